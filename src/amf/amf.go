@@ -69,3 +69,19 @@ func (a *Amf) DecodeBatch(r io.Reader, ver AmfVersion) ([]interface{}, error) {
 		}
 	}
 }
+
+//EncodeAvmplus writes val in an amf0 stream as amf3, i.e. avmplus-object-marker followed by the amf3 value
+func (a *Amf) EncodeAvmplus(w io.Writer, val interface{}) (int, error) {
+	if err := a.amf0.writeMarker(w, amf0AvmplusObjectMarker); err != nil {
+		return 0, err
+	}
+	amf3, err := newAmf3()
+	if err != nil {
+		return 0, err
+	}
+	n, err := amf3.encode(w, val)
+	if err != nil {
+		return 0, err
+	}
+	return 1 + n, nil
+}
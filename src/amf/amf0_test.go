@@ -567,6 +567,7 @@ func Test_amf0_decode(t *testing.T) {
 	{
 		buf := &bytes.Buffer{}
 		buf.WriteByte(amf0AvmplusObjectMarker)
+		buf.WriteByte(amf3NullMarker)
 		s, err := a.decode(buf)
 		assert.Equal(t, nil, s)
 		assert.NoError(t, err)
@@ -1,19 +1,544 @@
 package amf
 
-import "io"
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/zhyoulun/gls/src/core"
+	"github.com/zhyoulun/gls/src/utils"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+)
 
+//amf3 keeps the reference tables, so one amf3 should be used for one message only
 type amf3 struct {
+	stringRefs []string
+	objectRefs []interface{}
+	traitRefs  []*amf3Traits
+}
+
+type amf3Traits struct {
+	className      string
+	externalizable bool
+	dynamic        bool
+	sealedNames    []string
 }
 
 func newAmf3() (*amf3, error) {
 	return &amf3{}, nil
 }
 
+//integers are decoded as float64 too, just like amf0 numbers
 func (a *amf3) decode(r io.Reader) (interface{}, error) {
-	//todo
-	return nil, nil
+	marker, err := utils.ReadByte(r)
+	if err != nil {
+		return nil, err
+	}
+	switch marker {
+	case amf3UndefinedMarker, amf3NullMarker:
+		return nil, nil
+	case amf3FalseMarker:
+		return false, nil
+	case amf3TrueMarker:
+		return true, nil
+	case amf3IntegerMarker:
+		if n, err := a.decodeInteger(r); err != nil {
+			return nil, err
+		} else {
+			return float64(n), nil
+		}
+	case amf3DoubleMarker:
+		return a.decodeDouble(r)
+	case amf3StringMarker:
+		return a.decodeString(r)
+	case amf3XmlDocMarker, amf3XmlMarker:
+		return a.decodeXml(r)
+	case amf3DateMarker:
+		return a.decodeDate(r)
+	case amf3ArrayMarker:
+		return a.decodeArray(r)
+	case amf3ObjectMarker:
+		return a.decodeObject(r)
+	case amf3ByteArrayMarker:
+		return a.decodeByteArray(r)
+	}
+	return nil, errors.Errorf("amf3 decode, unknown marker %d", marker)
 }
 
+//references are never written, which is allowed by the spec
 func (a *amf3) encode(w io.Writer, val interface{}) (int, error) {
-	return 0, nil
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Invalid:
+		return a.encodeMarker(w, amf3NullMarker)
+	case reflect.Bool:
+		if v.Bool() {
+			return a.encodeMarker(w, amf3TrueMarker)
+		} else {
+			return a.encodeMarker(w, amf3FalseMarker)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := v.Int(); n >= amf3IntegerMin && n <= amf3IntegerMax {
+			return a.encodeInteger(w, int32(n))
+		} else {
+			return a.encodeDouble(w, float64(n))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n := v.Uint(); n <= amf3IntegerMax {
+			return a.encodeInteger(w, int32(n))
+		} else {
+			return a.encodeDouble(w, float64(n))
+		}
+	case reflect.Float32, reflect.Float64:
+		return a.encodeDouble(w, v.Float())
+	case reflect.Array, reflect.Slice:
+		if b, ok := val.([]byte); ok {
+			return a.encodeByteArray(w, b)
+		}
+		length := v.Len()
+		arr := make(AmfArray, 0, length)
+		for i := 0; i < length; i++ {
+			arr = append(arr, v.Index(i).Interface())
+		}
+		return a.encodeArray(w, arr)
+	case reflect.Map:
+		if obj, ok := val.(AmfObject); !ok {
+			return 0, fmt.Errorf("amf3 encode: unable to create object from map")
+		} else {
+			return a.encodeObject(w, "", obj)
+		}
+	case reflect.Ptr:
+		if obj, ok := val.(*AmfTypedObject); ok {
+			return a.encodeObject(w, obj.Type, obj.Object)
+		}
+	case reflect.String:
+		if n, err := a.encodeMarker(w, amf3StringMarker); err != nil {
+			return 0, err
+		} else {
+			nn, err := a.encodeUTF8(w, v.String())
+			if err != nil {
+				return 0, err
+			}
+			return n + nn, nil
+		}
+	}
+
+	return 0, fmt.Errorf("amf3 encode: unsupport v kind %v", v.Kind())
+}
+
+//U29 = 1 to 4 bytes, the high bit of the first 3 bytes tells whether there is one more byte,
+//all 8 bits of the 4th byte are used
+func (a *amf3) decodeU29(r io.Reader) (uint32, error) {
+	var n uint32
+	for i := 0; i < 4; i++ {
+		b, err := utils.ReadByte(r)
+		if err != nil {
+			return 0, err
+		}
+		if i == 3 {
+			return n<<8 | uint32(b), nil
+		}
+		n = n<<7 | uint32(b&0x7f)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return n, nil
+}
+
+func (a *amf3) decodeInteger(r io.Reader) (int32, error) {
+	n, err := a.decodeU29(r)
+	if err != nil {
+		return 0, err
+	}
+	//sign extend the 29 bit integer
+	return int32(n<<3) >> 3, nil
+}
+
+func (a *amf3) decodeDouble(r io.Reader) (float64, error) {
+	var n float64
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+//UTF-8-vr = U29S-ref | (U29S-value *(UTF8-char))
+//the empty string is never sent by reference
+func (a *amf3) decodeString(r io.Reader) (string, error) {
+	ref, err := a.decodeU29(r)
+	if err != nil {
+		return "", err
+	}
+	if ref&0x01 == 0 {
+		index := int(ref >> 1)
+		if index >= len(a.stringRefs) {
+			return "", errors.Errorf("amf3 decode string, invalid reference %d", index)
+		}
+		return a.stringRefs[index], nil
+	}
+	buf, err := a.readBytes(r, int(ref>>1))
+	if err != nil {
+		return "", err
+	}
+	s := string(buf)
+	if s != "" {
+		a.stringRefs = append(a.stringRefs, s)
+	}
+	return s, nil
+}
+
+//getObjectRef returns the referenced object if the U29O-ref is a reference,
+//otherwise the value part of the U29 is returned
+func (a *amf3) getObjectRef(r io.Reader) (interface{}, uint32, bool, error) {
+	ref, err := a.decodeU29(r)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if ref&0x01 == 0 {
+		index := int(ref >> 1)
+		if index >= len(a.objectRefs) {
+			return nil, 0, false, errors.Errorf("amf3 decode, invalid object reference %d", index)
+		}
+		return a.objectRefs[index], 0, true, nil
+	}
+	return nil, ref >> 1, false, nil
+}
+
+func (a *amf3) decodeXml(r io.Reader) (interface{}, error) {
+	obj, length, isRef, err := a.getObjectRef(r)
+	if err != nil || isRef {
+		return obj, err
+	}
+	buf, err := a.readBytes(r, int(length))
+	if err != nil {
+		return nil, err
+	}
+	s := string(buf)
+	a.objectRefs = append(a.objectRefs, s)
+	return s, nil
+}
+
+//date-type = date-marker (U29O-ref | (U29D-value date-time))
+//the milliseconds since 1970 are returned, just like amf0
+func (a *amf3) decodeDate(r io.Reader) (interface{}, error) {
+	obj, _, isRef, err := a.getObjectRef(r)
+	if err != nil || isRef {
+		return obj, err
+	}
+	n, err := a.decodeDouble(r)
+	if err != nil {
+		return nil, err
+	}
+	a.objectRefs = append(a.objectRefs, n)
+	return n, nil
+}
+
+//array-type = array-marker (U29O-ref | (U29A-value (UTF-8-empty | *(assoc-value) UTF-8-empty) *(value-type)))
+//an AmfArray is returned for the dense array,
+//an AmfObject is returned if there are associative values, with the dense values keyed by the index
+func (a *amf3) decodeArray(r io.Reader) (interface{}, error) {
+	obj, length, isRef, err := a.getObjectRef(r)
+	if err != nil || isRef {
+		return obj, err
+	}
+	index := len(a.objectRefs)
+	a.objectRefs = append(a.objectRefs, nil)
+
+	var assoc AmfObject
+	for {
+		key, err := a.decodeString(r)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			break
+		}
+		value, err := a.decode(r)
+		if err != nil {
+			return nil, err
+		}
+		if assoc == nil {
+			assoc = make(AmfObject)
+		}
+		assoc[key] = value
+	}
+	dense := make(AmfArray, 0, length)
+	for i := uint32(0); i < length; i++ {
+		value, err := a.decode(r)
+		if err != nil {
+			return nil, err
+		}
+		dense = append(dense, value)
+	}
+
+	if assoc == nil {
+		a.objectRefs[index] = dense
+		return dense, nil
+	}
+	for i, value := range dense {
+		assoc[strconv.Itoa(i)] = value
+	}
+	a.objectRefs[index] = assoc
+	return assoc, nil
+}
+
+//U29O-traits-ref = U29 ; 0b...01
+//U29O-traits-ext = U29 ; 0b...111
+//U29O-traits = U29 ; 0b...(dynamic)011, the sealed member count is in the high bits
+func (a *amf3) decodeTraits(ref uint32, r io.Reader) (*amf3Traits, error) {
+	if ref&0x01 == 0 {
+		index := int(ref >> 1)
+		if index >= len(a.traitRefs) {
+			return nil, errors.Errorf("amf3 decode traits, invalid reference %d", index)
+		}
+		return a.traitRefs[index], nil
+	}
+	traits := &amf3Traits{}
+	var err error
+	if traits.className, err = a.decodeString(r); err != nil {
+		return nil, err
+	}
+	if ref&0x02 != 0 {
+		traits.externalizable = true
+		return traits, nil
+	}
+	traits.dynamic = ref&0x04 != 0
+	count := int(ref >> 3)
+	traits.sealedNames = make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		name, err := a.decodeString(r)
+		if err != nil {
+			return nil, err
+		}
+		traits.sealedNames = append(traits.sealedNames, name)
+	}
+	a.traitRefs = append(a.traitRefs, traits)
+	return traits, nil
+}
+
+//object-type = object-marker (U29O-ref | (U29O-traits-ext class-name *(U8)) | U29O-traits-ref | (U29O-traits class-name *(UTF-8-vr))) *(value-type) *(dynamic-member)))
+//an AmfObject is returned for the anonymous object, an AmfTypedObject for the others
+func (a *amf3) decodeObject(r io.Reader) (interface{}, error) {
+	obj, ref, isRef, err := a.getObjectRef(r)
+	if err != nil || isRef {
+		return obj, err
+	}
+	traits, err := a.decodeTraits(ref, r)
+	if err != nil {
+		return nil, err
+	}
+	if traits.externalizable {
+		//the format is only known by the class itself
+		return nil, errors.Wrapf(core.ErrorNotSupported, "amf3 externalizable object, class name: %s", traits.className)
+	}
+
+	result := make(AmfObject)
+	var typed *AmfTypedObject
+	if traits.className != "" {
+		typed = &AmfTypedObject{Type: traits.className, Object: result}
+		a.objectRefs = append(a.objectRefs, typed)
+	} else {
+		a.objectRefs = append(a.objectRefs, result)
+	}
+
+	for _, name := range traits.sealedNames {
+		value, err := a.decode(r)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = value
+	}
+	if traits.dynamic {
+		for {
+			key, err := a.decodeString(r)
+			if err != nil {
+				return nil, err
+			}
+			if key == "" {
+				break
+			}
+			value, err := a.decode(r)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = value
+		}
+	}
+
+	if typed != nil {
+		return typed, nil
+	}
+	return result, nil
+}
+
+//bytearray-type = bytearray-marker (U29O-ref | U29B-value *(U8))
+func (a *amf3) decodeByteArray(r io.Reader) (interface{}, error) {
+	obj, length, isRef, err := a.getObjectRef(r)
+	if err != nil || isRef {
+		return obj, err
+	}
+	buf, err := a.readBytes(r, int(length))
+	if err != nil {
+		return nil, err
+	}
+	a.objectRefs = append(a.objectRefs, buf)
+	return buf, nil
+}
+
+//the empty string may be the last bytes of a message, reading 0 bytes at the end would get io.EOF
+func (a *amf3) readBytes(r io.Reader, n int) ([]byte, error) {
+	if n == 0 {
+		return []byte{}, nil
+	}
+	return utils.ReadBytes(r, n)
+}
+
+func (a *amf3) encodeMarker(w io.Writer, marker byte) (int, error) {
+	if err := utils.WriteByte(w, marker); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (a *amf3) encodeU29(w io.Writer, n uint32) (int, error) {
+	var buf []byte
+	switch {
+	case n < 0x80:
+		buf = []byte{byte(n)}
+	case n < 0x4000:
+		buf = []byte{byte(n>>7 | 0x80), byte(n & 0x7f)}
+	case n < 0x200000:
+		buf = []byte{byte(n>>14 | 0x80), byte(n>>7 | 0x80), byte(n & 0x7f)}
+	case n <= amf3U29Max:
+		buf = []byte{byte(n>>22 | 0x80), byte(n>>15 | 0x80), byte(n>>8 | 0x80), byte(n)}
+	default:
+		return 0, errors.Errorf("amf3 encode u29, out of range: %d", n)
+	}
+	if err := utils.WriteBytes(w, buf); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (a *amf3) encodeInteger(w io.Writer, n int32) (int, error) {
+	if _, err := a.encodeMarker(w, amf3IntegerMarker); err != nil {
+		return 0, err
+	}
+	if nn, err := a.encodeU29(w, uint32(n)&amf3U29Max); err != nil {
+		return 0, err
+	} else {
+		return 1 + nn, nil
+	}
+}
+
+func (a *amf3) encodeDouble(w io.Writer, num float64) (int, error) {
+	if _, err := a.encodeMarker(w, amf3DoubleMarker); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.BigEndian, math.Float64bits(num)); err != nil {
+		return 0, err
+	}
+	return 9, nil
+}
+
+//UTF-8-vr without marker, always by value
+func (a *amf3) encodeUTF8(w io.Writer, s string) (int, error) {
+	if len(s) > amf3U29Max>>1 {
+		return 0, errors.Errorf("amf3 encode string, too long: %d", len(s))
+	}
+	n, err := a.encodeU29(w, uint32(len(s))<<1|0x01)
+	if err != nil {
+		return 0, err
+	}
+	if err := utils.WriteBytes(w, []byte(s)); err != nil {
+		return 0, err
+	}
+	return n + len(s), nil
+}
+
+func (a *amf3) encodeArray(w io.Writer, arr AmfArray) (int, error) {
+	n := 0
+	if nn, err := a.encodeMarker(w, amf3ArrayMarker); err != nil {
+		return 0, err
+	} else {
+		n += nn
+	}
+	if nn, err := a.encodeU29(w, uint32(len(arr))<<1|0x01); err != nil {
+		return 0, err
+	} else {
+		n += nn
+	}
+	//no associative values
+	if nn, err := a.encodeUTF8(w, ""); err != nil {
+		return 0, err
+	} else {
+		n += nn
+	}
+	for _, v := range arr {
+		if nn, err := a.encode(w, v); err != nil {
+			return 0, err
+		} else {
+			n += nn
+		}
+	}
+	return n, nil
+}
+
+//all the members are written as dynamic members, no sealed member
+func (a *amf3) encodeObject(w io.Writer, className string, obj AmfObject) (int, error) {
+	n := 0
+	if nn, err := a.encodeMarker(w, amf3ObjectMarker); err != nil {
+		return 0, err
+	} else {
+		n += nn
+	}
+	//U29O-traits, dynamic, 0 sealed member
+	if nn, err := a.encodeU29(w, 0x0b); err != nil {
+		return 0, err
+	} else {
+		n += nn
+	}
+	if nn, err := a.encodeUTF8(w, className); err != nil {
+		return 0, err
+	} else {
+		n += nn
+	}
+	for k, v := range obj {
+		if k == "" {
+			return 0, errors.Errorf("amf3 encode object, empty key")
+		}
+		if nn, err := a.encodeUTF8(w, k); err != nil {
+			return 0, err
+		} else {
+			n += nn
+		}
+		if nn, err := a.encode(w, v); err != nil {
+			return 0, err
+		} else {
+			n += nn
+		}
+	}
+	if nn, err := a.encodeUTF8(w, ""); err != nil {
+		return 0, err
+	} else {
+		n += nn
+	}
+	return n, nil
+}
+
+func (a *amf3) encodeByteArray(w io.Writer, b []byte) (int, error) {
+	if _, err := a.encodeMarker(w, amf3ByteArrayMarker); err != nil {
+		return 0, err
+	}
+	n, err := a.encodeU29(w, uint32(len(b))<<1|0x01)
+	if err != nil {
+		return 0, err
+	}
+	if err := utils.WriteBytes(w, b); err != nil {
+		return 0, err
+	}
+	return 1 + n + len(b), nil
 }
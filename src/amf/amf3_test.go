@@ -0,0 +1,151 @@
+package amf
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_amf3_U29(t *testing.T) {
+	a, _ := newAmf3()
+	cases := []struct {
+		n   uint32
+		buf []byte
+	}{
+		{0x00, []byte{0x00}},
+		{0x7f, []byte{0x7f}},
+		{0x80, []byte{0x81, 0x00}},
+		{0x3fff, []byte{0xff, 0x7f}},
+		{0x4000, []byte{0x81, 0x80, 0x00}},
+		{0x1fffff, []byte{0xff, 0xff, 0x7f}},
+		{0x200000, []byte{0x80, 0xc0, 0x80, 0x00}},
+		{0x1fffffff, []byte{0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		n, err := a.encodeU29(buf, c.n)
+		assert.NoError(t, err)
+		assert.Equal(t, len(c.buf), n)
+		assert.Equal(t, c.buf, buf.Bytes())
+
+		got, err := a.decodeU29(bytes.NewReader(c.buf))
+		assert.NoError(t, err)
+		assert.Equal(t, c.n, got)
+	}
+	{
+		_, err := a.encodeU29(&bytes.Buffer{}, 0x20000000)
+		assert.Error(t, err)
+	}
+}
+
+func Test_amf3_decode(t *testing.T) {
+	{
+		a, _ := newAmf3()
+		//integer -1
+		v, err := a.decode(bytes.NewReader([]byte{amf3IntegerMarker, 0xff, 0xff, 0xff, 0xff}))
+		assert.NoError(t, err)
+		assert.Equal(t, float64(-1), v)
+	}
+	{
+		a, _ := newAmf3()
+		//"abc", then the reference of "abc"
+		r := bytes.NewReader([]byte{amf3StringMarker, 0x07, 'a', 'b', 'c', amf3StringMarker, 0x00})
+		vs := make([]interface{}, 0)
+		for i := 0; i < 2; i++ {
+			v, err := a.decode(r)
+			assert.NoError(t, err)
+			vs = append(vs, v)
+		}
+		assert.Equal(t, []interface{}{"abc", "abc"}, vs)
+	}
+	{
+		a, _ := newAmf3()
+		//anonymous dynamic object {app: "live", objectEncoding: 3}
+		buf := []byte{amf3ObjectMarker, 0x0b, 0x01,
+			0x07, 'a', 'p', 'p', amf3StringMarker, 0x09, 'l', 'i', 'v', 'e',
+			0x1d, 'o', 'b', 'j', 'e', 'c', 't', 'E', 'n', 'c', 'o', 'd', 'i', 'n', 'g', amf3IntegerMarker, 0x03,
+			0x01}
+		v, err := a.decode(bytes.NewReader(buf))
+		assert.NoError(t, err)
+		assert.Equal(t, AmfObject{"app": "live", "objectEncoding": float64(3)}, v)
+	}
+	{
+		a, _ := newAmf3()
+		//typed object with one sealed member, then a trait reference
+		buf := []byte{amf3ObjectMarker, 0x13, 0x07, 'F', 'o', 'o', 0x03, 'x', amf3TrueMarker,
+			amf3ObjectMarker, 0x01, amf3FalseMarker}
+		r := bytes.NewReader(buf)
+		v, err := a.decode(r)
+		assert.NoError(t, err)
+		assert.Equal(t, &AmfTypedObject{Type: "Foo", Object: AmfObject{"x": true}}, v)
+		v, err = a.decode(r)
+		assert.NoError(t, err)
+		assert.Equal(t, &AmfTypedObject{Type: "Foo", Object: AmfObject{"x": false}}, v)
+	}
+	{
+		a, _ := newAmf3()
+		//externalizable object
+		_, err := a.decode(bytes.NewReader([]byte{amf3ObjectMarker, 0x07, 0x03, 'F'}))
+		assert.Error(t, err)
+	}
+	{
+		a, _ := newAmf3()
+		//invalid string reference
+		_, err := a.decode(bytes.NewReader([]byte{amf3StringMarker, 0x02}))
+		assert.Error(t, err)
+	}
+}
+
+func Test_amf3_encode(t *testing.T) {
+	values := []interface{}{
+		nil,
+		true,
+		false,
+		float64(1.5),
+		"",
+		"abc",
+		AmfArray{"a", float64(1), nil},
+		AmfObject{"level": "status", "objectEncoding": float64(3), "list": AmfArray{"x"}},
+		&AmfTypedObject{Type: "Foo", Object: AmfObject{"x": "y"}},
+		[]byte{0x01, 0x02},
+	}
+	for _, v := range values {
+		a, _ := newAmf3()
+		buf := &bytes.Buffer{}
+		n, err := a.encode(buf, v)
+		assert.NoError(t, err)
+		assert.Equal(t, buf.Len(), n)
+
+		b, _ := newAmf3()
+		got, err := b.decode(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, v, got)
+		assert.Equal(t, 0, buf.Len())
+	}
+	{
+		a, _ := newAmf3()
+		buf := &bytes.Buffer{}
+		_, err := a.encode(buf, 3)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{amf3IntegerMarker, 0x03}, buf.Bytes())
+	}
+	{
+		a, _ := newAmf3()
+		buf := &bytes.Buffer{}
+		_, err := a.encode(buf, -1)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{amf3IntegerMarker, 0xff, 0xff, 0xff, 0xff}, buf.Bytes())
+	}
+}
+
+func TestAmf_EncodeAvmplus(t *testing.T) {
+	a, _ := NewAmf()
+	buf := &bytes.Buffer{}
+	_, err := a.Encode(buf, "connect", Amf0)
+	assert.NoError(t, err)
+	_, err = a.EncodeAvmplus(buf, AmfObject{"app": "live"})
+	assert.NoError(t, err)
+	vs, err := a.DecodeBatch(buf, Amf0)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"connect", AmfObject{"app": "live"}}, vs)
+}
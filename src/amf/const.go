@@ -36,3 +36,25 @@ const (
 	Amf0 AmfVersion = 0x00
 	Amf3 AmfVersion = 0x03
 )
+
+const (
+	amf3UndefinedMarker = 0x00
+	amf3NullMarker      = 0x01
+	amf3FalseMarker     = 0x02
+	amf3TrueMarker      = 0x03
+	amf3IntegerMarker   = 0x04
+	amf3DoubleMarker    = 0x05
+	amf3StringMarker    = 0x06
+	amf3XmlDocMarker    = 0x07
+	amf3DateMarker      = 0x08
+	amf3ArrayMarker     = 0x09
+	amf3ObjectMarker    = 0x0a
+	amf3XmlMarker       = 0x0b
+	amf3ByteArrayMarker = 0x0c
+)
+
+const (
+	amf3IntegerMin = -1 << 28 //integer-type is a 29 bit signed integer
+	amf3IntegerMax = 1<<28 - 1
+	amf3U29Max     = 1<<29 - 1
+)
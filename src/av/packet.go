@@ -8,6 +8,7 @@ type Packet struct {
 	avType          uint8
 	streamID        uint32
 	timestamp       uint32
+	timestamp64     int64 //the timestamp following the 32 bits rollover, e.g. of a 24/7 channel
 	data            []byte
 	audioTagHandler AudioTagI
 	videoTagHandler VideoTagI
@@ -25,25 +26,35 @@ type MessageI interface {
 	GetAvType() (uint8, error)
 	GetMessageStreamID() uint32
 	GetTimestamp() uint32
+	GetTimestamp64() int64
 	GetData() []byte
 }
 
 func NewPacket(csi MessageI, di DemuxerI) (*Packet, error) {
-	var err error
 	avType, err := csi.GetAvType()
 	if err != nil {
 		return nil, err
 	}
+	return newPacket(avType, csi.GetMessageStreamID(), csi.GetTimestamp64(), csi.GetData(), di)
+}
+
+//NewPacketFromData creates a packet from an flv tag body, for packets not read from a rtmp message
+func NewPacketFromData(avType uint8, timestamp uint32, data []byte, di DemuxerI) (*Packet, error) {
+	return newPacket(avType, 0, int64(timestamp), data, di)
+}
 
+//the 32 bits timestamp is the lower 32 bits of timestamp64
+func newPacket(avType uint8, streamID uint32, timestamp64 int64, data []byte, di DemuxerI) (*Packet, error) {
+	var err error
 	var audioTagHandler AudioTagI
 	var videoTagHandler VideoTagI
 	switch avType {
 	case TypeAudio:
-		if audioTagHandler, err = di.ParseAudioTag(csi.GetData()); err != nil {
+		if audioTagHandler, err = di.ParseAudioTag(data); err != nil {
 			return nil, err
 		}
 	case TypeVideo:
-		if videoTagHandler, err = di.ParseVideoTag(csi.GetData()); err != nil {
+		if videoTagHandler, err = di.ParseVideoTag(data); err != nil {
 			return nil, err
 		}
 	case TypeMetadata:
@@ -52,9 +63,10 @@ func NewPacket(csi MessageI, di DemuxerI) (*Packet, error) {
 
 	return &Packet{
 		avType:          avType,
-		streamID:        csi.GetMessageStreamID(),
-		timestamp:       csi.GetTimestamp(),
-		data:            csi.GetData(),
+		streamID:        streamID,
+		timestamp:       uint32(timestamp64),
+		timestamp64:     timestamp64,
+		data:            data,
 		audioTagHandler: audioTagHandler,
 		videoTagHandler: videoTagHandler,
 	}, nil
@@ -93,6 +105,11 @@ func (p *Packet) getAvTypeName() string {
 	}
 }
 
+//GetTimestamp64 is the timestamp which does not wrap around, GetTimestamp is its lower 32 bits as sent in rtmp
+func (p *Packet) GetTimestamp64() int64 {
+	return p.timestamp64
+}
+
 func (p *Packet) GetData() []byte {
 	return p.data
 }
@@ -125,6 +142,13 @@ type AudioTagI interface {
 type VideoTagI interface {
 	FrameType() uint8
 	AVCPacketType() uint8
+	CompositionTime() int32
+	//IsExHeader reports whether the tag is of enhanced rtmp, e.g. hevc, av1 and vp9
+	IsExHeader() bool
+	//PacketType is the PacketType of enhanced rtmp, the AVCPacketType of the legacy avc has the same values
+	PacketType() uint8
+	//FourCC is the codec, e.g. avc1, hvc1, av01 and vp09
+	FourCC() string
 }
 
 type DemuxerI interface {
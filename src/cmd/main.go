@@ -1,12 +1,15 @@
 package main
 
 import (
+	"flag"
 	log "github.com/sirupsen/logrus"
 	"github.com/zhyoulun/gls/src/server"
 	"github.com/zhyoulun/gls/src/stream"
 	"github.com/zhyoulun/gls/src/utils/debug"
 	"net"
+	"net/http"
 	"os"
+	"time"
 )
 
 func Init() error {
@@ -28,14 +31,46 @@ func InitLog() error {
 	return nil
 }
 
+var (
+	addr        = flag.String("addr", "127.0.0.1:1935", "rtmp listen address")
+	tlsAddr     = flag.String("tls-addr", "", "rtmps listen address, e.g. 127.0.0.1:443, empty means disabled")
+	tlsCertFile = flag.String("tls-cert", "", "rtmps certificate file")
+	tlsKeyFile  = flag.String("tls-key", "", "rtmps private key file")
+	rtmptAddr   = flag.String("rtmpt-addr", "", "rtmpt(rtmp over http) listen address, e.g. 127.0.0.1:80, empty means disabled")
+
+	pingInterval  = flag.Duration("ping-interval", 10*time.Second, "interval of the ping request sent to each conn, 0 means disabled")
+	pingMaxMissed = flag.Int("ping-max-missed", 3, "the conn is closed after this many ping requests in a row are not responded")
+
+	recordDir = flag.String("record-dir", "", "dir of the recorded streams to play, publish with record or append, <dir>/<app>/<stream name>.flv, empty means disabled")
+)
+
 func main() {
+	flag.Parse()
 	if err := Init(); err != nil {
 		panic(err)
 	}
+	stream.Mgr.SetRecordDir(*recordDir)
 
-	addr := "127.0.0.1:1935"
-	log.Infof("start golang live server: %s", addr)
-	ln, err := net.Listen("tcp", addr)
+	if *tlsAddr != "" {
+		log.Infof("start golang live server(rtmps): %s", *tlsAddr)
+		ln, err := server.ListenTLS(*tlsAddr, *tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			log.Fatalf("server ListenTLS err: %s", err)
+		}
+		rtmpsServer, err := server.NewServer(ln)
+		if err != nil {
+			log.Fatalf("rtmps NewServer err: %s", err)
+		}
+		rtmpsServer.SetPing(*pingInterval, *pingMaxMissed)
+		go func() {
+			if err := rtmpsServer.Serve(); err != nil {
+				log.Fatalf("rtmpsServer Serve err: %s", err)
+			}
+		}()
+	}
+
+	log.Infof("start golang live server: %s", *addr)
+	ln, err := net.Listen("tcp", *addr)
 	if err != nil {
 		log.Fatalf("net Listen err: %s", err)
 	}
@@ -43,6 +78,17 @@ func main() {
 	if err != nil {
 		log.Fatalf("rtmp NewServer err: %s", err)
 	}
+	rtmpServer.SetPing(*pingInterval, *pingMaxMissed)
+
+	if *rtmptAddr != "" {
+		log.Infof("start golang live server(rtmpt): %s", *rtmptAddr)
+		go func() {
+			if err := http.ListenAndServe(*rtmptAddr, server.NewRTMPTHandler(rtmpServer)); err != nil {
+				log.Fatalf("rtmpt ListenAndServe err: %s", err)
+			}
+		}()
+	}
+
 	if err := rtmpServer.Serve(); err != nil {
 		log.Fatalf("rtmpServer Serve err: %s", err)
 	}
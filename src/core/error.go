@@ -12,4 +12,10 @@ var (
 	ErrorAlreadyExist     = errors.Errorf("already exist")
 	ErrorDuplicatePublish = errors.Errorf("duplicate publish") //重复推流
 	ErrorInvalidData      = errors.Errorf("invalid data")      //不合法的数据
+	ErrorClosed           = errors.Errorf("closed")
+	ErrorStreamNotFound   = errors.Errorf("stream not found") //播放的流不存在
+	ErrorRejected         = errors.Errorf("rejected")         //connect, publish or play is refused, the conn is closed after the error status
+	ErrorStreamClosed     = errors.Errorf("stream closed")    //NetStream closed by FCUnpublish, deleteStream or closeStream, the NetConnection is kept
+	ErrorNoAccess         = errors.Errorf("no access")        //the recorded stream can not be written
+	ErrorTimeout          = errors.Errorf("timeout")          //the peer does not respond in time, e.g. the acknowledgement
 )
@@ -1,5 +1,21 @@
 package flv
 
+//TagType of the flv file, the same as the rtmp message type of audio, video and amf0 data
+const (
+	TagTypeAudio      = 8
+	TagTypeVideo      = 9
+	TagTypeScriptData = 18
+)
+
+//the flv file header, "FLV" + version(1 byte) + flags(1 byte) + data offset(4 bytes)
+const (
+	headerSize       = 9
+	headerVersion    = 1
+	headerFlagsAudio = 0x04
+	headerFlagsVideo = 0x01
+	tagHeaderSize    = 11
+)
+
 //Format of SoundData
 //Format 7,8,14 and 15 are reserved for internal use
 //AAC is supported in Flash Player 9,0,115,0 and higher
@@ -75,3 +91,30 @@ const (
 	AVCPacketTypeAVCNALU           = 1 //avc nalu
 	AVCPacketTypeAVCEndOfSequence  = 2 //avc end of sequence(lower level nalu sequence ender is not required or supported)
 )
+
+//enhanced rtmp, the IsExHeader bit is the highest bit of the first byte of the video tag,
+//FrameType is the next 3 bits, and PacketType is the lower 4 bits instead of CodecID, the FourCC follows
+const (
+	VideoTagExHeaderFlag = 0x80
+)
+
+//PacketType of enhanced rtmp, the legacy AVCPacketType has the same values for the sequence header, nalu and end of sequence
+const (
+	PacketTypeSequenceStart        = 0 //the decoder configuration record, e.g. HEVCDecoderConfigurationRecord
+	PacketTypeCodedFrames          = 1 //followed by SI24 composition time for hvc1
+	PacketTypeSequenceEnd          = 2
+	PacketTypeCodedFramesX         = 3 //the composition time is implied to be 0
+	PacketTypeMetadata             = 4 //amf encoded, e.g. the hdr metadata
+	PacketTypeMPEG2TSSequenceStart = 5
+)
+
+//FourCC of the video codecs of enhanced rtmp
+const (
+	FourCCAVC  = "avc1" //the legacy codec id 7 is reported as it
+	FourCCHEVC = "hvc1"
+	FourCCAV1  = "av01"
+	FourCCVP9  = "vp09"
+)
+
+//FourCCList is advertised by connect
+var FourCCList = []string{FourCCAV1, FourCCVP9, FourCCHEVC}
@@ -54,6 +54,9 @@ func (d *Demuxer) ParseVideoTag(b []byte) (av.VideoTagI, error) {
 		return nil, errors.Errorf("invalid videodata length, want>=5, got: %d", len(b))
 	}
 	flags := b[0]
+	if flags&VideoTagExHeaderFlag != 0 {
+		return d.parseExVideoTag(b)
+	}
 	tag.frameType = flags >> 4
 	tag.codecID = flags & 0xf
 	if tag.frameType != FrameTypeInterFrame && tag.frameType != FrameTypeKeyFrame {
@@ -75,3 +78,36 @@ func (d *Demuxer) ParseVideoTag(b []byte) (av.VideoTagI, error) {
 
 	return tag, nil
 }
+
+//parseExVideoTag parses the video tag of enhanced rtmp,
+//IsExHeader(1 bit) + FrameType(3 bits) + PacketType(4 bits) + FourCC(4 bytes) + the body of the PacketType
+func (d *Demuxer) parseExVideoTag(b []byte) (av.VideoTagI, error) {
+	tag := &VideoTag{}
+	tag.isExHeader = true
+	tag.frameType = (b[0] >> 4) & 0x7
+	tag.packetType = b[0] & 0xf
+	tag.fourCC = string(b[1:5])
+	if tag.frameType < FrameTypeKeyFrame || tag.frameType > FrameTypeVideoInfoCommandFrame {
+		return nil, errors.Wrapf(core.ErrorInvalidData, "invalid enhanced videodata frameType: %d", tag.frameType)
+	}
+	switch tag.fourCC {
+	case FourCCAVC, FourCCHEVC, FourCCAV1, FourCCVP9:
+	default:
+		return nil, errors.Wrapf(core.ErrorNotSupported, "enhanced videodata FourCC: %q", tag.fourCC)
+	}
+	switch tag.packetType {
+	case PacketTypeCodedFrames:
+		//only avc1 and hvc1 carry the composition time
+		if tag.fourCC == FourCCAVC || tag.fourCC == FourCCHEVC {
+			if len(b) < 8 {
+				return nil, errors.Errorf("invalid enhanced videodata length, want>=8, got: %d", len(b))
+			}
+			//SI24
+			tag.compositionTime = int32(uint32(b[5])<<24|uint32(b[6])<<16|uint32(b[7])<<8) >> 8
+		}
+	case PacketTypeSequenceStart, PacketTypeSequenceEnd, PacketTypeCodedFramesX, PacketTypeMetadata, PacketTypeMPEG2TSSequenceStart:
+	default:
+		return nil, errors.Wrapf(core.ErrorNotSupported, "enhanced videodata PacketType: %d", tag.packetType)
+	}
+	return tag, nil
+}
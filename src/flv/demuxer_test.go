@@ -0,0 +1,55 @@
+package flv
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhyoulun/gls/src/core"
+	"testing"
+)
+
+func TestDemuxer_ParseVideoTag(t *testing.T) {
+	d := NewDemuxer()
+	tests := []struct {
+		name            string
+		data            []byte
+		frameType       uint8
+		packetType      uint8
+		fourCC          string
+		compositionTime int32
+	}{
+		{"avc sequence header", []byte{0x17, AVCPacketTypeAVCSequenceHeader, 0x00, 0x00, 0x00}, FrameTypeKeyFrame, PacketTypeSequenceStart, FourCCAVC, 0},
+		{"avc nalu", []byte{0x27, AVCPacketTypeAVCNALU, 0x00, 0x00, 0x28}, FrameTypeInterFrame, PacketTypeCodedFrames, FourCCAVC, 40},
+		{"hevc sequence start", []byte{0x90 | PacketTypeSequenceStart, 'h', 'v', 'c', '1', 0x01}, FrameTypeKeyFrame, PacketTypeSequenceStart, FourCCHEVC, 0},
+		{"hevc coded frames", []byte{0x90 | PacketTypeCodedFrames, 'h', 'v', 'c', '1', 0xff, 0xff, 0xd8, 0x01}, FrameTypeKeyFrame, PacketTypeCodedFrames, FourCCHEVC, -40},
+		{"hevc coded frames x", []byte{0xa0 | PacketTypeCodedFramesX, 'h', 'v', 'c', '1', 0x01}, FrameTypeInterFrame, PacketTypeCodedFramesX, FourCCHEVC, 0},
+		{"av1 coded frames", []byte{0x90 | PacketTypeCodedFrames, 'a', 'v', '0', '1', 0x01}, FrameTypeKeyFrame, PacketTypeCodedFrames, FourCCAV1, 0},
+		{"vp9 sequence end", []byte{0x90 | PacketTypeSequenceEnd, 'v', 'p', '0', '9'}, FrameTypeKeyFrame, PacketTypeSequenceEnd, FourCCVP9, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tag, err := d.ParseVideoTag(tt.data)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.data[0]&VideoTagExHeaderFlag != 0, tag.IsExHeader())
+			assert.Equal(t, tt.frameType, tag.FrameType())
+			assert.Equal(t, tt.packetType, tag.PacketType())
+			assert.Equal(t, tt.fourCC, tag.FourCC())
+			assert.Equal(t, tt.compositionTime, tag.CompositionTime())
+		})
+	}
+}
+
+func TestDemuxer_ParseVideoTag_invalid(t *testing.T) {
+	d := NewDemuxer()
+	_, err := d.ParseVideoTag([]byte{0x90 | PacketTypeCodedFrames, 'x', 'x', 'x', 'x'})
+	assert.Equal(t, core.ErrorNotSupported, errors.Cause(err))
+	_, err = d.ParseVideoTag([]byte{0x90 | 0x0f, 'h', 'v', 'c', '1'})
+	assert.Equal(t, core.ErrorNotSupported, errors.Cause(err))
+	//the composition time is missing
+	_, err = d.ParseVideoTag([]byte{0x90 | PacketTypeCodedFrames, 'h', 'v', 'c', '1', 0x00})
+	assert.Error(t, err)
+	//the legacy codec id 12, used for hevc by some servers, is not supported
+	_, err = d.ParseVideoTag([]byte{0x1c, 0x00, 0x00, 0x00, 0x00})
+	assert.Error(t, err)
+}
@@ -0,0 +1,79 @@
+package flv
+
+import (
+	"github.com/pkg/errors"
+	"github.com/zhyoulun/gls/src/core"
+	"github.com/zhyoulun/gls/src/utils"
+	"io"
+)
+
+//Tag is the tag of the flv file, the data is the same as the rtmp message of the tag type
+type Tag struct {
+	TagType   uint8
+	Timestamp uint32 //milliseconds, the lower 24 bits and the extended upper 8 bits in the file
+	Data      []byte
+}
+
+//Reader reads the tags of the flv file,
+//header + previous tag size 0(4 bytes) + (tag header(11 bytes) + data + previous tag size(4 bytes))*
+type Reader struct {
+	r io.Reader
+}
+
+//NewReader reads the header of the flv file
+func NewReader(r io.Reader) (*Reader, error) {
+	header, err := utils.ReadBytes(r, headerSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "read flv header")
+	}
+	if string(header[:3]) != "FLV" || header[3] != headerVersion {
+		return nil, errors.Wrapf(core.ErrorInvalidData, "flv header: %x", header)
+	}
+	dataOffset := uint32(header[5])<<24 | uint32(header[6])<<16 | uint32(header[7])<<8 | uint32(header[8])
+	if dataOffset < headerSize {
+		return nil, errors.Wrapf(core.ErrorInvalidData, "flv data offset: %d", dataOffset)
+	}
+	//the header may be extended by a later version
+	if _, err := readBytes(r, int(dataOffset-headerSize)); err != nil {
+		return nil, err
+	}
+	if _, err := utils.ReadUintBE(r, 4); err != nil {
+		return nil, errors.Wrap(err, "read previous tag size 0")
+	}
+	return &Reader{r: r}, nil
+}
+
+//ReadTag reads the next tag, io.EOF is returned at the end of the file
+func (r *Reader) ReadTag() (*Tag, error) {
+	header, err := utils.ReadBytes(r.r, tagHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	//the filter bit of the encrypted tag is not supported
+	tagType := header[0] & 0x1f
+	if header[0]&0x20 != 0 {
+		return nil, errors.Wrapf(core.ErrorNotSupported, "encrypted flv tag")
+	}
+	dataSize := uint32(header[1])<<16 | uint32(header[2])<<8 | uint32(header[3])
+	data, err := readBytes(r.r, int(dataSize))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read flv tag data, size: %d", dataSize)
+	}
+	if _, err := utils.ReadUintBE(r.r, 4); err != nil {
+		return nil, errors.Wrap(err, "read previous tag size")
+	}
+	return &Tag{TagType: tagType, Timestamp: tagTimestamp(header), Data: data}, nil
+}
+
+//tagTimestamp is the lower 24 bits and the extended upper 8 bits of the tag header
+func tagTimestamp(header []byte) uint32 {
+	return uint32(header[7])<<24 | uint32(header[4])<<16 | uint32(header[5])<<8 | uint32(header[6])
+}
+
+//the data of a tag may be empty
+func readBytes(r io.Reader, n int) ([]byte, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	return utils.ReadBytes(r, n)
+}
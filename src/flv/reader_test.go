@@ -0,0 +1,41 @@
+package flv
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhyoulun/gls/src/core"
+	"io"
+	"testing"
+)
+
+func TestReader_ReadTag(t *testing.T) {
+	data := []byte{
+		'F', 'L', 'V', 0x01, headerFlagsAudio | headerFlagsVideo, 0x00, 0x00, 0x00, 0x09,
+		0x00, 0x00, 0x00, 0x00,
+		//audio, 2 bytes, timestamp 40
+		TagTypeAudio, 0x00, 0x00, 0x02, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00, 0x00,
+		0xaf, 0x01,
+		0x00, 0x00, 0x00, 0x0d,
+		//video, empty, timestamp 0x01020304 with the extended byte
+		TagTypeVideo, 0x00, 0x00, 0x00, 0x02, 0x03, 0x04, 0x01, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x0b,
+	}
+	r, err := NewReader(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	tag, err := r.ReadTag()
+	assert.NoError(t, err)
+	assert.Equal(t, &Tag{TagType: TagTypeAudio, Timestamp: 40, Data: []byte{0xaf, 0x01}}, tag)
+	tag, err = r.ReadTag()
+	assert.NoError(t, err)
+	assert.Equal(t, &Tag{TagType: TagTypeVideo, Timestamp: 0x01020304}, tag)
+	_, err = r.ReadTag()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestNewReader_invalid(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte{'F', 'L', 'X', 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}))
+	assert.Equal(t, core.ErrorInvalidData, errors.Cause(err))
+}
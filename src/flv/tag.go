@@ -21,6 +21,13 @@ type avcVideoPacket struct {
 	compositionTime int32
 }
 
+//exVideoPacket is the header of enhanced rtmp
+type exVideoPacket struct {
+	isExHeader bool
+	packetType uint8
+	fourCC     string
+}
+
 type AudioTag struct {
 	audioData
 	aacAudioData
@@ -29,6 +36,7 @@ type AudioTag struct {
 type VideoTag struct {
 	videoData
 	avcVideoPacket
+	exVideoPacket
 }
 
 func (at *AudioTag) SoundFormat() uint8 {
@@ -46,3 +54,27 @@ func (vt *VideoTag) FrameType() uint8 {
 func (vt *VideoTag) AVCPacketType() uint8 {
 	return vt.avcPacketType
 }
+
+func (vt *VideoTag) CompositionTime() int32 {
+	return vt.compositionTime
+}
+
+func (vt *VideoTag) IsExHeader() bool {
+	return vt.isExHeader
+}
+
+//PacketType is the PacketType of enhanced rtmp, or the AVCPacketType of the legacy avc
+func (vt *VideoTag) PacketType() uint8 {
+	if vt.isExHeader {
+		return vt.packetType
+	}
+	return vt.avcPacketType
+}
+
+//FourCC is the codec, avc1 for the legacy avc
+func (vt *VideoTag) FourCC() string {
+	if vt.isExHeader {
+		return vt.fourCC
+	}
+	return FourCCAVC
+}
@@ -0,0 +1,99 @@
+package flv
+
+import (
+	"github.com/pkg/errors"
+	"github.com/zhyoulun/gls/src/core"
+	"github.com/zhyoulun/gls/src/utils"
+	"io"
+)
+
+const maxTagDataSize = 0xffffff //the data size of the tag header is 3 bytes
+
+//Writer writes the tags of the flv file, in the layout read by Reader
+type Writer struct {
+	w io.Writer
+}
+
+//NewWriter writes the header of a new flv file, both the audio and video flags are set
+func NewWriter(w io.Writer) (*Writer, error) {
+	header := []byte{'F', 'L', 'V', headerVersion, headerFlagsAudio | headerFlagsVideo, 0x00, 0x00, 0x00, headerSize}
+	if err := utils.WriteBytes(w, header); err != nil {
+		return nil, errors.Wrap(err, "write flv header")
+	}
+	if err := utils.WriteUintBE(w, 0, 4); err != nil {
+		return nil, errors.Wrap(err, "write previous tag size 0")
+	}
+	return &Writer{w: w}, nil
+}
+
+//NewAppendWriter writes the tags after the last one of an existing flv file, w must be at the end of the file
+func NewAppendWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+//WriteTag writes the tag header, the data and the previous tag size
+func (w *Writer) WriteTag(tag *Tag) error {
+	dataSize := len(tag.Data)
+	if dataSize > maxTagDataSize {
+		return errors.Wrapf(core.ErrorInvalidData, "flv tag data size: %d", dataSize)
+	}
+	header := []byte{
+		tag.TagType,
+		byte(dataSize >> 16), byte(dataSize >> 8), byte(dataSize),
+		byte(tag.Timestamp >> 16), byte(tag.Timestamp >> 8), byte(tag.Timestamp), byte(tag.Timestamp >> 24),
+		0x00, 0x00, 0x00, //stream id
+	}
+	if err := utils.WriteBytes(w.w, header); err != nil {
+		return errors.Wrap(err, "write flv tag header")
+	}
+	if dataSize > 0 {
+		if err := utils.WriteBytes(w.w, tag.Data); err != nil {
+			return errors.Wrap(err, "write flv tag data")
+		}
+	}
+	if err := utils.WriteUintBE(w.w, uint32(tagHeaderSize+dataSize), 4); err != nil {
+		return errors.Wrap(err, "write previous tag size")
+	}
+	return nil
+}
+
+//LastTimestamp finds the timestamp of the last tag by the previous tag size at the end of the flv file,
+//0 is returned for a file without tags, r is left at the end of the file
+func LastTimestamp(r io.ReadSeeker) (uint32, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := NewReader(r); err != nil {
+		return 0, err
+	}
+	firstTag, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := r.Seek(-4, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if end+4 == firstTag {
+		return 0, nil
+	}
+	previousTagSize, err := utils.ReadUintBE(r, 4)
+	if err != nil {
+		return 0, errors.Wrap(err, "read last previous tag size")
+	}
+	lastTag := end - int64(previousTagSize)
+	if previousTagSize < tagHeaderSize || lastTag < firstTag {
+		return 0, errors.Wrapf(core.ErrorInvalidData, "flv last previous tag size: %d", previousTagSize)
+	}
+	if _, err := r.Seek(lastTag, io.SeekStart); err != nil {
+		return 0, err
+	}
+	header, err := utils.ReadBytes(r, tagHeaderSize)
+	if err != nil {
+		return 0, errors.Wrap(err, "read last flv tag header")
+	}
+	if _, err := r.Seek(0, io.SeekEnd); err != nil {
+		return 0, err
+	}
+	return tagTimestamp(header), nil
+}
@@ -0,0 +1,77 @@
+package flv
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhyoulun/gls/src/core"
+	"io"
+	"testing"
+)
+
+func TestWriter_WriteTag(t *testing.T) {
+	tags := []*Tag{
+		{TagType: TagTypeAudio, Timestamp: 40, Data: []byte{0xaf, 0x01}},
+		{TagType: TagTypeVideo, Timestamp: 0x01020304},
+	}
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, tag := range tags {
+		assert.NoError(t, w.WriteTag(tag))
+	}
+	//the same as the file read by TestReader_ReadTag
+	assert.Equal(t, []byte{
+		'F', 'L', 'V', 0x01, headerFlagsAudio | headerFlagsVideo, 0x00, 0x00, 0x00, 0x09,
+		0x00, 0x00, 0x00, 0x00,
+		TagTypeAudio, 0x00, 0x00, 0x02, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00, 0x00,
+		0xaf, 0x01,
+		0x00, 0x00, 0x00, 0x0d,
+		TagTypeVideo, 0x00, 0x00, 0x00, 0x02, 0x03, 0x04, 0x01, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x0b,
+	}, buf.Bytes())
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, tag := range tags {
+		got, err := r.ReadTag()
+		assert.NoError(t, err)
+		assert.Equal(t, tag, got)
+	}
+	_, err = r.ReadTag()
+	assert.Equal(t, io.EOF, err)
+
+	err = w.WriteTag(&Tag{TagType: TagTypeVideo, Data: make([]byte, maxTagDataSize+1)})
+	assert.Equal(t, core.ErrorInvalidData, errors.Cause(err))
+}
+
+func TestLastTimestamp(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, _ := NewWriter(buf)
+	timestamp, err := LastTimestamp(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), timestamp, "no tags")
+
+	_ = w.WriteTag(&Tag{TagType: TagTypeVideo, Timestamp: 1000, Data: []byte{0x17, 0x01}})
+	_ = w.WriteTag(&Tag{TagType: TagTypeAudio, Timestamp: 0x01000020, Data: []byte{0xaf, 0x01, 0x02}})
+	r := bytes.NewReader(buf.Bytes())
+	timestamp, err = LastTimestamp(r)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x01000020), timestamp)
+	assert.Equal(t, 0, r.Len(), "at the end")
+
+	//the tags appended follow the last one
+	assert.NoError(t, NewAppendWriter(buf).WriteTag(&Tag{TagType: TagTypeAudio, Timestamp: 0x01000040}))
+	timestamp, err = LastTimestamp(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x01000040), timestamp)
+
+	//a previous tag size beyond the tags
+	data := append(buf.Bytes()[:buf.Len()-4], 0x00, 0x01, 0x00, 0x00)
+	_, err = LastTimestamp(bytes.NewReader(data))
+	assert.Equal(t, core.ErrorInvalidData, errors.Cause(err))
+}
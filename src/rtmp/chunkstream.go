@@ -1,6 +1,7 @@
 package rtmp
 
 import (
+	"encoding/binary"
 	"fmt"
 	"github.com/zhyoulun/gls/src/core"
 	"github.com/zhyoulun/gls/src/utils"
@@ -11,7 +12,8 @@ import (
 type chunkStream struct {
 	fmt             Fmt
 	chunkStreamID   uint32
-	clock           uint32
+	clock           uint32 //the timestamp, wraps around at 2^32
+	timestamp64     int64  //the timestamp following clock across the rollover
 	messageLength   uint32
 	messageTypeID   uint8
 	messageStreamID uint32
@@ -44,7 +46,8 @@ type chunkStreamTmp struct {
 	currentFmt         Fmt    //chunk type
 	extended           bool   //是否需要读取extend timestamp，用于fmt3 chunk的读取场景
 	firstChunkReadDone bool   //chunkStream中，第一个chunk读取完成
-	timestamp          uint32 //used for read storage
+	timestamp          uint32 //used for read storage, the timestamp of fmt0 or the timestamp delta of fmt1 and fmt2
+	lastClock          uint32 //the clock of the last message, used for timestamp64
 	timestampDelta     uint32 //used for read storage
 	extendedTimestamp  uint32 //used for read storage
 	//extended          bool
@@ -95,26 +98,19 @@ func (cs *chunkStream) readChunk(r utils.ReadPeeker, chunkSize uint32) error {
 			return err
 		}
 		//cs.timestamp
-		if cs.tmp.timestamp == max3BTimestamp {
-			var extendedTimestamp uint32
-			if extendedTimestamp, err = utils.ReadUintBE(r, 4); err != nil {
-				return err
-			}
-			cs.clock = extendedTimestamp
-			cs.tmp.extended = true
-			cs.tmp.timestampDelta = 0
-		} else {
-			cs.clock = cs.tmp.timestamp
-			cs.tmp.extended = false
-			cs.tmp.timestampDelta = 0
+		if err := cs.readExtendedTimestamp(r); err != nil {
+			return err
 		}
+		cs.clock = cs.tmp.timestamp
+		//if a type 3 chunk follows a type 0 chunk, then the timestamp delta for this type 3 chunk is the same as the timestamp of the type 0 chunk
+		cs.tmp.timestampDelta = cs.tmp.timestamp
 		//cs.data init
 		cs.initData(cs.messageLength)
 	case fmt1: //7B, stream with variable-sized message(for example: many video formats) should use this format for the first chunk of each new message after the first(//todo first what??)
 		cs.fmt = fmt1
 		var err error
 		//for a type-1 or type-2 chunk, the difference between the previous chunk's timestamp and the current chunk's timestamp is sent here.
-		if cs.tmp.timestampDelta, err = utils.ReadUintBE(r, 3); err != nil {
+		if cs.tmp.timestamp, err = utils.ReadUintBE(r, 3); err != nil {
 			return err
 		}
 		//cs.messageLength
@@ -127,42 +123,26 @@ func (cs *chunkStream) readChunk(r utils.ReadPeeker, chunkSize uint32) error {
 		} else {
 			cs.messageTypeID = uint8(messageTypeID)
 		}
-		//cs.timestamp
-		if cs.tmp.timestampDelta == max3BTimestamp {
-			var extendedTimestamp uint32
-			if extendedTimestamp, err = utils.ReadUintBE(r, 4); err != nil {
-				return err
-			}
-			cs.clock += extendedTimestamp
-			cs.tmp.extended = true
-			cs.tmp.timestampDelta = extendedTimestamp
-		} else {
-			cs.clock += cs.tmp.timestampDelta
-			cs.tmp.extended = false
-			//cs.tmp.timestampDelta = cs.tmp.timestampDelta
+		//cs.timestamp, wraps around at 2^32
+		if err := cs.readExtendedTimestamp(r); err != nil {
+			return err
 		}
+		cs.tmp.timestampDelta = cs.tmp.timestamp
+		cs.clock += cs.tmp.timestampDelta
 		//cs.data init
 		cs.initData(cs.messageLength)
 	case fmt2: //3B, stream with constant-sized messages(for example: some audio and data formats) should use this format for the first chunk of each message after the first
 		cs.fmt = fmt2
 		var err error
-		if cs.tmp.timestampDelta, err = utils.ReadUintBE(r, 3); err != nil {
+		if cs.tmp.timestamp, err = utils.ReadUintBE(r, 3); err != nil {
 			return err
 		}
-		//cs.timestamp
-		if cs.tmp.timestampDelta == max3BTimestamp {
-			var extendedTimestamp uint32
-			if extendedTimestamp, err = utils.ReadUintBE(r, 4); err != nil {
-				return err
-			}
-			cs.clock += extendedTimestamp
-			cs.tmp.extended = true
-			cs.tmp.timestampDelta = extendedTimestamp
-		} else {
-			cs.clock += cs.tmp.timestampDelta
-			cs.tmp.extended = false
-			//cs.tmp.timestampDelta = cs.tmp.timestampDelta
+		//cs.timestamp, wraps around at 2^32
+		if err := cs.readExtendedTimestamp(r); err != nil {
+			return err
 		}
+		cs.tmp.timestampDelta = cs.tmp.timestamp
+		cs.clock += cs.tmp.timestampDelta
 		//cs.data init
 		cs.initData(cs.messageLength)
 	case fmt3: //0B; fmt3不可能是ChunkStream的第一个chunk
@@ -173,35 +153,29 @@ func (cs *chunkStream) readChunk(r utils.ReadPeeker, chunkSize uint32) error {
 		//		as there is no need for a chunk of type 2 to register the delta
 		//if a type 3 chunk follows a type 0 chunk, then the timestamp delta for this type 3 chunk is the same as the timestamp of the type 0 chunk
 
-		//read extended timestamp
-		if cs.tmp.extended {
-			var err error
-			if cs.tmp.extendedTimestamp, err = utils.ReadUintBE(r, 4); err != nil {
-				return err
-			}
-		} else {
-			//nothing changed
-		}
 		//chunk type 3 can be used in two different ways. the first is to specify the continuation of a message.
 		//  the second is to specify the beginning of a new message whose header can be derived from the existing state data.
 		if cs.dataIndex == cs.messageLength { //example 1
-			//set cs.clock
-			if cs.fmt == fmt0 {
-				if cs.tmp.extended {
-					cs.clock = cs.tmp.extendedTimestamp
-				} else {
-					//nothing changed
-				}
-			} else {
-				if cs.tmp.extended {
-					cs.clock += cs.tmp.extendedTimestamp
-				} else {
-					cs.clock += cs.tmp.timestampDelta
+			//the extended timestamp is present if the last type 0, 1 or 2 chunk has it
+			if cs.tmp.extended {
+				var err error
+				if cs.tmp.extendedTimestamp, err = utils.ReadUintBE(r, 4); err != nil {
+					return err
 				}
+				cs.tmp.timestampDelta = cs.tmp.extendedTimestamp
 			}
+			cs.clock += cs.tmp.timestampDelta
 			cs.initData(cs.messageLength)
-		} else {
-			//nothing changed
+		} else if cs.tmp.extended {
+			//the continuation repeats the extended timestamp, but some peers omit it,
+			//it is taken only if it is the same as the one of the first chunk
+			if buf, err := r.Peek(4); err != nil {
+				return err
+			} else if binary.BigEndian.Uint32(buf) == cs.tmp.timestampDelta {
+				if cs.tmp.extendedTimestamp, err = utils.ReadUintBE(r, 4); err != nil {
+					return err
+				}
+			}
 		}
 
 	default:
@@ -234,78 +208,136 @@ func (cs *chunkStream) readChunk(r utils.ReadPeeker, chunkSize uint32) error {
 	return nil
 }
 
+//readExtendedTimestamp reads the extended timestamp of the type 0, 1 or 2 chunk,
+//it is present if the timestamp or the timestamp delta is 0xffffff, and replaces it
+func (cs *chunkStream) readExtendedTimestamp(r io.Reader) error {
+	cs.tmp.extended = cs.tmp.timestamp == max3BTimestamp
+	if !cs.tmp.extended {
+		return nil
+	}
+	var err error
+	if cs.tmp.extendedTimestamp, err = utils.ReadUintBE(r, 4); err != nil {
+		return err
+	}
+	cs.tmp.timestamp = cs.tmp.extendedTimestamp
+	return nil
+}
+
+//initData starts a new message, the clock of which is set
 func (cs *chunkStream) initData(messageLength uint32) {
 	cs.data = make([]byte, messageLength)
 	cs.dataIndex = 0
+	//follow the clock across the 32 bits rollover, the difference is taken as signed,
+	//so that a small jump backward is not a rollover
+	if cs.tmp.firstChunkReadDone {
+		cs.timestamp64 += int64(int32(cs.clock - cs.tmp.lastClock))
+	} else {
+		cs.timestamp64 = int64(cs.clock)
+	}
+	cs.tmp.lastClock = cs.clock
 	cs.tmp.firstChunkReadDone = true
 }
 
-func (cs *chunkStream) writeChunk(w io.Writer, chunkSize uint32) error {
-	numChunks := cs.messageLength / chunkSize
-	for i := uint32(0); i <= numChunks; i++ {
-		//debug
-		if numChunks > 0 {
-			_ = chunkSize
-		}
+//abort discards the partially received message,
+//the message header is kept, so that the next chunk starts a fresh message, even if it is a type 3 chunk
+func (cs *chunkStream) abort() {
+	cs.data = nil
+	cs.dataIndex = cs.messageLength
+}
+
+//chunkWriteState is the header of the last message written on a chunk stream,
+//the header of the next message is compressed against it
+type chunkWriteState struct {
+	clock           uint32
+	timestampDelta  uint32 //the timestamp for fmt0, as the delta of the type 3 chunk following it
+	messageLength   uint32
+	messageTypeID   uint8
+	messageStreamID uint32
+}
+
+//headerFmt chooses the chunk type of the first chunk of the message, and the timestamp delta for fmt1, fmt2 and fmt3
+//fmt0: the first message of the chunk stream, another message stream, or the timestamp goes backward
+//fmt1: the message length or the message type changes
+//fmt2: the timestamp delta changes
+//fmt3: the same message length, message type and timestamp delta as the last message
+//the timestamps wrap around at 2^32, a delta over half of the range is taken as going backward
+func (cs *chunkStream) headerFmt(last *chunkWriteState) (Fmt, uint32) {
+	if last == nil || last.messageStreamID != cs.messageStreamID || int32(cs.clock-last.clock) < 0 {
+		return fmt0, cs.clock
+	}
+	delta := cs.clock - last.clock
+	if last.messageLength != cs.messageLength || last.messageTypeID != cs.messageTypeID {
+		return fmt1, delta
+	}
+	if last.timestampDelta != delta {
+		return fmt2, delta
+	}
+	return fmt3, delta
+}
+
+//writeChunk writes the message as chunks, the first one with the header compressed against last,
+//the others are fmt3, the header of the message is returned for the next message of the chunk stream.
+//The timestamp of fmt0 or the timestamp delta of the others not less than 0xffffff is sent as the extended timestamp,
+//which is repeated by all the type 3 chunks of the message
+func (cs *chunkStream) writeChunk(w io.Writer, chunkSize uint32, last *chunkWriteState) (*chunkWriteState, error) {
+	headerFmt, timestamp := cs.headerFmt(last)
+	extended := timestamp >= max3BTimestamp
+	timestamp3B := timestamp
+	if extended {
+		timestamp3B = max3BTimestamp
+	}
+	//at least one chunk for the empty message
+	numChunks := (cs.messageLength + chunkSize - 1) / chunkSize
+	if numChunks == 0 {
+		numChunks = 1
+	}
+	for i := uint32(0); i < numChunks; i++ {
 		var f Fmt
 		if i == 0 {
-			f = fmt0
+			f = headerFmt
 		} else {
 			f = fmt3
 		}
 		if basicHeader, err := newChunkBasicHeaderForWrite(cs.chunkStreamID, f); err != nil {
-			return err
+			return nil, err
 		} else {
 			if err := basicHeader.Write(w); err != nil {
-				return err
+				return nil, err
 			}
 		}
 		//chunk message header
-		if f == fmt3 {
-			if cs.clock > 0xffffff {
-				//todo ??为什么要删掉
-				//if err := utils.WriteUintBE(w, 0xffffff, 3); err != nil {
-				//	return err
-				//}
-				if err := utils.WriteUintBE(w, cs.clock, 4); err != nil {
-					return err
-				}
-			} else {
-				//todo ??为什么要删掉
-				//if err := utils.WriteUintBE(w, cs.timestamp, 3); err != nil {
-				//	return err
-				//}
+		switch f {
+		case fmt0:
+			if err := utils.WriteUintBE(w, timestamp3B, 3); err != nil {
+				return nil, err
 			}
-		} else if f == fmt0 {
-			if cs.clock > 0xffffff {
-				if err := utils.WriteUintBE(w, 0xffffff, 3); err != nil {
-					return err
-				}
-				if err := utils.WriteUintBE(w, cs.messageLength, 3); err != nil {
-					return err
-				}
-				if err := utils.WriteByte(w, cs.messageTypeID); err != nil {
-					return err
-				}
-				if err := utils.WriteUintLE(w, cs.messageStreamID, 4); err != nil {
-					return err
-				}
-				if err := utils.WriteUintBE(w, cs.clock, 4); err != nil {
-					return err
-				}
-			} else {
-				if err := utils.WriteUintBE(w, cs.clock, 3); err != nil {
-					return err
-				}
-				if err := utils.WriteUintBE(w, cs.messageLength, 3); err != nil {
-					return err
-				}
-				if err := utils.WriteByte(w, cs.messageTypeID); err != nil {
-					return err
-				}
-				if err := utils.WriteUintLE(w, cs.messageStreamID, 4); err != nil {
-					return err
-				}
+			if err := utils.WriteUintBE(w, cs.messageLength, 3); err != nil {
+				return nil, err
+			}
+			if err := utils.WriteByte(w, cs.messageTypeID); err != nil {
+				return nil, err
+			}
+			if err := utils.WriteUintLE(w, cs.messageStreamID, 4); err != nil {
+				return nil, err
+			}
+		case fmt1:
+			if err := utils.WriteUintBE(w, timestamp3B, 3); err != nil {
+				return nil, err
+			}
+			if err := utils.WriteUintBE(w, cs.messageLength, 3); err != nil {
+				return nil, err
+			}
+			if err := utils.WriteByte(w, cs.messageTypeID); err != nil {
+				return nil, err
+			}
+		case fmt2:
+			if err := utils.WriteUintBE(w, timestamp3B, 3); err != nil {
+				return nil, err
+			}
+		}
+		if extended {
+			if err := utils.WriteUintBE(w, timestamp, 4); err != nil {
+				return nil, err
 			}
 		}
 		//data
@@ -315,10 +347,16 @@ func (cs *chunkStream) writeChunk(w io.Writer, chunkSize uint32) error {
 			end = cs.messageLength
 		}
 		if err := utils.WriteBytes(w, cs.data[start:end]); err != nil {
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	return &chunkWriteState{
+		clock:           cs.clock,
+		timestampDelta:  timestamp,
+		messageLength:   cs.messageLength,
+		messageTypeID:   cs.messageTypeID,
+		messageStreamID: cs.messageStreamID,
+	}, nil
 }
 
 func (cs *chunkStream) writeToData(v []byte) error {
@@ -1,6 +1,7 @@
 package rtmp
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
 	"github.com/zhyoulun/gls/src/utils"
 	"github.com/zhyoulun/gls/src/utils/debug"
@@ -368,3 +369,131 @@ func Test_chunkStream_readChunkFmt3(t *testing.T) {
 		assert.Error(t, err)
 	}
 }
+
+func Test_chunkStream_writeChunk(t *testing.T) {
+	out := &bytes.Buffer{}
+	c, _ := NewConn(newBufferConn(&bytes.Buffer{}, out))
+	peer, _ := NewConn(newBufferConn(out, &bytes.Buffer{}))
+	peer.remoteMaximumChunkSize = c.localMaximumChunkSize
+	tests := []struct {
+		messageStreamID uint32
+		timestamp       uint32
+		length          uint32
+		fmt             Fmt
+		size            int //the bytes written
+	}{
+		{1, 0, 10, fmt0, 1 + 11 + 10},
+		{1, 40, 12, fmt1, 1 + 7 + 12},                        //the length changes
+		{1, 80, 12, fmt3, 1 + 12},                            //the same length and delta
+		{1, 100, 12, fmt2, 1 + 3 + 12},                       //the delta changes
+		{1, 50, 12, fmt0, 1 + 11 + 12},                       //the timestamp goes backward
+		{2, 60, 12, fmt0, 1 + 11 + 12},                       //another message stream
+		{2, 120, 12, fmt3, 1 + 12},                           //the timestamp of fmt0 is the delta of the following fmt3
+		{2, 120 + 0xffffff, 12, fmt2, 1 + 3 + 4 + 12},        //the delta needs the extended timestamp
+		{2, 120 + 2*0xffffff, 12, fmt3, 1 + 4 + 12},          //fmt3 repeats the extended timestamp
+		{2, 160 + 2*0xffffff, 2048, fmt1, 1 + 7 + 1 + 2048},  //split into 2 chunks exactly
+		{3, 0xffffff, 2048, fmt0, 1 + 11 + 4 + 1 + 4 + 2048}, //each chunk carries the extended timestamp
+	}
+	for i, tt := range tests {
+		data := make([]byte, tt.length)
+		data[0] = byte(i)
+		m, _ := newMessage2(6, tt.timestamp, tt.length, typeVideo, tt.messageStreamID)
+		_ = m.cs.writeToData(data)
+		assert.NoError(t, c.writeMessage(m))
+		assert.Equal(t, byte(tt.fmt), out.Bytes()[0]>>6, "message %d", i)
+		assert.Equal(t, tt.size, out.Len(), "message %d", i)
+
+		got, err := peer.readMessage()
+		if assert.NoError(t, err, "message %d", i) {
+			assert.Equal(t, tt.messageStreamID, got.GetMessageStreamID(), "message %d", i)
+			assert.Equal(t, tt.timestamp, got.GetTimestamp(), "message %d", i)
+			assert.Equal(t, data, got.GetData(), "message %d", i)
+		}
+		assert.Equal(t, 0, out.Len(), "message %d", i)
+	}
+}
+
+func Test_chunkStream_timestamp64(t *testing.T) {
+	out := &bytes.Buffer{}
+	c, _ := NewConn(newBufferConn(&bytes.Buffer{}, out))
+	peer, _ := NewConn(newBufferConn(out, &bytes.Buffer{}))
+	peer.remoteMaximumChunkSize = c.localMaximumChunkSize
+	tests := []struct {
+		timestamp   uint32
+		timestamp64 int64
+	}{
+		{0xfffffff0, 0xfffffff0},
+		{0x10, 0x100000010}, //the timestamp wraps around
+		{0x30, 0x100000030},
+		{0x20, 0x100000020}, //backward
+	}
+	for i, tt := range tests {
+		m, _ := newMessage2(6, tt.timestamp, 300, typeVideo, 1)
+		_ = m.cs.writeToData(make([]byte, 300))
+		assert.NoError(t, c.writeMessage(m))
+		got, err := peer.readMessage()
+		if assert.NoError(t, err, "message %d", i) {
+			assert.Equal(t, tt.timestamp, got.GetTimestamp(), "message %d", i)
+			assert.Equal(t, tt.timestamp64, got.GetTimestamp64(), "message %d", i)
+		}
+	}
+}
+
+func Test_chunkStream_readChunk_extendedTimestamp(t *testing.T) {
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	tests := []struct {
+		name      string
+		input     []byte
+		timestamp uint32
+	}{
+		{
+			name: "continuation with the extended timestamp",
+			input: bytes.Join([][]byte{
+				{0x06, 0xff, 0xff, 0xff, 0x00, 0x00, 0xc8, 0x09, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00},
+				data[:128],
+				{0xc6, 0x01, 0x00, 0x00, 0x00},
+				data[128:],
+			}, nil),
+			timestamp: 0x1000000,
+		},
+		{
+			name: "continuation without the extended timestamp",
+			input: bytes.Join([][]byte{
+				{0x06, 0xff, 0xff, 0xff, 0x00, 0x00, 0xc8, 0x09, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00},
+				data[:128],
+				{0xc6},
+				data[128:],
+			}, nil),
+			timestamp: 0x1000000,
+		},
+		{
+			name: "fmt1 with the extended delta",
+			input: bytes.Join([][]byte{
+				{0x06, 0x00, 0x00, 0x10, 0x00, 0x00, 0x01, 0x09, 0x01, 0x00, 0x00, 0x00},
+				{0x00},
+				{0x46, 0xff, 0xff, 0xff, 0x00, 0x00, 0xc8, 0x09, 0x01, 0x00, 0x00, 0x00},
+				data[:128],
+				{0xc6, 0x01, 0x00, 0x00, 0x00},
+				data[128:],
+			}, nil),
+			timestamp: 0x1000010,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := NewConn(newBufferConn(bytes.NewBuffer(tt.input), &bytes.Buffer{}))
+			var m *message
+			var err error
+			for err == nil && (m == nil || len(m.GetData()) != 200) {
+				m, err = c.readMessage()
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.timestamp, m.GetTimestamp())
+				assert.Equal(t, data, m.GetData())
+			}
+		})
+	}
+}
@@ -0,0 +1,520 @@
+package rtmp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zhyoulun/gls/src/amf"
+	"github.com/zhyoulun/gls/src/core"
+	"github.com/zhyoulun/gls/src/flv"
+	"github.com/zhyoulun/gls/src/utils"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//clientSetupTimeout bounds the handshake and connect of NewClientConn, and the publish or play,
+//so that a server which stops responding does not block the client forever
+var clientSetupTimeout = 10 * time.Second
+
+//Dial connects to the rtmp server addressed by rawurl(rtmp://host[:port]/app/stream or rtmps://...),
+//does the handshake and sends the connect command
+func Dial(rawurl string) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	var netConn net.Conn
+	dialer := &net.Dialer{Timeout: core.Duration5Second}
+	switch u.Scheme {
+	case "rtmp":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), defaultPort)
+		}
+		if netConn, err = dialer.Dial("tcp", host); err != nil {
+			return nil, err
+		}
+	case "rtmps":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), defaultTLSPort)
+		}
+		if netConn, err = tls.DialWithDialer(dialer, "tcp", host, nil); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Wrapf(core.ErrorNotSupported, "scheme: %s", u.Scheme)
+	}
+	c, err := NewClientConn(netConn, rawurl)
+	if err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+//DialPublish dials rawurl and publishes the stream named in it, packets can be sent by WritePacket
+func DialPublish(rawurl string) (*Conn, error) {
+	c, err := Dial(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Publish(); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+//DialPlay dials rawurl and plays the stream named in it, packets can be got by ReadPacket
+func DialPlay(rawurl string) (*Conn, error) {
+	c, err := Dial(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Play(); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+//NewClientConn does the client side handshake and connect over an established conn
+func NewClientConn(netConn net.Conn, rawurl string) (*Conn, error) {
+	tcUrl, app, streamName, err := parseURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewConn(utils.NewBufferedConn(netConn, core.Size4KB))
+	if err != nil {
+		return nil, err
+	}
+	clearDeadline := c.setupDeadline()
+	c.isClient = true
+	c.streamName = streamName
+	c.connInfo = ConnectCommentObject{
+		App:           app,
+		Flashver:      defaultFlashVer,
+		TcUrl:         tcUrl,
+		AudioCodecs:   audioCodecSupportSndAll,
+		VideoCodecs:   videoCodecSupportVidAll,
+		VideoFunction: supportVidClientSeek,
+		Type:          defaultConnectType,
+		FourCcList:    flv.FourCCList,
+	}
+
+	var h *handshake
+	if h, err = newHandshake(); err != nil {
+		return nil, err
+	}
+	if err = h.DoClient(c.conn); err != nil {
+		return nil, err
+	}
+	if err = c.connect(); err != nil {
+		return nil, err
+	}
+	clearDeadline()
+	return c, nil
+}
+
+//setupDeadline sets the deadline of the setup phase on the conn, the func returned clears it
+func (c *Conn) setupDeadline() func() {
+	_ = c.conn.SetDeadline(time.Now().Add(clientSetupTimeout))
+	return func() {
+		_ = c.conn.SetDeadline(time.Time{})
+	}
+}
+
+//rtmp://host[:port]/app[/instance]/stream[?query]
+//the first path element is the app, the others and the query are the stream name
+func parseURL(rawurl string) (tcUrl, app, streamName string, err error) {
+	var u *url.URL
+	if u, err = url.Parse(rawurl); err != nil {
+		return "", "", "", err
+	}
+	items := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if len(items) != 2 || items[0] == "" || items[1] == "" {
+		return "", "", "", errors.Errorf("parse url, want: rtmp://host[:port]/app/stream, got: %s", rawurl)
+	}
+	app, streamName = items[0], items[1]
+	if u.RawQuery != "" {
+		streamName = fmt.Sprintf("%s?%s", streamName, u.RawQuery)
+	}
+	tcUrl = fmt.Sprintf("%s://%s/%s", u.Scheme, u.Host, app)
+	return tcUrl, app, streamName, nil
+}
+
+//1. client -> server: set chunk size
+//2. client -> server: command message(connect)
+//3. server -> client: window acknowledgement size, set peer bandwidth, ...
+//4. server -> client: command message(_result - connect response)
+//5. client -> server: window acknowledgement size
+func (c *Conn) connect() error {
+	//the chunk size must be told before any message larger than the default chunk size is sent
+	if m, err := newPCMSetChunkSize(c.localMaximumChunkSize); err != nil {
+		return err
+	} else {
+		if err := c.writeMessage(m); err != nil {
+			return err
+		}
+	}
+	transactionID := c.nextTransactionID()
+	if msg, err := newNetConnectionCommandConnect(transactionID, c.connInfo); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID3, messageStreamID0, msg); err != nil {
+			return err
+		}
+	}
+	if _, err := c.readResult(transactionID); err != nil {
+		return errors.Wrap(err, "connect")
+	}
+	if m, err := newPCMWindowAcknowledgementSize(c.localWindowAckSize); err != nil {
+		return err
+	} else {
+		if err := c.writeMessage(m); err != nil {
+			return err
+		}
+	}
+	log.Infof("client connect done, connInfo: %+v", c.connInfo)
+	return nil
+}
+
+//Publish sends releaseStream, FCPublish, createStream and publish, just like ffmpeg and obs
+func (c *Conn) Publish() error {
+	return c.PublishWithType(PublishingTypeLive)
+}
+
+//PublishWithType publishes with PublishingTypeLive, PublishingTypeRecord or PublishingTypeAppend,
+//NetStream.Record.Start is waited for the recorded ones
+func (c *Conn) PublishWithType(publishingType string) error {
+	if !c.isClient {
+		return errors.Wrapf(core.ErrorNotSupported, "publish on a server conn")
+	}
+	clearDeadline := c.setupDeadline()
+	defer clearDeadline()
+	if msg, err := newNetConnectionCommandReleaseStream(c.nextTransactionID(), c.streamName); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID3, messageStreamID0, msg); err != nil {
+			return err
+		}
+	}
+	if msg, err := newNetConnectionCommandFCPublish(c.nextTransactionID(), c.streamName); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID3, messageStreamID0, msg); err != nil {
+			return err
+		}
+	}
+	if err := c.createStream(); err != nil {
+		return err
+	}
+	if msg, err := newNetStreamCommandPublish(c.nextTransactionID(), c.streamName, publishingType); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID8, c.messageStreamID, msg); err != nil {
+			return err
+		}
+	}
+	if err := c.readStatus("NetStream.Publish.Start"); err != nil {
+		return errors.Wrap(err, "publish")
+	}
+	if publishingType != PublishingTypeLive {
+		if err := c.readStatus("NetStream.Record.Start"); err != nil {
+			return errors.Wrap(err, "publish")
+		}
+	}
+	c.isPublish = true
+	log.Infof("client publish start, stream name: %s, publishing type: %s", c.streamName, publishingType)
+	return nil
+}
+
+//Play plays the live stream, or the recorded stream if the live one is not found
+func (c *Conn) Play() error {
+	return c.PlayRange(PlayStartLiveOrRecorded, PlayDurationAll)
+}
+
+//PlayRange sends createStream, getStreamLength, play and set buffer length, just like ffmpeg,
+//start and duration are in seconds, see PlayStartLiveOrRecorded, PlayStartLive and PlayDurationAll
+func (c *Conn) PlayRange(start, duration float64) error {
+	if !c.isClient {
+		return errors.Wrapf(core.ErrorNotSupported, "play on a server conn")
+	}
+	clearDeadline := c.setupDeadline()
+	defer clearDeadline()
+	if err := c.createStream(); err != nil {
+		return err
+	}
+	if msg, err := newNetStreamCommandGetStreamLength(c.nextTransactionID(), c.streamName); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID8, c.messageStreamID, msg); err != nil {
+			return err
+		}
+	}
+	if msg, err := newNetStreamCommandPlay(c.nextTransactionID(), c.streamName, start, duration); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID8, c.messageStreamID, msg); err != nil {
+			return err
+		}
+	}
+	if m, err := newUCMSetBufferLength(c.messageStreamID, defaultBufferLength); err != nil {
+		return err
+	} else {
+		if err := c.writeMessage(m); err != nil {
+			return err
+		}
+	}
+	if err := c.readStatus("NetStream.Play.Start"); err != nil {
+		return errors.Wrap(err, "play")
+	}
+	log.Infof("client play start, stream name: %s", c.streamName)
+	return nil
+}
+
+//Switch sends play2 to switch the playing to streamName at the next keyframe, e.g. another bitrate of the stream,
+//the status is read by ReadPacket and ignored
+func (c *Conn) Switch(streamName string) error {
+	if !c.isClient || c.isPublish {
+		return errors.Wrapf(core.ErrorNotSupported, "switch on a conn not playing")
+	}
+	if msg, err := newNetStreamCommandPlay2(transactionID0, streamName, c.streamName); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID8, c.messageStreamID, msg); err != nil {
+			return err
+		}
+	}
+	c.streamName = streamName
+	return nil
+}
+
+//Unpublish sends FCUnpublish and deleteStream, just like ffmpeg, the conn can publish again
+func (c *Conn) Unpublish() error {
+	if !c.isClient || !c.isPublish {
+		return errors.Wrapf(core.ErrorNotSupported, "unpublish on a conn not publishing")
+	}
+	if msg, err := newNetConnectionCommandFCUnpublish(c.nextTransactionID(), c.streamName); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID3, messageStreamID0, msg); err != nil {
+			return err
+		}
+	}
+	if msg, err := newNetStreamCommandDeleteStream(c.nextTransactionID(), c.messageStreamID); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID3, messageStreamID0, msg); err != nil {
+			return err
+		}
+	}
+	c.isPublish = false
+	log.Infof("client unpublish, stream name: %s", c.streamName)
+	return nil
+}
+
+//Pause pauses or unpauses the playing, the status is read by ReadPacket and ignored
+func (c *Conn) Pause(pause bool) error {
+	if !c.isClient || c.isPublish {
+		return errors.Wrapf(core.ErrorNotSupported, "pause on a conn not playing")
+	}
+	if msg, err := newNetStreamCommandPause(transactionID0, pause, 0); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID8, c.messageStreamID, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ReceiveAudio turns the audio of the playing on or off
+func (c *Conn) ReceiveAudio(flag bool) error {
+	return c.receive(commandNetStreamReceiveAudio, flag)
+}
+
+//ReceiveVideo turns the video of the playing on or off
+func (c *Conn) ReceiveVideo(flag bool) error {
+	return c.receive(commandNetStreamReceiveVideo, flag)
+}
+
+func (c *Conn) receive(command string, flag bool) error {
+	if !c.isClient || c.isPublish {
+		return errors.Wrapf(core.ErrorNotSupported, "%s on a conn not playing", command)
+	}
+	if msg, err := newNetStreamCommandReceive(command, transactionID0, flag); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID8, c.messageStreamID, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Call calls a method registered on the server and waits for its results,
+//it reads the conn, so it must not be called while another goroutine is reading packets
+func (c *Conn) Call(name string, args ...interface{}) ([]interface{}, error) {
+	if !c.isClient {
+		return nil, errors.Wrapf(core.ErrorNotSupported, "call on a server conn")
+	}
+	transactionID := c.nextTransactionID()
+	if msg, err := newNetConnectionCommandCall(name, transactionID, args); err != nil {
+		return nil, err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID3, messageStreamID0, msg); err != nil {
+			return nil, err
+		}
+	}
+	vs, err := c.readResult(transactionID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "call %s", name)
+	}
+	//vs[0] is nil
+	if len(vs) < 1 {
+		return nil, nil
+	}
+	return vs[1:], nil
+}
+
+func (c *Conn) createStream() error {
+	transactionID := c.nextTransactionID()
+	if msg, err := newNetConnectionCommandCreateStream(transactionID); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID3, messageStreamID0, msg); err != nil {
+			return err
+		}
+	}
+	vs, err := c.readResult(transactionID)
+	if err != nil {
+		return errors.Wrap(err, "create stream")
+	}
+	//vs[0] is nil
+	if len(vs) < 2 {
+		return errors.Errorf("create stream, len(vs) error, want: >=2, got: %d", len(vs))
+	}
+	messageStreamID, ok := vs[1].(float64)
+	if !ok {
+		return errors.Errorf("parse message stream id, want float64, got: %+v", vs[1])
+	}
+	c.messageStreamID = uint32(messageStreamID)
+	return nil
+}
+
+func (c *Conn) nextTransactionID() float64 {
+	c.transactionID++
+	return c.transactionID
+}
+
+//readResult reads messages until the _result or _error of transactionID arrives,
+//returns the values after the transaction id
+func (c *Conn) readResult(transactionID float64) ([]interface{}, error) {
+	for {
+		command, vs, err := c.readCommand()
+		if err != nil {
+			return nil, err
+		}
+		if command != commandNetConnectionResult && command != commandNetConnectionError {
+			log.Debugf("read result, ignore command: %s", command)
+			continue
+		}
+		if len(vs) < 1 {
+			return nil, errors.Errorf("read result, len(vs) error, want: >=1, got: %d", len(vs))
+		}
+		if id, ok := vs[0].(float64); !ok || id != transactionID {
+			log.Debugf("read result, ignore transaction id: %+v", vs[0])
+			continue
+		}
+		if command == commandNetConnectionError {
+			return nil, errors.Errorf("got %s: %+v", command, vs[1:])
+		}
+		return vs[1:], nil
+	}
+}
+
+//readStatus reads messages until an onStatus with code arrives, an error level onStatus ends the waiting
+func (c *Conn) readStatus(code string) error {
+	for {
+		command, vs, err := c.readCommand()
+		if err != nil {
+			return err
+		}
+		if command != commandNetStreamOnStatus {
+			log.Debugf("read status, ignore command: %s", command)
+			continue
+		}
+		//vs[0] transaction id, vs[1] is nil
+		if len(vs) < 3 {
+			return errors.Errorf("read status, len(vs) error, want: >=3, got: %d", len(vs))
+		}
+		info, ok := vs[2].(amf.AmfObject)
+		if !ok {
+			return errors.Errorf("parse info object, want AmfObject, got: %+v", vs[2])
+		}
+		if info["code"] == code {
+			return nil
+		}
+		if info["level"] == netStreamStatusLevelError {
+			return errors.Errorf("got onStatus: %s", info)
+		}
+		log.Debugf("read status, ignore info: %s", info)
+	}
+}
+
+//statusCode is the code of the onStatus command, or empty for the other commands
+func statusCode(m *message) string {
+	command, vs, err := decodeCommandMessage(m.getMessageTypeID(), m.GetData())
+	if err != nil || command != commandNetStreamOnStatus || len(vs) < 3 {
+		return ""
+	}
+	info, _ := vs[2].(amf.AmfObject)
+	code, _ := info["code"].(string)
+	return code
+}
+
+//ReadSharedObjectMessage reads messages until a shared object message arrives, other messages are dropped,
+//so it must not be called while another goroutine is reading packets
+func (c *Conn) ReadSharedObjectMessage() (*SharedObjectMessage, error) {
+	for {
+		m, err := c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case isProtocolControlMessage(m.getMessageTypeID()), m.getMessageTypeID() == typeUserControl:
+			if err := c.handleMessage(m.getChunkStreamID(), m.GetMessageStreamID(), m.getMessageTypeID(), m.GetData(), m.GetTimestamp()); err != nil {
+				return nil, err
+			}
+		case m.getMessageTypeID() == typeSharedObjectAMF0, m.getMessageTypeID() == typeSharedObjectAMF3:
+			return decodeSharedObjectMessage(m.getMessageTypeID(), m.GetData())
+		default:
+			log.Tracef("read shared object message, ignore, messageTypeID: %d", m.getMessageTypeID())
+		}
+	}
+}
+
+//readCommand reads messages until a command message arrives, protocol control messages are handled on the way
+func (c *Conn) readCommand() (string, []interface{}, error) {
+	for {
+		m, err := c.readMessage()
+		if err != nil {
+			return "", nil, err
+		}
+		switch {
+		case isProtocolControlMessage(m.getMessageTypeID()), m.getMessageTypeID() == typeUserControl:
+			if err := c.handleMessage(m.getChunkStreamID(), m.GetMessageStreamID(), m.getMessageTypeID(), m.GetData(), m.GetTimestamp()); err != nil {
+				return "", nil, err
+			}
+		case m.getMessageTypeID() == typeCommandAMF0, m.getMessageTypeID() == typeCommandAMF3:
+			return decodeCommandMessage(m.getMessageTypeID(), m.GetData())
+		default:
+			log.Tracef("read command, ignore, messageTypeID: %d", m.getMessageTypeID())
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package rtmp
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhyoulun/gls/src/av"
+	"github.com/zhyoulun/gls/src/core"
+	"github.com/zhyoulun/gls/src/flv"
+	"github.com/zhyoulun/gls/src/utils"
+	"github.com/zhyoulun/gls/src/utils/debug"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_parseURL(t *testing.T) {
+	{
+		tcUrl, app, streamName, err := parseURL("rtmp://127.0.0.1:1935/live/test")
+		assert.NoError(t, err)
+		assert.Equal(t, "rtmp://127.0.0.1:1935/live", tcUrl)
+		assert.Equal(t, "live", app)
+		assert.Equal(t, "test", streamName)
+	}
+	{
+		tcUrl, app, streamName, err := parseURL("rtmp://example.com/live/room/test?token=abc")
+		assert.NoError(t, err)
+		assert.Equal(t, "rtmp://example.com/live", tcUrl)
+		assert.Equal(t, "live", app)
+		assert.Equal(t, "room/test?token=abc", streamName)
+	}
+	{
+		_, _, _, err := parseURL("rtmp://127.0.0.1:1935/live")
+		assert.Error(t, err)
+	}
+	{
+		_, _, _, err := parseURL("rtmp://127.0.0.1:1935/")
+		assert.Error(t, err)
+	}
+}
+
+func TestDial(t *testing.T) {
+	{
+		_, err := Dial("http://127.0.0.1/live/test")
+		assert.Error(t, err)
+	}
+	{
+		_, err := Dial("rtmp://127.0.0.1:1/live/test")
+		assert.Error(t, err)
+	}
+}
+
+//accept one conn and read its header, the NetStream is sent back through ch
+func serveOneConn(t *testing.T, ln net.Listener, ch chan *NetStream) {
+	netConn, err := ln.Accept()
+	if !assert.NoError(t, err) {
+		ch <- nil
+		return
+	}
+	c, _ := NewConn(utils.NewBufferedConn(netConn, core.Size4KB))
+	if err := c.Handshake(); !assert.NoError(t, err) {
+		ch <- nil
+		return
+	}
+	ns, err := c.ReadHeader()
+	if !assert.NoError(t, err) {
+		ch <- nil
+		return
+	}
+	ch <- ns
+}
+
+//the server accepts but never responds
+func TestDial_setupTimeout(t *testing.T) {
+	timeout := clientSetupTimeout
+	clientSetupTimeout = 100 * time.Millisecond
+	defer func() {
+		clientSetupTimeout = timeout
+	}()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		netConn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer netConn.Close()
+		time.Sleep(time.Second)
+	}()
+
+	start := time.Now()
+	_, err = Dial("rtmp://" + ln.Addr().String() + "/live/test")
+	if assert.Error(t, err) {
+		ne, ok := errors.Cause(err).(net.Error)
+		assert.True(t, ok && ne.Timeout(), "err: %s", err)
+	}
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestDialPublish(t *testing.T) {
+	_ = debug.Init()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	ch := make(chan *NetStream, 1)
+	go serveOneConn(t, ln, ch)
+
+	c, err := DialPublish("rtmp://" + ln.Addr().String() + "/live/test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	assert.True(t, c.IsPublish())
+	assert.Equal(t, uint32(1), c.messageStreamID)
+
+	ns := <-ch
+	if !assert.NotNil(t, ns) {
+		return
+	}
+	sc := ns.Conn()
+	defer sc.Close()
+	assert.True(t, ns.IsPublish())
+	assert.Equal(t, "test", ns.GetStreamName())
+	assert.Equal(t, uint32(1), ns.ID())
+	assert.Equal(t, "live", sc.GetConnInfo().App)
+	assert.Equal(t, "rtmp://"+ln.Addr().String()+"/live", sc.GetConnInfo().TcUrl)
+
+	data := []byte{0xaf, flv.AACPacketTypeAACRaw, 0x01, 0x02, 0x03}
+	p, err := av.NewPacketFromData(av.TypeAudio, 40, data, flv.NewDemuxer())
+	assert.NoError(t, err)
+	assert.NoError(t, c.WritePacket(p))
+
+	got, err := sc.ReadPacket()
+	assert.NoError(t, err)
+	assert.True(t, got.IsAudio())
+	assert.Equal(t, uint32(40), got.GetTimestamp())
+	assert.Equal(t, uint32(1), got.GetStreamID())
+	assert.Equal(t, data, got.GetData())
+}
+
+func TestDialPlay(t *testing.T) {
+	_ = debug.Init()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	ch := make(chan *NetStream, 1)
+	go serveOneConn(t, ln, ch)
+
+	c, err := DialPlay("rtmp://" + ln.Addr().String() + "/live/test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	assert.False(t, c.IsPublish())
+	assert.Equal(t, uint32(1), c.messageStreamID)
+
+	ns := <-ch
+	if !assert.NotNil(t, ns) {
+		return
+	}
+	defer ns.Conn().Close()
+	assert.False(t, ns.IsPublish())
+	assert.Equal(t, "test", ns.GetStreamName())
+
+	data := []byte{0x17, flv.AVCPacketTypeAVCNALU, 0x00, 0x00, 0x00, 0x01, 0x02}
+	p, err := av.NewPacketFromData(av.TypeVideo, 80, data, flv.NewDemuxer())
+	assert.NoError(t, err)
+	assert.NoError(t, ns.WritePacket(p))
+
+	got, err := c.ReadPacket()
+	assert.NoError(t, err)
+	assert.True(t, got.IsVideo())
+	assert.Equal(t, uint32(80), got.GetTimestamp())
+	assert.Equal(t, data, got.GetData())
+}
+
+func TestConn_Unpublish(t *testing.T) {
+	_ = debug.Init()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	ch := make(chan *NetStream, 1)
+	go serveOneConn(t, ln, ch)
+
+	c, err := DialPublish("rtmp://" + ln.Addr().String() + "/live/test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	ns := <-ch
+	if !assert.NotNil(t, ns) {
+		return
+	}
+	sc := ns.Conn()
+	defer sc.Close()
+
+	//FCUnpublish stops the publishing, deleteStream after it is ignored
+	assert.NoError(t, c.Unpublish())
+	assert.False(t, c.IsPublish())
+	assert.Error(t, c.Unpublish())
+	_, err = sc.ReadPacket()
+	assert.Equal(t, core.ErrorStreamClosed, errors.Cause(err))
+	assert.False(t, ns.IsPublish())
+
+	//publish again on the same conn
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Publish()
+	}()
+	ns, err = sc.ReadHeader()
+	assert.NoError(t, err)
+	assert.True(t, ns.IsPublish())
+	assert.Equal(t, "test", ns.GetStreamName())
+	assert.NoError(t, <-errCh)
+}
+
+//eventHandler sends the calls of NetStreamHandler to ch
+type eventHandler struct {
+	ch chan string
+}
+
+func (h *eventHandler) HandlePublish(ns *NetStream) error {
+	h.ch <- fmt.Sprintf("publish %d %s", ns.ID(), ns.GetStreamName())
+	return nil
+}
+
+func (h *eventHandler) HandlePlay(ns *NetStream) error {
+	h.ch <- fmt.Sprintf("play %d %s", ns.ID(), ns.GetStreamName())
+	return nil
+}
+
+func (h *eventHandler) HandlePlayStart(ns *NetStream) {
+	p, _ := av.NewPacketFromData(av.TypeAudio, 0, []byte{0xaf, flv.AACPacketTypeAACRaw, byte(ns.ID())}, flv.NewDemuxer())
+	_ = ns.WritePacket(p)
+}
+
+func (h *eventHandler) HandleSwitch(ns *NetStream, oldStreamName string) error {
+	h.ch <- fmt.Sprintf("switch %d %s %s", ns.ID(), oldStreamName, ns.GetStreamName())
+	return nil
+}
+
+func (h *eventHandler) HandlePacket(ns *NetStream, p *av.Packet) error {
+	h.ch <- fmt.Sprintf("packet %d %x", ns.ID(), p.GetData())
+	return nil
+}
+
+func (h *eventHandler) HandleClose(ns *NetStream, err error) {
+	h.ch <- fmt.Sprintf("close %d %t", ns.ID(), err == nil)
+}
+
+func TestConn_Serve(t *testing.T) {
+	_ = debug.Init()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	h := &eventHandler{ch: make(chan string, 10)}
+	go func() {
+		netConn, err := ln.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		c, _ := NewConn(utils.NewBufferedConn(netConn, core.Size4KB))
+		defer c.Close()
+		if err := c.Handshake(); !assert.NoError(t, err) {
+			return
+		}
+		_ = c.Serve(h)
+	}()
+
+	//one conn publishes a and plays b, c at the same time
+	c, err := DialPublish("rtmp://" + ln.Addr().String() + "/live/a")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	assert.Equal(t, "publish 1 a", <-h.ch)
+	for i, streamName := range []string{"b", "c"} {
+		id := uint32(i + 2)
+		c.streamName = streamName
+		assert.NoError(t, c.Play())
+		assert.Equal(t, fmt.Sprintf("play %d %s", id, streamName), <-h.ch)
+		p, err := c.ReadPacket()
+		if assert.NoError(t, err) {
+			assert.Equal(t, id, p.GetStreamID())
+			assert.Equal(t, []byte{0xaf, flv.AACPacketTypeAACRaw, byte(id)}, p.GetData())
+		}
+	}
+
+	//the packets of the publishing NetStream
+	c.messageStreamID = 1
+	p, _ := av.NewPacketFromData(av.TypeAudio, 0, []byte{0xaf, flv.AACPacketTypeAACRaw, 0x01}, flv.NewDemuxer())
+	assert.NoError(t, c.WritePacket(p))
+	assert.Equal(t, "packet 1 af0101", <-h.ch)
+
+	//deleteStream stops one of them, the others are closed with the conn
+	data, _ := newNetStreamCommandDeleteStream(c.nextTransactionID(), 2)
+	assert.NoError(t, c.writeCommandMessage(chunkStreamID3, messageStreamID0, data))
+	assert.Equal(t, "close 2 true", <-h.ch)
+	_ = c.Close()
+	closes := []string{<-h.ch, <-h.ch}
+	assert.ElementsMatch(t, []string{"close 1 false", "close 3 false"}, closes)
+}
@@ -12,33 +12,63 @@ import (
 	"github.com/zhyoulun/gls/src/flv"
 	"github.com/zhyoulun/gls/src/utils"
 	"github.com/zhyoulun/gls/src/utils/debug"
+	"io"
+	"io/ioutil"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Conn struct {
-	conn utils.PeekerConn
+	conn   utils.PeekerConn
+	reader *countReader //reads conn, counts the bytes read for the acknowledgement
 
 	localMaximumChunkSize  uint32
 	remoteMaximumChunkSize uint32 //the maximum chunk size should be at least 128 bytes, and must be at least 1 byte
 
 	localWindowAckSize  uint32
 	remoteWindowAckSize uint32
-	receivedSize        uint32
+	lastAckSent         uint32 //the sequence number of the last acknowledgement sent
 
 	localPeerBandwidth uint32
-
-	chunkStreams map[uint32]*chunkStream
-
-	readMessageDone bool //默认值为false
-	isPublish       bool //默认值为false //todo
-
-	connInfo   ConnectCommentObject
-	streamName string
+	flow               *flowControl //the bytes written and acknowledged by the peer, limited by the peer bandwidth
+
+	chunkStreams     map[uint32]*chunkStream
+	chunkWriteStates map[uint32]*chunkWriteState //the last header written on each chunk stream, guarded by writeMutex
+
+	connInfo ConnectCommentObject
+
+	//the client has one NetStream
+	isClient        bool    //conn created by Dial
+	isPublish       bool    //publishing by the client
+	streamName      string  //stream name in the url of the client
+	transactionID   float64 //last transaction id sent by the client
+	messageStreamID uint32  //message stream id got from createStream by the client
+
+	//the server has any number of NetStreams
+	netStreams          map[uint32]*NetStream  //created by createStream, keyed by the message stream id
+	lastMessageStreamID uint32                 //the last message stream id allocated by createStream
+	startedNetStream    *NetStream             //the last NetStream starts publishing or playing, returned by ReadHeader
+	handler             NetStreamHandler       //set by Serve
+	callHandlers        map[string]CallHandler //registered by RegisterCall, keyed by the method name
+	sharedObjectHandler SharedObjectHandler    //set by SetSharedObjectHandler
+	rejected            bool                   //the _error of connect or an error onStatus is sent, the conn is drained by Serve
+
+	pendingMessages []*message //split from aggregate messages, returned by ReadPacket first
+
+	writeMutex *sync.Mutex //messages are written by the sink, the source(acknowledgement) and the ping goroutine
+	startTime  time.Time   //the base of the ping timestamp
+	pingMissed int32       //pings sent without response, atomic
+	rtt        int64       //round trip time measured by ping, nanosecond, atomic
+	closeOnce  *sync.Once
+	done       chan struct{} //closed by Close
 }
 
 func NewConn(conn utils.PeekerConn) (*Conn, error) {
 	return &Conn{
-		conn: conn,
+		conn:   conn,
+		reader: &countReader{ReadPeeker: conn},
 
 		localMaximumChunkSize:  defaultLocalMaximumChunkSize,
 		remoteMaximumChunkSize: defaultRemoteMaximumChunkSize,
@@ -47,8 +77,17 @@ func NewConn(conn utils.PeekerConn) (*Conn, error) {
 		remoteWindowAckSize: 2.5e6, //todo ??
 
 		localPeerBandwidth: 2.5e6, //todo ??
+		flow:               newFlowControl(),
 
-		chunkStreams: make(map[uint32]*chunkStream),
+		chunkStreams:     make(map[uint32]*chunkStream),
+		chunkWriteStates: make(map[uint32]*chunkWriteState),
+		netStreams:       make(map[uint32]*NetStream),
+		callHandlers:     make(map[string]CallHandler),
+
+		writeMutex: &sync.Mutex{},
+		startTime:  time.Now(),
+		closeOnce:  &sync.Once{},
+		done:       make(chan struct{}),
 	}, nil
 }
 
@@ -64,28 +103,81 @@ func (c *Conn) Handshake() error {
 	return nil
 }
 
-func (c *Conn) ReadHeader() error {
+//ReadHeader reads until a NetStream starts publishing or playing, and returns it,
+//then the packets are read by ReadPacket. Serve handles any number of NetStreams
+func (c *Conn) ReadHeader() (*NetStream, error) {
+	c.startedNetStream = nil
 	for {
-		if c.readMessageDone {
+		if c.startedNetStream != nil {
 			break
 		}
 		var m *message
 		var err error
 		if m, err = c.readMessage(); err != nil {
-			return err
+			return nil, err
 		}
 		//handle message in chunk stream
 		if err = c.handleMessage(m.getChunkStreamID(), m.GetMessageStreamID(), m.getMessageTypeID(), m.GetData(), m.GetTimestamp()); err != nil { //todo 这里的cs.timestamp传参可能有问题
+			return nil, err
+		}
+	}
+	return c.startedNetStream, nil
+}
+
+//Serve reads the server conn until it fails, the NetStreams are told to h,
+//the NetStreams still publishing or playing are closed with the error at last
+func (c *Conn) Serve(h NetStreamHandler) error {
+	c.handler = h
+	err := c.serve()
+	for _, ns := range c.netStreams {
+		if ns.started {
+			ns.reset()
+			h.HandleClose(ns, err)
+		}
+	}
+	if c.sharedObjectHandler != nil {
+		c.sharedObjectHandler.HandleSharedObjectClose(c)
+	}
+	if c.rejected {
+		c.drain()
+	}
+	return err
+}
+
+//drain reads until the peer closes the conn after the rejection, or until rejectDrainTimeout.
+//the conn closed with the messages unread, e.g. set buffer length after play, is reset by tcp,
+//and the peer may lose the error status before reading it
+func (c *Conn) drain() {
+	timer := time.AfterFunc(rejectDrainTimeout, func() {
+		_ = c.Close()
+	})
+	defer timer.Stop()
+	_, _ = io.Copy(ioutil.Discard, c.reader)
+}
+
+func (c *Conn) serve() error {
+	for {
+		p, err := c.ReadPacket()
+		if err != nil {
+			return err
+		}
+		ns, ok := c.netStreams[p.GetStreamID()]
+		if !ok || !ns.started || !ns.isPublish {
+			log.Debugf("serve, ignore packet of message stream %d", p.GetStreamID())
+			continue
+		}
+		if err := c.handler.HandlePacket(ns, p); err != nil {
 			return err
 		}
 	}
-	return nil
 }
 
+//IsPublish reports whether the client is publishing
 func (c *Conn) IsPublish() bool {
 	return c.isPublish
 }
 
+//GetStreamName returns the stream name in the url of the client
 func (c *Conn) GetStreamName() string {
 	return c.streamName
 }
@@ -94,14 +186,26 @@ func (c *Conn) GetConnInfo() ConnectCommentObject {
 	return c.connInfo
 }
 
+//Close can be called more than once, e.g. by the sink and the ping goroutine
 func (c *Conn) Close() error {
-	return c.conn.Close()
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.conn.Close()
+	})
+	return err
 }
 
+//ReadPacket reads the next audio, video or data packet, the player gets core.ErrorStreamClosed after NetStream.Play.Stop
 func (c *Conn) ReadPacket() (*av.Packet, error) {
 	var m *message
 	var err error
 	for {
+		if len(c.pendingMessages) > 0 {
+			m = c.pendingMessages[0]
+			c.pendingMessages = c.pendingMessages[1:]
+			break
+		}
 		m, err = c.readMessage()
 		if err != nil {
 			return nil, err
@@ -118,6 +222,33 @@ func (c *Conn) ReadPacket() (*av.Packet, error) {
 			m.getMessageTypeID() == typeDataAMF0 || m.getMessageTypeID() == typeDataAMF3 {
 			break
 		}
+		if m.getMessageTypeID() == typeAggregate {
+			if c.pendingMessages, err = splitAggregateMessage(m); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		//commands of the NetStream, e.g. deleteStream of the publisher, and the shared object messages
+		if !c.isClient && (m.getMessageTypeID() == typeCommandAMF0 || m.getMessageTypeID() == typeCommandAMF3 ||
+			m.getMessageTypeID() == typeSharedObjectAMF0 || m.getMessageTypeID() == typeSharedObjectAMF3) {
+			if err := c.handleMessage(m.getChunkStreamID(), m.GetMessageStreamID(), m.getMessageTypeID(), m.GetData(), m.GetTimestamp()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		//the player is told the end of the recorded stream or the duration of play
+		if c.isClient && (m.getMessageTypeID() == typeCommandAMF0 || m.getMessageTypeID() == typeCommandAMF3) {
+			if code := statusCode(m); code == "NetStream.Play.Stop" {
+				return nil, errors.Wrapf(core.ErrorStreamClosed, "onStatus: %s", code)
+			}
+		}
+		//the peer may change the chunk size or window at any time, e.g. the server before play start
+		if isProtocolControlMessage(m.getMessageTypeID()) || m.getMessageTypeID() == typeUserControl {
+			if err := c.handleMessage(m.getChunkStreamID(), m.GetMessageStreamID(), m.getMessageTypeID(), m.GetData(), m.GetTimestamp()); err != nil {
+				return nil, err
+			}
+			continue
+		}
 		log.Tracef("read packet, ignore, messageTypeID: %d", m.getMessageTypeID())
 	}
 
@@ -140,6 +271,14 @@ func (c *Conn) WritePacket(p *av.Packet) error {
 	if err != nil {
 		return err
 	}
+	if c.isClient {
+		m.cs.messageStreamID = c.messageStreamID
+	}
+	//only the packets wait for the acknowledgement, the other messages are written by the reading goroutine,
+	//which must not be blocked to read the acknowledgement. the writer is not blocked for long by a peer never acknowledging
+	if err := c.flow.wait(c.done, writeAckTimeout); err != nil {
+		return err
+	}
 	if err := c.writeMessage(m); err != nil {
 		return err
 	}
@@ -158,7 +297,7 @@ func (c *Conn) readMessage() (*message, error) {
 		if basicHeader, err = newChunkBasicHeaderForRead(); err != nil {
 			return nil, err
 		}
-		if err = basicHeader.Read(c.conn); err != nil {
+		if err = basicHeader.Read(c.reader); err != nil {
 			return nil, err
 		}
 		log.Tracef("basic header: %s", basicHeader)
@@ -175,7 +314,7 @@ func (c *Conn) readMessage() (*message, error) {
 		}
 
 		//read chunk to chunk stream
-		if err = cs.readChunk(c.conn, c.remoteMaximumChunkSize); err != nil {
+		if err = cs.readChunk(c.reader, c.remoteMaximumChunkSize); err != nil {
 			return nil, err
 		}
 		if cs.gotOneMessage() {
@@ -184,30 +323,43 @@ func (c *Conn) readMessage() (*message, error) {
 		}
 	}
 
-	if err := c.ack(cs.messageLength); err != nil {
+	if err := c.ack(); err != nil {
 		return nil, err
 	}
 
 	return newMessage(cs)
 }
 
-func (c *Conn) ack(receivedSize uint32) error {
-	c.receivedSize += receivedSize
-	if c.receivedSize >= c.remoteWindowAckSize {
-		m, err := newPCMAcknowledgement(receivedSize)
-		if err != nil {
-			return err
-		}
-		if err := c.writeMessage(m); err != nil {
-			return err
-		}
-		c.receivedSize = 0
+//ack sends the bytes read so far as the sequence number, after each window acknowledgement size bytes
+func (c *Conn) ack() error {
+	if c.reader.n-c.lastAckSent < c.remoteWindowAckSize {
+		return nil
+	}
+	m, err := newPCMAcknowledgement(c.reader.n)
+	if err != nil {
+		return err
 	}
+	if err := c.writeMessage(m); err != nil {
+		return err
+	}
+	c.lastAckSent = c.reader.n
 	return nil
 }
 
 func (c *Conn) writeMessage(m *message) error {
-	return m.cs.writeChunk(c.conn, c.localMaximumChunkSize)
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	last := c.chunkWriteStates[m.cs.chunkStreamID]
+	w := &countWriter{Writer: c.conn}
+	state, err := m.cs.writeChunk(w, c.localMaximumChunkSize, last)
+	c.flow.written(w.n)
+	if err != nil {
+		//the peer can not follow the chunk stream after a partial write, the next message starts with fmt0
+		delete(c.chunkWriteStates, m.cs.chunkStreamID)
+		return err
+	}
+	c.chunkWriteStates[m.cs.chunkStreamID] = state
+	return nil
 }
 
 func (c *Conn) handleMessage(chunkStreamID, messageStreamID uint32, messageTypeID uint8, data []byte, timestamp uint32) error {
@@ -220,7 +372,7 @@ func (c *Conn) handleMessage(chunkStreamID, messageStreamID uint32, messageTypeI
 		typeAbort,
 		typeAcknowledgement,
 		typeWindowAcknowledgementSize,
-		typeSetPeerBandwidth: //timestamp is ignored
+		typeSetPeerBandwidth: //timestamp is ignored, keep the same with isProtocolControlMessage
 		if chunkStreamID != chunkStreamID2 {
 			return errors.Errorf("protocol control message must be sent in chunk stream id 2")
 		}
@@ -228,7 +380,8 @@ func (c *Conn) handleMessage(chunkStreamID, messageStreamID uint32, messageTypeI
 			return errors.Errorf("protocol control message must have message stream id 0")
 		}
 		return c.handleProtocolControlMessage(messageTypeID, data)
-	case typeUserControl: //todo
+	case typeUserControl:
+		return c.handleUserControlMessage(data)
 
 	case typeAudio: //todo
 	case typeVideo: //todo
@@ -236,14 +389,12 @@ func (c *Conn) handleMessage(chunkStreamID, messageStreamID uint32, messageTypeI
 	case typeDataAMF3: //todo
 	case typeDataAMF0: //todo
 
-	case typeSharedObjectAMF3: //todo
-	case typeSharedObjectAMF0: //todo
+	case typeSharedObjectAMF3, typeSharedObjectAMF0:
+		return c.handleSharedObjectMessage(messageTypeID, data)
 
-	case typeCommandAMF3: //todo
-		return errors.Wrapf(core.ErrorNotImplemented, "typeCommandAMF3")
-	case typeCommandAMF0:
+	case typeCommandAMF3, typeCommandAMF0:
 		return c.handleCommandMessage(chunkStreamID, messageStreamID, messageTypeID, data, timestamp)
-	case typeAggregate: //todo
+	case typeAggregate: //split by ReadPacket
 	default:
 		return errors.Wrapf(core.ErrorNotSupported, "messageTypeID: %d", messageTypeID)
 	}
@@ -251,59 +402,163 @@ func (c *Conn) handleMessage(chunkStreamID, messageStreamID uint32, messageTypeI
 	return nil
 }
 
+func isProtocolControlMessage(messageTypeID uint8) bool {
+	switch messageTypeID {
+	case typeSetChunkSize,
+		typeAbort,
+		typeAcknowledgement,
+		typeWindowAcknowledgementSize,
+		typeSetPeerBandwidth:
+		return true
+	}
+	return false
+}
+
 func (c *Conn) handleCommandMessage(chunkStreamID, messageStreamID uint32, typeID uint8, data []byte, timestamp uint32) error {
 	log.Tracef("handle command message, chunkStreamID: %d, messageStreamID: %d, typeID: %d", chunkStreamID, messageStreamID, typeID)
-	amfDecoder, err := amf.NewAmf()
+	command, vs, err := decodeCommandMessage(typeID, data)
 	if err != nil {
 		return err
 	}
-	r := bytes.NewReader(data)
-	vs, err := amfDecoder.DecodeBatch(r, amf.Amf0)
-	if err != nil {
-		return errors.Wrap(err, "amf decoder decode batch")
-	}
-	if len(vs) == 0 {
-		return fmt.Errorf("amf decode error, len(vs)=0")
-	}
-
-	switch vs[0].(type) {
-	case string:
-	default:
-		return core.ErrorUnknown
-	}
-
-	command, ok := vs[0].(string)
-	if !ok {
-		return core.ErrorImpossible
-	}
 
 	switch command {
 	case commandNetConnectionConnect:
-		return c.handleCommandConnect(chunkStreamID, messageStreamID, vs[1:])
-	case commandNetConnectionCall: //todo
+		return c.handleCommandConnect(chunkStreamID, messageStreamID, vs)
 	case commandNetConnectionCreateStream:
-		return c.handleCommandCreateStream(chunkStreamID, messageStreamID, vs[1:])
+		return c.handleCommandCreateStream(chunkStreamID, messageStreamID, vs)
 	case commandNetStreamPlay:
-		c.readMessageDone = true
-		return c.handleCommandPlay(chunkStreamID, messageStreamID, vs[1:])
-	case commandNetStreamPlay2: //todo
-	case commandNetStreamDeleteStream: //todo
-	case commandNetStreamCloseStream: //todo
-	case commandNetStreamReceiveAudio: //todo
+		return c.handleCommandPlay(chunkStreamID, messageStreamID, vs)
+	case commandNetStreamPlay2:
+		return c.handleCommandPlay2(chunkStreamID, messageStreamID, vs)
+	case commandNetStreamDeleteStream:
+		return c.handleCommandDeleteStream(chunkStreamID, messageStreamID, vs)
+	case commandNetStreamCloseStream:
+		return c.closeNetStream(chunkStreamID, c.netStreams[messageStreamID], command)
+	case commandReleaseStream:
+		return c.handleCommandReleaseStream(chunkStreamID, messageStreamID, vs)
+	case commandFCPublish:
+		return c.handleCommandFCPublish(chunkStreamID, messageStreamID, vs)
+	case commandFCUnpublish:
+		return c.handleCommandFCUnpublish(chunkStreamID, messageStreamID, vs)
+	case commandFCSubscribe:
+		return c.handleCommandFCSubscribe(chunkStreamID, messageStreamID, vs)
 	//NetStream send the receiveAudio message to inform the server whether to send or not to send the audio to the client
-	case commandNetStreamReceiveVideo: //todo
+	case commandNetStreamReceiveAudio, commandNetStreamReceiveVideo:
+		return c.handleCommandReceive(chunkStreamID, messageStreamID, command, vs)
 	case commandNetStreamPublish:
-		c.readMessageDone = true
-		c.isPublish = true
-		return c.handleCommandPublish(chunkStreamID, messageStreamID, vs[1:])
+		return c.handleCommandPublish(chunkStreamID, messageStreamID, vs)
 	case commandNetStreamSeek: //todo
-	case commandNetStreamPause: //todo
+	case commandNetStreamPause:
+		return c.handleCommandPause(chunkStreamID, messageStreamID, vs)
+	case commandNetConnectionResult, commandNetConnectionError, commandNetStreamOnStatus:
+		//responses are never answered
+		log.Debugf("ignore command: %s", command)
 	default:
+		return c.handleCommandCall(chunkStreamID, messageStreamID, command, vs)
+	}
+	return nil
+}
+
+//CallHandler is a method called by the client with NetConnection.call,
+//the results are sent back with _result, the error with _error, the conn is kept in both cases
+type CallHandler func(conn *Conn, args []interface{}) ([]interface{}, error)
+
+//RegisterCall registers the handler of a method, it must be called before Serve
+func (c *Conn) RegisterCall(name string, h CallHandler) {
+	c.callHandlers[name] = h
+}
+
+//1. client -> server: command message(the method name, transaction id, command object, arguments)
+//2. server -> client: command message(_result with the results, or _error), only if the transaction id is not 0
+func (c *Conn) handleCommandCall(chunkStreamID, messageStreamID uint32, command string, vs []interface{}) error {
+	//vs[0] transaction id, vs[1] command object, usually nil, vs[2:] arguments
+	var transactionID float64
+	if len(vs) > 0 {
+		transactionID, _ = vs[0].(float64)
+	}
+	var args []interface{}
+	if len(vs) > 2 {
+		args = vs[2:]
+	}
+	h, ok := c.callHandlers[command]
+	if !ok {
 		log.Warnf("unknown command: %s", command)
+		if transactionID == transactionID0 {
+			return nil
+		}
+		if msg, err := newNetConnectionResponseCallFailed(transactionID, fmt.Sprintf("method not found: %s", command), c.objectEncoding()); err != nil {
+			return err
+		} else {
+			return c.writeCommandMessage(chunkStreamID, messageStreamID, msg)
+		}
+	}
+
+	results, err := h(c, args)
+	if transactionID == transactionID0 {
+		//no response is expected
+		if err != nil {
+			log.Warnf("call %s, err: %s", command, err)
+		}
+		return nil
+	}
+	var msg []byte
+	if err != nil {
+		log.Warnf("call %s, err: %s", command, err)
+		msg, err = newNetConnectionResponseCallFailed(transactionID, err.Error(), c.objectEncoding())
+	} else {
+		msg, err = newNetConnectionResponseCallResult(transactionID, results, c.objectEncoding())
+	}
+	if err != nil {
+		return err
+	}
+	return c.writeCommandMessage(chunkStreamID, messageStreamID, msg)
+}
+
+//decodeCommandMessage returns the command name and the values after it,
+//the amf3 command starts with a 0x00 byte, followed by amf0 values which may switch to amf3 by the avmplus-object-marker
+func decodeCommandMessage(typeID uint8, data []byte) (string, []interface{}, error) {
+	if typeID == typeCommandAMF3 && len(data) > 0 && data[0] == 0x00 {
+		data = data[1:]
+	}
+	amfDecoder, err := amf.NewAmf()
+	if err != nil {
+		return "", nil, err
+	}
+	vs, err := amfDecoder.DecodeBatch(bytes.NewReader(data), amf.Amf0)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "amf decoder decode batch")
+	}
+	if len(vs) == 0 {
+		return "", nil, fmt.Errorf("amf decode error, len(vs)=0")
+	}
+	command, ok := vs[0].(string)
+	if !ok {
+		return "", nil, core.ErrorUnknown
+	}
+	return command, vs[1:], nil
+}
+
+//writeCommandMessage writes data encoded in the negotiated amf version,
+//which is always amf0 for the client
+func (c *Conn) writeCommandMessage(chunkStreamID, messageStreamID uint32, data []byte) error {
+	if m, err := newCommandMessage(chunkStreamID, messageStreamID, c.objectEncoding(), data); err != nil {
+		return err
+	} else {
+		if err := c.writeMessage(m); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+//objectEncoding is the amf version negotiated in connect, commands are sent in it
+func (c *Conn) objectEncoding() amf.AmfVersion {
+	if c.connInfo.ObjectEncoding == float64(amf.Amf3) {
+		return amf.Amf3
+	}
+	return amf.Amf0
+}
+
 func (c *Conn) handleProtocolControlMessage(typeID uint8, data []byte) error {
 	n := len(data)
 	switch typeID {
@@ -320,12 +575,17 @@ func (c *Conn) handleProtocolControlMessage(typeID uint8, data []byte) error {
 		if n != 4 {
 			return fmt.Errorf("abort error, length: %d", n)
 		}
-		//todo discard the partially received message over a chunk stream
+		//discard the partially received message over the chunk stream
+		chunkStreamID := binary.BigEndian.Uint32(data)
+		if cs, ok := c.chunkStreams[chunkStreamID]; ok {
+			log.Infof("abort message, chunkStreamID: %d, messageLength: %d, dataIndex: %d", chunkStreamID, cs.messageLength, cs.dataIndex)
+			cs.abort()
+		}
 	case typeAcknowledgement:
 		if n != 4 {
 			return fmt.Errorf("acknowledgement error, length: %d", n)
 		}
-		//check is useless
+		c.flow.acknowledge(binary.BigEndian.Uint32(data))
 	case typeWindowAcknowledgementSize:
 		if n != 4 {
 			return fmt.Errorf("window acknowledgement size error, length: %d", n)
@@ -335,13 +595,50 @@ func (c *Conn) handleProtocolControlMessage(typeID uint8, data []byte) error {
 		if n != 5 {
 			return fmt.Errorf("set peer bandwidth error, length: %d", n)
 		}
-		//todo peer bandwidth, limit type strategy
+		window, err := c.flow.setPeerBandwidth(binary.BigEndian.Uint32(data), data[4])
+		if err != nil {
+			return err
+		}
+		//respond with the window acknowledgement size if it is different from the last one sent,
+		//so that the peer acknowledges before the window is used up
+		if window == 0 || window == c.localWindowAckSize {
+			return nil
+		}
+		c.localWindowAckSize = window
+		if m, err := newPCMWindowAcknowledgementSize(window); err != nil {
+			return err
+		} else {
+			return c.writeMessage(m)
+		}
 	default:
 		return core.ErrorNotSupported
 	}
 	return nil
 }
 
+//event type(2B) followed by event data
+func (c *Conn) handleUserControlMessage(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("user control message error, length: %d", len(data))
+	}
+	eventType := binary.BigEndian.Uint16(data)
+	switch eventType {
+	case EventPingRequest:
+		if len(data) != 6 {
+			return fmt.Errorf("ping request error, length: %d", len(data))
+		}
+		return c.handlePingRequest(binary.BigEndian.Uint32(data[2:]))
+	case EventPingResponse:
+		if len(data) != 6 {
+			return fmt.Errorf("ping response error, length: %d", len(data))
+		}
+		c.handlePingResponse(binary.BigEndian.Uint32(data[2:]))
+	default:
+		log.Tracef("user control message, ignore, eventType: %d", eventType)
+	}
+	return nil
+}
+
 //1. client -> server: send connect command(connect)
 //2. server -> client: window acknowledgement size
 //3. server -> client: set peer bandwidth
@@ -349,8 +646,9 @@ func (c *Conn) handleProtocolControlMessage(typeID uint8, data []byte) error {
 //5. server -> client: user control message(StreamBegin)
 //6. server -> client: command message(_result - connect response)
 func (c *Conn) handleCommandConnect(chunkStreamID, messageStreamID uint32, vs []interface{}) error {
-	if len(vs) != 2 {
-		return errors.Errorf("handle command connect, len(vs) error, want: 2, got: %d", len(vs))
+	//optional user arguments may follow the command object, e.g. conn= of librtmp
+	if len(vs) < 2 {
+		return errors.Errorf("handle command connect, len(vs) error, want: >=2, got: %d", len(vs))
 	}
 
 	var transactionID float64
@@ -359,9 +657,6 @@ func (c *Conn) handleCommandConnect(chunkStreamID, messageStreamID uint32, vs []
 	if !ok {
 		return fmt.Errorf("parse transaction id fail, not float64")
 	}
-	if transactionID != transactionID1 {
-		return fmt.Errorf("parse transcation id, want: 1, got: %f", transactionID)
-	}
 
 	obj, ok := vs[1].(amf.AmfObject)
 	if !ok {
@@ -401,8 +696,18 @@ func (c *Conn) handleCommandConnect(chunkStreamID, messageStreamID uint32, vs []
 	if v, ok := obj["type"]; ok {
 		c.connInfo.Type = v.(string)
 	}
+	if v, ok := obj["fourCcList"].(amf.AmfArray); ok {
+		for _, fourCC := range v {
+			if s, ok := fourCC.(string); ok {
+				c.connInfo.FourCcList = append(c.connInfo.FourCcList, s)
+			}
+		}
+	}
 
 	log.Infof("handle command connect, connInfo: %+v", c.connInfo)
+	if c.connInfo.App == "" {
+		return c.rejectConnect(chunkStreamID, messageStreamID, transactionID, errors.Wrapf(core.ErrorRejected, "app is empty"))
+	}
 
 	if m, err := newPCMWindowAcknowledgementSize(c.localWindowAckSize); err != nil {
 		return err
@@ -433,10 +738,10 @@ func (c *Conn) handleCommandConnect(chunkStreamID, messageStreamID uint32, vs []
 			return err
 		}
 	}
-	if msg, err := newNetConnectionResponseConnect(transactionID); err != nil {
+	if msg, err := newNetConnectionResponseConnect(transactionID, c.objectEncoding()); err != nil {
 		return err
 	} else {
-		if m, err := newCommandMessage(chunkStreamID, messageStreamID, msg); err != nil {
+		if m, err := newCommandMessage(chunkStreamID, messageStreamID, c.objectEncoding(), msg); err != nil {
 			return err
 		} else {
 			if err := c.writeMessage(m); err != nil {
@@ -449,17 +754,16 @@ func (c *Conn) handleCommandConnect(chunkStreamID, messageStreamID uint32, vs []
 }
 
 func (c *Conn) handleCommandCreateStream(chunkStreamID, messageStreamID uint32, vs []interface{}) error {
-	if len(vs) != 2 {
-		return errors.Errorf("handle command connect, len(vs) error, want: 2, got: %d", len(vs))
+	if len(vs) < 1 {
+		return errors.Errorf("handle command createStream, len(vs) error, want: >=1, got: %d", len(vs))
 	}
-	var transactionID float64
-	switch vs[0].(type) {
-	case float64:
-		transactionID = vs[0].(float64)
-		if transactionID != 4 && transactionID != 2 { //todo ??? 4 for publish, 2 for play
-			return errors.Errorf("parse transcation id, want: 4/2, got: %f", transactionID)
-		}
+	transactionID, ok := vs[0].(float64)
+	if !ok {
+		return errors.Errorf("parse transaction id, want float64, got: %+v", vs[0])
 	}
+	//vs[1] is nil
+	c.lastMessageStreamID++
+	c.netStreams[c.lastMessageStreamID] = newNetStream(c, c.lastMessageStreamID)
 
 	if m, err := newUCMStreamBegin(messageStreamID); err != nil {
 		return err
@@ -469,10 +773,10 @@ func (c *Conn) handleCommandCreateStream(chunkStreamID, messageStreamID uint32,
 		}
 	}
 
-	if msg, err := newNetConnectionResponseCreateStream(transactionID, 1); err != nil { //todo ??这里为什么是1
+	if msg, err := newNetConnectionResponseCreateStream(transactionID, c.lastMessageStreamID, c.objectEncoding()); err != nil {
 		return err
 	} else {
-		if m, err := newCommandMessage(chunkStreamID, messageStreamID, msg); err != nil {
+		if m, err := newCommandMessage(chunkStreamID, messageStreamID, c.objectEncoding(), msg); err != nil {
 			return err
 		} else {
 			if err := c.writeMessage(m); err != nil {
@@ -494,22 +798,40 @@ func (c *Conn) handleCommandPublish(chunkStreamID, messageStreamID uint32, vs []
 	if len(vs) < 3 {
 		return errors.Errorf("handle command publish, len(vs) error, want: >=3, got: %d", len(vs))
 	}
-	transactionID, ok := vs[0].(float64)
-	if !ok || transactionID != 5 { //todo ??
-		return errors.Errorf("parse transaction id, want float64 0, got: %+v", vs[0])
-	}
-	//vs[1] is nil
+	//vs[0] transaction id, 0 is sent by most clients, vs[1] is nil
 	publishingName, ok := vs[2].(string)
 	if !ok {
 		return errors.Errorf("parse publishing name, want string, got: %+v", vs[2])
 	}
-	c.streamName = publishingName
-	//vs[3] publishing type
+	publishingType := PublishingTypeLive
+	if len(vs) > 3 {
+		//vs[3] publishing type, some clients send nothing or null for live
+		switch t, _ := vs[3].(string); t {
+		case PublishingTypeLive, PublishingTypeRecord, PublishingTypeAppend:
+			publishingType = t
+		default:
+			log.Warnf("handle command publish, unknown publishing type: %+v, publish as live", vs[3])
+		}
+	}
+	if publishingName == "" {
+		return c.rejectNetStream(chunkStreamID, messageStreamID, true, errors.Wrapf(core.ErrorRejected, "publishing name is empty"))
+	}
+	ns, err := c.startNetStream(messageStreamID, publishingName, true)
+	if err != nil {
+		return err
+	}
+	ns.publishingType = publishingType
+	if c.handler != nil {
+		if err := c.handler.HandlePublish(ns); err != nil {
+			ns.reset()
+			return c.rejectNetStream(chunkStreamID, messageStreamID, true, err)
+		}
+	}
 
-	if msg, err := newNetStreamResponsePublishStart(); err != nil {
+	if msg, err := newNetStreamResponsePublishStart(c.objectEncoding()); err != nil {
 		return err
 	} else {
-		if m, err := newCommandMessage(chunkStreamID, messageStreamID, msg); err != nil {
+		if m, err := newCommandMessage(chunkStreamID, messageStreamID, c.objectEncoding(), msg); err != nil {
 			return err
 		} else {
 			if err := c.writeMessage(m); err != nil {
@@ -517,7 +839,301 @@ func (c *Conn) handleCommandPublish(chunkStreamID, messageStreamID uint32, vs []
 			}
 		}
 	}
+	if ns.IsRecord() {
+		if msg, err := newNetStreamResponseRecordStart(c.objectEncoding()); err != nil {
+			return err
+		} else {
+			if err := c.writeCommandMessage(chunkStreamID, messageStreamID, msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//parseFCCommand parses releaseStream, FCPublish, FCUnpublish and FCSubscribe,
+//vs[0] is the transaction id, vs[1] is nil, vs[2] is the stream name
+func parseFCCommand(command string, vs []interface{}) (float64, string, error) {
+	if len(vs) < 3 {
+		return 0, "", errors.Errorf("handle command %s, len(vs) error, want: >=3, got: %d", command, len(vs))
+	}
+	transactionID, ok := vs[0].(float64)
+	if !ok {
+		return 0, "", errors.Errorf("parse transaction id, want float64, got: %+v", vs[0])
+	}
+	streamName, ok := vs[2].(string)
+	if !ok {
+		return 0, "", errors.Errorf("parse stream name, want string, got: %+v", vs[2])
+	}
+	return transactionID, streamName, nil
+}
+
+//releaseStream is sent before FCPublish, in case the stream name is still held by a broken conn of the same encoder,
+//the stream is released when its source fails, so it is only answered
+func (c *Conn) handleCommandReleaseStream(chunkStreamID, messageStreamID uint32, vs []interface{}) error {
+	transactionID, streamName, err := parseFCCommand(commandReleaseStream, vs)
+	if err != nil {
+		return err
+	}
+	log.Debugf("handle command releaseStream, stream name: %s", streamName)
+	if msg, err := newNetConnectionResponseResult(transactionID, c.objectEncoding()); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID, messageStreamID, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//1. client -> server: command message(FCPublish)
+//2. server -> client: command message(onFCPublish)
+//3. server -> client: command message(_result - FCPublish response)
+func (c *Conn) handleCommandFCPublish(chunkStreamID, messageStreamID uint32, vs []interface{}) error {
+	transactionID, streamName, err := parseFCCommand(commandFCPublish, vs)
+	if err != nil {
+		return err
+	}
+	if msg, err := newNetConnectionResponseOnFCPublish(streamName, c.objectEncoding()); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID, messageStreamID, msg); err != nil {
+			return err
+		}
+	}
+	if msg, err := newNetConnectionResponseResult(transactionID, c.objectEncoding()); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID, messageStreamID, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//1. client -> server: command message(FCUnpublish)
+//2. server -> client: command message(onFCUnpublish)
+//3. server -> client: command message(_result - FCUnpublish response)
+//4. server -> client: command message(onStatus - unpublish success)
+func (c *Conn) handleCommandFCUnpublish(chunkStreamID, messageStreamID uint32, vs []interface{}) error {
+	transactionID, streamName, err := parseFCCommand(commandFCUnpublish, vs)
+	if err != nil {
+		return err
+	}
+	if msg, err := newNetConnectionResponseOnFCUnpublish(streamName, c.objectEncoding()); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID, messageStreamID, msg); err != nil {
+			return err
+		}
+	}
+	if msg, err := newNetConnectionResponseResult(transactionID, c.objectEncoding()); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID, messageStreamID, msg); err != nil {
+			return err
+		}
+	}
+	//FCUnpublish is sent on the NetConnection, the NetStream is found by the stream name
+	for _, ns := range c.netStreams {
+		if ns.started && ns.isPublish && ns.GetStreamName() == streamName {
+			return c.closeNetStream(chunkStreamID, ns, commandFCUnpublish)
+		}
+	}
+	log.Debugf("handle command FCUnpublish, stream %s is not publishing", streamName)
+	return nil
+}
+
+//1. client -> server: command message(FCSubscribe)
+//2. server -> client: command message(onFCSubscribe)
+//3. server -> client: command message(_result - FCSubscribe response)
+//the stream is subscribed by the following play
+func (c *Conn) handleCommandFCSubscribe(chunkStreamID, messageStreamID uint32, vs []interface{}) error {
+	transactionID, streamName, err := parseFCCommand(commandFCSubscribe, vs)
+	if err != nil {
+		return err
+	}
+	if msg, err := newNetConnectionResponseOnFCSubscribe(streamName, c.objectEncoding()); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID, messageStreamID, msg); err != nil {
+			return err
+		}
+	}
+	if msg, err := newNetConnectionResponseResult(transactionID, c.objectEncoding()); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID, messageStreamID, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//deleteStream is sent on the NetConnection, with the message stream id of the NetStream to delete
+func (c *Conn) handleCommandDeleteStream(chunkStreamID, messageStreamID uint32, vs []interface{}) error {
+	//vs[0] transaction id, vs[1] is nil, vs[2] message stream id
+	if len(vs) >= 3 {
+		if id, ok := vs[2].(float64); ok {
+			messageStreamID = uint32(id)
+		}
+	}
+	ns := c.netStreams[messageStreamID]
+	delete(c.netStreams, messageStreamID)
+	return c.closeNetStream(chunkStreamID, ns, commandNetStreamDeleteStream)
+}
+
+//FCUnpublish, deleteStream and closeStream stop the publishing or playing, the NetConnection is kept.
+//The handler of Serve is told, otherwise ReadPacket returns core.ErrorStreamClosed to the caller,
+//so that ReadHeader can be called again for the next publish or play
+func (c *Conn) closeNetStream(chunkStreamID uint32, ns *NetStream, command string) error {
+	if ns == nil || !ns.started {
+		//e.g. deleteStream after FCUnpublish
+		log.Debugf("handle command %s, no stream is publishing or playing", command)
+		return nil
+	}
+	log.Infof("handle command %s, NetStream: %s", command, ns)
+	if ns.isPublish && ns.IsRecord() {
+		if msg, err := newNetStreamResponseRecordStop(c.objectEncoding()); err != nil {
+			return err
+		} else {
+			if err := c.writeCommandMessage(chunkStreamID, ns.id, msg); err != nil {
+				return err
+			}
+		}
+	}
+	if ns.isPublish {
+		if msg, err := newNetStreamResponseUnpublishSuccess(c.objectEncoding()); err != nil {
+			return err
+		} else {
+			//FCUnpublish and deleteStream are sent on the NetConnection
+			if err := c.writeCommandMessage(chunkStreamID, ns.id, msg); err != nil {
+				return err
+			}
+		}
+	}
+	ns.reset()
+	if c.handler != nil {
+		c.handler.HandleClose(ns, nil)
+		return nil
+	}
+	return errors.Wrapf(core.ErrorStreamClosed, "command: %s", command)
+}
+
+//startNetStream starts publishing or playing on the NetStream of messageStreamID
+func (c *Conn) startNetStream(messageStreamID uint32, streamName string, isPublish bool) (*NetStream, error) {
+	ns, ok := c.netStreams[messageStreamID]
+	if !ok {
+		return nil, errors.Errorf("message stream %d is not created by createStream", messageStreamID)
+	}
+	if ns.started {
+		return nil, errors.Errorf("message stream %d is publishing or playing, NetStream: %s", messageStreamID, ns)
+	}
+	ns.setStreamName(streamName)
+	ns.isPublish = isPublish
+	ns.started = true
+	c.startedNetStream = ns
+	return ns, nil
+}
+
+//playingNetStream returns the NetStream of messageStreamID if it is playing
+func (c *Conn) playingNetStream(messageStreamID uint32) *NetStream {
+	if ns, ok := c.netStreams[messageStreamID]; ok && ns.started && !ns.isPublish {
+		return ns
+	}
+	return nil
+}
+
+//1. client -> server: command message(pause)
+//2. server -> client: user control message(stream eof for pause, stream begin for unpause)
+//3. server -> client: command message(onStatus - pause notify or unpause notify)
+//the conn is kept while pausing, the stream resumes at the next keyframe
+func (c *Conn) handleCommandPause(chunkStreamID, messageStreamID uint32, vs []interface{}) error {
+	//vs[0] transaction id, vs[1] is nil, vs[2] pause or unpause, vs[3] milliSeconds
+	if len(vs) < 3 {
+		return errors.Errorf("handle command pause, len(vs) error, want: >=3, got: %d", len(vs))
+	}
+	pause, ok := vs[2].(bool)
+	if !ok {
+		return errors.Errorf("parse pause, want bool, got: %+v", vs[2])
+	}
+	ns := c.playingNetStream(messageStreamID)
+	if ns == nil {
+		log.Debugf("handle command pause, message stream %d is not playing", messageStreamID)
+		return nil
+	}
+	log.Infof("handle command pause, NetStream: %s, pause: %t", ns, pause)
+	var m *message
+	var msg []byte
+	var err error
+	if pause {
+		atomic.StoreInt32(&ns.paused, 1)
+		if m, err = newUCMStreamEOF(ns.id); err != nil {
+			return err
+		}
+		if msg, err = newNetStreamResponsePauseNotify(c.objectEncoding()); err != nil {
+			return err
+		}
+	} else {
+		atomic.StoreInt32(&ns.paused, 0)
+		if m, err = newUCMStreamBegin(ns.id); err != nil {
+			return err
+		}
+		if msg, err = newNetStreamResponseUnpauseNotify(c.objectEncoding()); err != nil {
+			return err
+		}
+	}
+	if err := c.writeMessage(m); err != nil {
+		return err
+	}
+	return c.writeCommandMessage(chunkStreamID, ns.id, msg)
+}
 
+//1. client -> server: command message(receiveAudio or receiveVideo)
+//2. server -> client: command message(onStatus - seek notify), only if the flag is true
+//3. server -> client: command message(onStatus - play start), only if the flag is true
+func (c *Conn) handleCommandReceive(chunkStreamID, messageStreamID uint32, command string, vs []interface{}) error {
+	//vs[0] transaction id, vs[1] is nil, vs[2] the flag
+	if len(vs) < 3 {
+		return errors.Errorf("handle command %s, len(vs) error, want: >=3, got: %d", command, len(vs))
+	}
+	flag, ok := vs[2].(bool)
+	if !ok {
+		return errors.Errorf("parse %s flag, want bool, got: %+v", command, vs[2])
+	}
+	ns := c.playingNetStream(messageStreamID)
+	if ns == nil {
+		log.Debugf("handle command %s, message stream %d is not playing", command, messageStreamID)
+		return nil
+	}
+	log.Infof("handle command %s, NetStream: %s, flag: %t", command, ns, flag)
+	var off int32
+	if !flag {
+		off = 1
+	}
+	if command == commandNetStreamReceiveAudio {
+		atomic.StoreInt32(&ns.audioOff, off)
+	} else {
+		atomic.StoreInt32(&ns.videoOff, off)
+	}
+	if !flag {
+		return nil
+	}
+	if msg, err := newNetStreamResponseSeekNotify(c.objectEncoding()); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID, ns.id, msg); err != nil {
+			return err
+		}
+	}
+	if msg, err := newNetStreamResponsePlayStart(c.objectEncoding()); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID, ns.id, msg); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -535,19 +1151,40 @@ func (c *Conn) handleCommandPlay(chunkStreamID, messageStreamID uint32, vs []int
 	if len(vs) < 3 {
 		return errors.Errorf("handle command play, len(vs) error, want: >=3, got: %d", len(vs))
 	}
-	transactionID, ok := vs[0].(float64)
-	if !ok || transactionID != 4 { //todo ??
-		return errors.Errorf("parse transaction id, want float64 4, got: %+v", vs[0])
-	}
-	//vs[1] is nil
+	//vs[0] transaction id, 0 is sent by most clients, vs[1] is nil
 	streamName, ok := vs[2].(string)
 	if !ok {
 		return errors.Errorf("parse stream name, want string, got: %+v", vs[2])
 	}
-	c.streamName = streamName
 	//vs[3]  start,number,optional
 	//vs[4]  duration,number,optional
-	//vs[5]  reset,number,optional
+	//vs[5]  reset,boolean,optional, a number is sent by some clients
+	start, duration, reset := parsePlayArguments(vs[3:])
+	if streamName == "" {
+		return c.rejectNetStream(chunkStreamID, messageStreamID, false, errors.Wrapf(core.ErrorStreamNotFound, "stream name is empty"))
+	}
+	//the current play is replaced, there is no playlist
+	if ns := c.playingNetStream(messageStreamID); ns != nil {
+		log.Infof("handle command play, replace the playing NetStream: %s", ns)
+		ns.reset()
+		if c.handler != nil {
+			c.handler.HandleClose(ns, nil)
+		}
+	}
+	ns, err := c.startNetStream(messageStreamID, streamName, false)
+	if err != nil {
+		return err
+	}
+	ns.playStart = start
+	ns.playDuration = duration
+	ns.playReset = reset
+	//the stream is found before the play start, so that a missing one is told by the error status only
+	if c.handler != nil {
+		if err := c.handler.HandlePlay(ns); err != nil {
+			ns.reset()
+			return c.rejectNetStream(chunkStreamID, messageStreamID, false, err)
+		}
+	}
 
 	if m, err := newPCMSetChunkSize(c.localMaximumChunkSize); err != nil {
 		return err
@@ -573,22 +1210,24 @@ func (c *Conn) handleCommandPlay(chunkStreamID, messageStreamID uint32, vs []int
 		}
 	}
 
-	if msg, err := newNetStreamResponsePlayReset(); err != nil {
-		return err
-	} else {
-		if m, err := newCommandMessage(chunkStreamID, messageStreamID, msg); err != nil {
+	if reset {
+		if msg, err := newNetStreamResponsePlayReset(c.objectEncoding()); err != nil {
 			return err
 		} else {
-			if err := c.writeMessage(m); err != nil {
+			if m, err := newCommandMessage(chunkStreamID, messageStreamID, c.objectEncoding(), msg); err != nil {
 				return err
+			} else {
+				if err := c.writeMessage(m); err != nil {
+					return err
+				}
 			}
 		}
 	}
 
-	if msg, err := newNetStreamResponsePlayStart(); err != nil {
+	if msg, err := newNetStreamResponsePlayStart(c.objectEncoding()); err != nil {
 		return err
 	} else {
-		if m, err := newCommandMessage(chunkStreamID, messageStreamID, msg); err != nil {
+		if m, err := newCommandMessage(chunkStreamID, messageStreamID, c.objectEncoding(), msg); err != nil {
 			return err
 		} else {
 			if err := c.writeMessage(m); err != nil {
@@ -597,9 +1236,137 @@ func (c *Conn) handleCommandPlay(chunkStreamID, messageStreamID uint32, vs []int
 		}
 	}
 
+	//the packets are written after the play start
+	if c.handler != nil {
+		c.handler.HandlePlayStart(ns)
+	}
+
+	return nil
+}
+
+//1. client -> server: command message(play2)
+//2. server -> client: command message(onStatus - play transition)
+//3. server -> client: data message(onPlayStatus - play transition complete), sent at the keyframe of the new stream
+//vs[0] transaction id, vs[1] is nil, vs[2] the parameters object: streamName, oldStreamName, start, len, offset, transition
+func (c *Conn) handleCommandPlay2(chunkStreamID, messageStreamID uint32, vs []interface{}) error {
+	if len(vs) < 3 {
+		return errors.Errorf("handle command play2, len(vs) error, want: >=3, got: %d", len(vs))
+	}
+	params, ok := vs[2].(amf.AmfObject)
+	if !ok {
+		return errors.Errorf("parse play2 parameters, want object, got: %+v", vs[2])
+	}
+	streamName, _ := params["streamName"].(string)
+	oldStreamName, _ := params["oldStreamName"].(string)
+	transition, _ := params["transition"].(string)
+	log.Infof("handle command play2, streamName: %s, oldStreamName: %s, transition: %s", streamName, oldStreamName, transition)
+
+	switch transition {
+	case transitionSwitch, transitionSwap:
+	case transitionReset:
+		return c.handleCommandPlay(chunkStreamID, messageStreamID, []interface{}{vs[0], nil, streamName, params["start"], params["len"], true})
+	default:
+		log.Warnf("handle command play2, transition %s is not supported, ignore", transition)
+		return nil
+	}
+	ns := c.playingNetStream(messageStreamID)
+	if ns == nil {
+		log.Warnf("handle command play2, message stream %d is not playing, ignore", messageStreamID)
+		return nil
+	}
+	if streamName == "" {
+		return c.rejectNetStream(chunkStreamID, messageStreamID, false, errors.Wrapf(core.ErrorStreamNotFound, "stream name is empty"))
+	}
+	if playing := ns.GetStreamName(); oldStreamName != playing {
+		log.Warnf("handle command play2, oldStreamName %s is not the playing %s", oldStreamName, playing)
+		oldStreamName = playing
+	}
+	ns.setStreamName(streamName)
+
+	if msg, err := newNetStreamResponsePlayTransition(streamName, c.objectEncoding()); err != nil {
+		return err
+	} else {
+		if err := c.writeCommandMessage(chunkStreamID, messageStreamID, msg); err != nil {
+			return err
+		}
+	}
+
+	if c.handler != nil {
+		if err := c.handler.HandleSwitch(ns, oldStreamName); err != nil {
+			ns.reset()
+			c.handler.HandleClose(ns, err)
+			return c.rejectNetStream(chunkStreamID, messageStreamID, false, err)
+		}
+	}
 	return nil
 }
 
+//parsePlayArguments parses the optional start, duration and reset of play, a missing or null one is the default,
+//a negative start other than PlayStartLive is PlayStartLiveOrRecorded, a negative duration is PlayDurationAll
+func parsePlayArguments(vs []interface{}) (float64, float64, bool) {
+	start, duration, reset := float64(PlayStartLiveOrRecorded), float64(PlayDurationAll), true
+	if len(vs) > 0 {
+		if v, ok := vs[0].(float64); ok && (v >= 0 || v == PlayStartLive) {
+			start = v
+		}
+	}
+	if len(vs) > 1 {
+		if v, ok := vs[1].(float64); ok && v >= 0 {
+			duration = v
+		}
+	}
+	if len(vs) > 2 {
+		switch v := vs[2].(type) {
+		case bool:
+			reset = v
+		case float64:
+			reset = v != 0
+		}
+	}
+	return start, duration, reset
+}
+
+//rejectConnect sends the _error of connect, err is returned so that the conn is closed
+func (c *Conn) rejectConnect(chunkStreamID, messageStreamID uint32, transactionID float64, err error) error {
+	log.Warnf("reject connect, err: %s", err)
+	if msg, e := newNetConnectionResponseConnectRejected(transactionID, err.Error(), c.objectEncoding()); e != nil {
+		return e
+	} else {
+		if e := c.writeCommandMessage(chunkStreamID, messageStreamID, msg); e != nil {
+			return e
+		}
+	}
+	c.rejected = true
+	return err
+}
+
+//rejectNetStream sends the error onStatus of a refused publish or play, err is returned so that the conn is closed.
+//A refused publish is a bad name, e.g. the stream is being published by another conn,
+//a refused play is not found if the cause of err is core.ErrorStreamNotFound
+func (c *Conn) rejectNetStream(chunkStreamID, messageStreamID uint32, isPublish bool, err error) error {
+	log.Warnf("reject message stream %d, isPublish: %t, err: %s", messageStreamID, isPublish, err)
+	var msg []byte
+	var e error
+	switch {
+	case isPublish && errors.Cause(err) == core.ErrorNoAccess:
+		msg, e = newNetStreamResponseRecordNoAccess(err.Error(), c.objectEncoding())
+	case isPublish:
+		msg, e = newNetStreamResponsePublishBadName(err.Error(), c.objectEncoding())
+	case errors.Cause(err) == core.ErrorStreamNotFound:
+		msg, e = newNetStreamResponsePlayStreamNotFound(err.Error(), c.objectEncoding())
+	default:
+		msg, e = newNetStreamResponsePlayFailed(err.Error(), c.objectEncoding())
+	}
+	if e != nil {
+		return e
+	}
+	if e := c.writeCommandMessage(chunkStreamID, messageStreamID, msg); e != nil {
+		return e
+	}
+	c.rejected = true
+	return err
+}
+
 func (c *Conn) NetConn() net.Conn {
 	return c.conn
 }
@@ -0,0 +1,588 @@
+package rtmp
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhyoulun/gls/src/amf"
+	"github.com/zhyoulun/gls/src/core"
+	"github.com/zhyoulun/gls/src/flv"
+	"github.com/zhyoulun/gls/src/utils/debug"
+	"net"
+	"testing"
+)
+
+//bufferConn reads from r and writes to w
+type bufferConn struct {
+	net.Conn
+	r *bytes.Buffer
+	w *bytes.Buffer
+}
+
+func newBufferConn(r, w *bytes.Buffer) *bufferConn {
+	return &bufferConn{r: r, w: w}
+}
+
+func (c *bufferConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *bufferConn) Peek(n int) ([]byte, error) {
+	return c.r.Bytes()[:n], nil
+}
+
+func (c *bufferConn) Close() error {
+	return nil
+}
+
+func (c *bufferConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *bufferConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func TestConn_handleMessage_commandAMF3(t *testing.T) {
+	_ = debug.Init()
+	a, _ := amf.NewAmf()
+	out := &bytes.Buffer{}
+	c, _ := NewConn(newBufferConn(&bytes.Buffer{}, out))
+
+	//connect, sent by a client which negotiates amf3
+	data := &bytes.Buffer{}
+	data.WriteByte(0x00)
+	_, _ = a.EncodeBatch(data, amf.AmfArray{commandNetConnectionConnect, transactionID1}, amf.Amf0)
+	_, _ = a.EncodeAvmplus(data, amf.AmfObject{"app": "live", "tcUrl": "rtmp://127.0.0.1/live", "objectEncoding": 3})
+	assert.NoError(t, c.handleMessage(chunkStreamID3, messageStreamID0, typeCommandAMF3, data.Bytes(), 0))
+	assert.Equal(t, "live", c.connInfo.App)
+	assert.Equal(t, "rtmp://127.0.0.1/live", c.connInfo.TcUrl)
+	assert.Equal(t, amf.Amf3, c.objectEncoding())
+
+	//the response is an amf3 command too
+	peer, _ := NewConn(newBufferConn(out, &bytes.Buffer{}))
+	for {
+		m, err := peer.readMessage()
+		if !assert.NoError(t, err) {
+			return
+		}
+		if isProtocolControlMessage(m.getMessageTypeID()) {
+			assert.NoError(t, peer.handleMessage(m.getChunkStreamID(), m.GetMessageStreamID(), m.getMessageTypeID(), m.GetData(), m.GetTimestamp()))
+		}
+		if m.getMessageTypeID() == typeCommandAMF0 || m.getMessageTypeID() == typeCommandAMF3 {
+			assert.Equal(t, uint8(typeCommandAMF3), m.getMessageTypeID())
+			command, vs, err := decodeCommandMessage(m.getMessageTypeID(), m.GetData())
+			assert.NoError(t, err)
+			assert.Equal(t, commandNetConnectionResult, command)
+			assert.Equal(t, float64(transactionID1), vs[0])
+			info, ok := vs[2].(amf.AmfObject)
+			assert.True(t, ok)
+			assert.Equal(t, "NetConnection.Connect.Success", info["code"])
+			assert.Equal(t, float64(amf.Amf3), info["objectEncoding"])
+			break
+		}
+	}
+}
+
+func Test_decodeCommandMessage(t *testing.T) {
+	{
+		data, _ := newNetConnectionCommandCreateStream(2)
+		command, vs, err := decodeCommandMessage(typeCommandAMF0, data)
+		assert.NoError(t, err)
+		assert.Equal(t, commandNetConnectionCreateStream, command)
+		assert.Equal(t, []interface{}{float64(2), nil}, vs)
+	}
+	{
+		data, _ := newNetStreamResponsePlayStart(amf.Amf3)
+		assert.Equal(t, byte(0x00), data[0])
+		command, vs, err := decodeCommandMessage(typeCommandAMF3, data)
+		assert.NoError(t, err)
+		assert.Equal(t, commandNetStreamOnStatus, command)
+		assert.Equal(t, "NetStream.Play.Start", vs[2].(amf.AmfObject)["code"])
+	}
+	{
+		_, _, err := decodeCommandMessage(typeCommandAMF0, []byte{})
+		assert.Error(t, err)
+	}
+}
+
+func TestConn_ReadPacket_aggregate(t *testing.T) {
+	_ = debug.Init()
+	buf := &bytes.Buffer{}
+	writer, _ := NewConn(newBufferConn(&bytes.Buffer{}, buf))
+	body := &bytes.Buffer{}
+	writeAggregateTag(body, typeVideo, 500, []byte{0x17, 0x01, 0, 0, 0})
+	writeAggregateTag(body, typeAudio, 520, []byte{0xaf, 0x01, 0x21})
+	assert.NoError(t, writer.writeMessage(newAggregateMessage(40, body.Bytes())))
+
+	c, _ := NewConn(newBufferConn(buf, &bytes.Buffer{}))
+	c.remoteMaximumChunkSize = writer.localMaximumChunkSize
+	{
+		p, err := c.ReadPacket()
+		assert.NoError(t, err)
+		assert.True(t, p.IsVideo())
+		assert.Equal(t, uint32(40), p.GetTimestamp())
+		assert.Equal(t, uint32(1), p.GetStreamID())
+	}
+	{
+		p, err := c.ReadPacket()
+		assert.NoError(t, err)
+		assert.True(t, p.IsAudio())
+		assert.Equal(t, uint32(60), p.GetTimestamp())
+	}
+	{
+		_, err := c.ReadPacket()
+		assert.Error(t, err)
+	}
+}
+
+func TestConn_handleMessage_abort(t *testing.T) {
+	_ = debug.Init()
+	buf := &bytes.Buffer{}
+	//first chunk of a 200 bytes audio message in chunk stream 6
+	buf.Write([]byte{0x06, 0, 0, 0, 0, 0, 200, typeAudio, 1, 0, 0, 0})
+	buf.Write(bytes.Repeat([]byte{0xff}, 128))
+	//abort chunk stream 6
+	writer, _ := NewConn(newBufferConn(&bytes.Buffer{}, buf))
+	m, _ := newBaseProtocolControlMessage(4, typeAbort)
+	_ = m.cs.writeToData([]byte{0, 0, 0, 6})
+	assert.NoError(t, writer.writeMessage(m))
+	//a new message with type 3 chunks, the header is the same as the aborted one
+	data := append([]byte{0xaf, 0x01}, bytes.Repeat([]byte{0x01}, 198)...)
+	buf.WriteByte(0xc6)
+	buf.Write(data[:128])
+	buf.WriteByte(0xc6)
+	buf.Write(data[128:])
+
+	c, _ := NewConn(newBufferConn(buf, &bytes.Buffer{}))
+	p, err := c.ReadPacket()
+	assert.NoError(t, err)
+	if assert.NotNil(t, p) {
+		assert.True(t, p.IsAudio())
+		assert.Equal(t, data, p.GetData())
+	}
+}
+
+func TestConn_UnpublishNotify(t *testing.T) {
+	out := &bytes.Buffer{}
+	c, _ := NewConn(newBufferConn(&bytes.Buffer{}, out))
+	ns := newNetStream(c, 1)
+	assert.NoError(t, ns.UnpublishNotify())
+	assert.NoError(t, ns.PublishNotify())
+
+	peer, _ := NewConn(newBufferConn(out, &bytes.Buffer{}))
+	peer.isClient = true
+	eventType, data := readUserControlMessage(t, peer)
+	assert.Equal(t, uint16(EventStreamEOF), eventType)
+	assert.Equal(t, []byte{0, 0, 0, 1}, data)
+	for _, code := range []string{"NetStream.Play.UnpublishNotify", "NetStream.Play.PublishNotify"} {
+		command, vs, err := peer.readCommand()
+		assert.NoError(t, err)
+		assert.Equal(t, commandNetStreamOnStatus, command)
+		assert.Equal(t, code, vs[2].(amf.AmfObject)["code"])
+	}
+}
+
+//encoderStep is a command sent by the encoder and the replies it expects,
+//a reply is the command name, or the code of onStatus
+type encoderStep struct {
+	chunkStreamID   uint32
+	messageStreamID uint32
+	data            []byte
+	replies         []string
+	err             error
+}
+
+//runEncoderSteps feeds the steps to a server conn, one by one,
+//and checks the commands written back after each of them
+func runEncoderSteps(t *testing.T, steps []encoderStep) *Conn {
+	out := &bytes.Buffer{}
+	c, _ := NewConn(newBufferConn(&bytes.Buffer{}, out))
+	peer, _ := NewConn(newBufferConn(out, &bytes.Buffer{}))
+	peer.isClient = true
+	for i, step := range steps {
+		err := c.handleMessage(step.chunkStreamID, step.messageStreamID, typeCommandAMF0, step.data, 0)
+		if step.err != nil {
+			assert.Equal(t, step.err, errors.Cause(err), "step %d", i)
+		} else {
+			assert.NoError(t, err, "step %d", i)
+		}
+		var replies []string
+		for out.Len() > 0 {
+			m, err := peer.readMessage()
+			if !assert.NoError(t, err) {
+				return c
+			}
+			if isProtocolControlMessage(m.getMessageTypeID()) {
+				assert.NoError(t, peer.handleMessage(m.getChunkStreamID(), m.GetMessageStreamID(), m.getMessageTypeID(), m.GetData(), m.GetTimestamp()))
+			}
+			if m.getMessageTypeID() != typeCommandAMF0 {
+				continue
+			}
+			command, vs, err := decodeCommandMessage(m.getMessageTypeID(), m.GetData())
+			assert.NoError(t, err)
+			if command == commandNetStreamOnStatus {
+				command = vs[2].(amf.AmfObject)["code"].(string)
+			}
+			replies = append(replies, command)
+		}
+		assert.Equal(t, step.replies, replies, "step %d", i)
+	}
+	return c
+}
+
+func newEncoderConnect(tcUrl string) []byte {
+	data, _ := newNetConnectionCommandConnect(transactionID1, ConnectCommentObject{
+		App:      "live",
+		Type:     defaultConnectType,
+		Flashver: defaultFlashVer,
+		TcUrl:    tcUrl,
+	})
+	return data
+}
+
+//obs: releaseStream, FCPublish and createStream are sent at once, publish follows the _result of createStream,
+//FCUnpublish and deleteStream when the streaming stops
+func TestConn_handleMessage_obs(t *testing.T) {
+	releaseStream, _ := newNetConnectionCommandReleaseStream(2, "obs")
+	fcPublish, _ := newNetConnectionCommandFCPublish(3, "obs")
+	createStream, _ := newNetConnectionCommandCreateStream(4)
+	publish, _ := newNetStreamCommandPublish(5, "obs", PublishingTypeLive)
+	fcUnpublish, _ := newNetConnectionCommandFCUnpublish(6, "obs")
+	deleteStream, _ := newNetStreamCommandDeleteStream(7, 1)
+	c := runEncoderSteps(t, []encoderStep{
+		{chunkStreamID3, messageStreamID0, newEncoderConnect("rtmp://127.0.0.1/live"), []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, releaseStream, []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, fcPublish, []string{commandOnFCPublish, commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, createStream, []string{commandNetConnectionResult}, nil},
+		{chunkStreamID8, 1, publish, []string{"NetStream.Publish.Start"}, nil},
+		{chunkStreamID3, messageStreamID0, fcUnpublish, []string{commandOnFCUnpublish, commandNetConnectionResult, "NetStream.Unpublish.Success"}, core.ErrorStreamClosed},
+		{chunkStreamID3, messageStreamID0, deleteStream, nil, nil},
+	})
+	_, ok := c.netStreams[1]
+	assert.False(t, ok)
+}
+
+//vmix: the stream key is sent as the query of the stream name
+func TestConn_handleMessage_vmix(t *testing.T) {
+	releaseStream, _ := newNetConnectionCommandReleaseStream(2, "vmix?key=123")
+	fcPublish, _ := newNetConnectionCommandFCPublish(3, "vmix?key=123")
+	createStream, _ := newNetConnectionCommandCreateStream(4)
+	publish, _ := newNetStreamCommandPublish(5, "vmix?key=123", PublishingTypeLive)
+	c := runEncoderSteps(t, []encoderStep{
+		{chunkStreamID3, messageStreamID0, newEncoderConnect("rtmp://127.0.0.1/live"), []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, releaseStream, []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, fcPublish, []string{commandOnFCPublish, commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, createStream, []string{commandNetConnectionResult}, nil},
+		{chunkStreamID8, 1, publish, []string{"NetStream.Publish.Start"}, nil},
+	})
+	assert.True(t, c.netStreams[1].IsPublish())
+	assert.Equal(t, "vmix?key=123", c.netStreams[1].GetStreamName())
+}
+
+//wirecast: createStream is not sent until onFCPublish arrives
+func TestConn_handleMessage_wirecast(t *testing.T) {
+	releaseStream, _ := newNetConnectionCommandReleaseStream(2, "wirecast")
+	fcPublish, _ := newNetConnectionCommandFCPublish(3, "wirecast")
+	createStream, _ := newNetConnectionCommandCreateStream(4)
+	publish, _ := newNetStreamCommandPublish(5, "wirecast", PublishingTypeLive)
+	c := runEncoderSteps(t, []encoderStep{
+		{chunkStreamID3, messageStreamID0, newEncoderConnect("rtmp://127.0.0.1/live"), []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, releaseStream, []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, fcPublish, []string{commandOnFCPublish, commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, createStream, []string{commandNetConnectionResult}, nil},
+		{chunkStreamID8, 1, publish, []string{"NetStream.Publish.Start"}, nil},
+	})
+	assert.True(t, c.netStreams[1].IsPublish())
+	assert.Equal(t, "wirecast", c.netStreams[1].GetStreamName())
+}
+
+//larix: the NetStream commands are sent on chunk stream 4
+func TestConn_handleMessage_larix(t *testing.T) {
+	releaseStream, _ := newNetConnectionCommandReleaseStream(2, "larix")
+	fcPublish, _ := newNetConnectionCommandFCPublish(3, "larix")
+	createStream, _ := newNetConnectionCommandCreateStream(4)
+	publish, _ := newNetStreamCommandPublish(5, "larix", PublishingTypeLive)
+	c := runEncoderSteps(t, []encoderStep{
+		{chunkStreamID3, messageStreamID0, newEncoderConnect("rtmp://127.0.0.1:1935/live"), []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, releaseStream, []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, fcPublish, []string{commandOnFCPublish, commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, createStream, []string{commandNetConnectionResult}, nil},
+		{4, 1, publish, []string{"NetStream.Publish.Start"}, nil},
+	})
+	assert.True(t, c.netStreams[1].IsPublish())
+	assert.Equal(t, "larix", c.netStreams[1].GetStreamName())
+}
+
+//record and append are recorded, an unknown publishing type is published as live
+func TestConn_handleMessage_publishingType(t *testing.T) {
+	tests := []struct {
+		publishingType string
+		publishStart   []string
+		unpublish      []string
+	}{
+		{PublishingTypeLive, []string{"NetStream.Publish.Start"}, []string{commandOnFCUnpublish, commandNetConnectionResult, "NetStream.Unpublish.Success"}},
+		{PublishingTypeRecord, []string{"NetStream.Publish.Start", "NetStream.Record.Start"}, []string{commandOnFCUnpublish, commandNetConnectionResult, "NetStream.Record.Stop", "NetStream.Unpublish.Success"}},
+		{PublishingTypeAppend, []string{"NetStream.Publish.Start", "NetStream.Record.Start"}, []string{commandOnFCUnpublish, commandNetConnectionResult, "NetStream.Record.Stop", "NetStream.Unpublish.Success"}},
+		{"appendWithGap", []string{"NetStream.Publish.Start"}, []string{commandOnFCUnpublish, commandNetConnectionResult, "NetStream.Unpublish.Success"}},
+	}
+	for _, tt := range tests {
+		createStream, _ := newNetConnectionCommandCreateStream(2)
+		publish, _ := newNetStreamCommandPublish(3, "encoder", tt.publishingType)
+		fcUnpublish, _ := newNetConnectionCommandFCUnpublish(4, "encoder")
+		t.Run(tt.publishingType, func(t *testing.T) {
+			c := runEncoderSteps(t, []encoderStep{
+				{chunkStreamID3, messageStreamID0, newEncoderConnect("rtmp://127.0.0.1/live"), []string{commandNetConnectionResult}, nil},
+				{chunkStreamID3, messageStreamID0, createStream, []string{commandNetConnectionResult}, nil},
+				{chunkStreamID8, 1, publish, tt.publishStart, nil},
+				{chunkStreamID3, messageStreamID0, fcUnpublish, tt.unpublish, core.ErrorStreamClosed},
+			})
+			assert.Equal(t, PublishingTypeLive, c.netStreams[1].PublishingType())
+		})
+	}
+}
+
+//players behind a cdn edge subscribe the stream before play
+func TestConn_handleMessage_fcSubscribe(t *testing.T) {
+	createStream, _ := newNetConnectionCommandCreateStream(2)
+	fcSubscribe, _ := newNetConnectionCommandFCSubscribe(3, "player")
+	play, _ := newNetStreamCommandPlay(4, "player", PlayStartLiveOrRecorded, PlayDurationAll)
+	c := runEncoderSteps(t, []encoderStep{
+		{chunkStreamID3, messageStreamID0, newEncoderConnect("rtmp://127.0.0.1/live"), []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, createStream, []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, fcSubscribe, []string{commandOnFCSubscribe, commandNetConnectionResult}, nil},
+		{chunkStreamID8, 1, play, []string{"NetStream.Play.Reset", "NetStream.Play.Start"}, nil},
+	})
+	assert.False(t, c.netStreams[1].IsPublish())
+	assert.Equal(t, "player", c.netStreams[1].GetStreamName())
+}
+
+func TestConn_handleMessage_pause(t *testing.T) {
+	createStream, _ := newNetConnectionCommandCreateStream(2)
+	play, _ := newNetStreamCommandPlay(4, "pause", PlayStartLiveOrRecorded, PlayDurationAll)
+	pause, _ := newNetStreamCommandPause(0, true, 1000)
+	unpause, _ := newNetStreamCommandPause(0, false, 1000)
+	steps := []encoderStep{
+		{chunkStreamID3, messageStreamID0, newEncoderConnect("rtmp://127.0.0.1/live"), []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, createStream, []string{commandNetConnectionResult}, nil},
+		{chunkStreamID8, 1, play, []string{"NetStream.Play.Reset", "NetStream.Play.Start"}, nil},
+		{chunkStreamID8, 1, pause, []string{"NetStream.Pause.Notify"}, nil},
+	}
+	c := runEncoderSteps(t, steps)
+	assert.True(t, c.netStreams[1].IsPaused())
+
+	c = runEncoderSteps(t, append(steps, encoderStep{chunkStreamID8, 1, unpause, []string{"NetStream.Unpause.Notify"}, nil}))
+	assert.False(t, c.netStreams[1].IsPaused())
+}
+
+func TestConn_handleMessage_receive(t *testing.T) {
+	createStream, _ := newNetConnectionCommandCreateStream(2)
+	play, _ := newNetStreamCommandPlay(4, "receive", PlayStartLiveOrRecorded, PlayDurationAll)
+	audioOff, _ := newNetStreamCommandReceive(commandNetStreamReceiveAudio, 0, false)
+	videoOff, _ := newNetStreamCommandReceive(commandNetStreamReceiveVideo, 0, false)
+	videoOn, _ := newNetStreamCommandReceive(commandNetStreamReceiveVideo, 0, true)
+	c := runEncoderSteps(t, []encoderStep{
+		{chunkStreamID3, messageStreamID0, newEncoderConnect("rtmp://127.0.0.1/live"), []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, createStream, []string{commandNetConnectionResult}, nil},
+		{chunkStreamID8, 1, play, []string{"NetStream.Play.Reset", "NetStream.Play.Start"}, nil},
+		{chunkStreamID8, 1, audioOff, nil, nil},
+		{chunkStreamID8, 1, videoOff, nil, nil},
+		{chunkStreamID8, 1, videoOn, []string{"NetStream.Seek.Notify", "NetStream.Play.Start"}, nil},
+	})
+	assert.False(t, c.netStreams[1].IsReceiveAudio())
+	assert.True(t, c.netStreams[1].IsReceiveVideo())
+}
+
+func TestConn_handleMessage_createStream(t *testing.T) {
+	out := &bytes.Buffer{}
+	c, _ := NewConn(newBufferConn(&bytes.Buffer{}, out))
+	peer, _ := NewConn(newBufferConn(out, &bytes.Buffer{}))
+	peer.isClient = true
+
+	//any transaction id is echoed, the message stream ids are allocated one by one
+	a, _ := amf.NewAmf()
+	connect := bytes.NewBuffer(newEncoderConnect("rtmp://127.0.0.1/live"))
+	_, _ = a.Encode(connect, "user argument", amf.Amf0)
+	assert.NoError(t, c.handleMessage(chunkStreamID3, messageStreamID0, typeCommandAMF0, connect.Bytes(), 0))
+	_, err := peer.readResult(transactionID1)
+	assert.NoError(t, err)
+	for i, transactionID := range []float64{7, 3} {
+		data, _ := newNetConnectionCommandCreateStream(transactionID)
+		assert.NoError(t, c.handleMessage(chunkStreamID3, messageStreamID0, typeCommandAMF0, data, 0))
+		vs, err := peer.readResult(transactionID)
+		assert.NoError(t, err)
+		assert.Equal(t, []interface{}{nil, float64(i + 1)}, vs)
+	}
+
+	//publish on the second one, the transaction id is 0
+	data, _ := newNetStreamCommandPublish(transactionID0, "createStream", PublishingTypeLive)
+	assert.NoError(t, c.handleMessage(chunkStreamID8, 2, typeCommandAMF0, data, 0))
+	assert.True(t, c.netStreams[2].IsPublish())
+	assert.NoError(t, peer.readStatus("NetStream.Publish.Start"))
+}
+
+//the refused connect, publish and play are told with the error status before the conn is closed
+func TestConn_handleMessage_reject(t *testing.T) {
+	noApp, _ := newNetConnectionCommandConnect(transactionID1, ConnectCommentObject{Type: defaultConnectType})
+	runEncoderSteps(t, []encoderStep{
+		{chunkStreamID3, messageStreamID0, noApp, []string{commandNetConnectionError}, core.ErrorRejected},
+	})
+
+	createStream, _ := newNetConnectionCommandCreateStream(2)
+	publish, _ := newNetStreamCommandPublish(transactionID0, "", PublishingTypeLive)
+	runEncoderSteps(t, []encoderStep{
+		{chunkStreamID3, messageStreamID0, newEncoderConnect("rtmp://127.0.0.1/live"), []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, createStream, []string{commandNetConnectionResult}, nil},
+		{chunkStreamID8, 1, publish, []string{"NetStream.Publish.BadName"}, core.ErrorRejected},
+	})
+
+	play, _ := newNetStreamCommandPlay(4, "", PlayStartLiveOrRecorded, PlayDurationAll)
+	c := runEncoderSteps(t, []encoderStep{
+		{chunkStreamID3, messageStreamID0, newEncoderConnect("rtmp://127.0.0.1/live"), []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, createStream, []string{commandNetConnectionResult}, nil},
+		{chunkStreamID8, 1, play, []string{"NetStream.Play.StreamNotFound"}, core.ErrorStreamNotFound},
+	})
+	assert.False(t, c.netStreams[1].started)
+}
+
+func TestConn_handleMessage_call(t *testing.T) {
+	out := &bytes.Buffer{}
+	c, _ := NewConn(newBufferConn(&bytes.Buffer{}, out))
+	peer, _ := NewConn(newBufferConn(out, &bytes.Buffer{}))
+	peer.isClient = true
+	c.RegisterCall("echo", func(conn *Conn, args []interface{}) ([]interface{}, error) {
+		return args, nil
+	})
+	c.RegisterCall("fail", func(conn *Conn, args []interface{}) ([]interface{}, error) {
+		return nil, errors.Errorf("no settings")
+	})
+	assert.NoError(t, c.handleMessage(chunkStreamID3, messageStreamID0, typeCommandAMF0, newEncoderConnect("rtmp://127.0.0.1/live"), 0))
+	_, err := peer.readResult(transactionID1)
+	assert.NoError(t, err)
+
+	//the results follow the nil command object
+	data, _ := newNetConnectionCommandCall("echo", 2, []interface{}{"bitrate", float64(2500)})
+	assert.NoError(t, c.handleMessage(chunkStreamID3, messageStreamID0, typeCommandAMF0, data, 0))
+	vs, err := peer.readResult(2)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{nil, "bitrate", float64(2500)}, vs)
+
+	//the failed and the unknown methods get _error, the conn is kept
+	data, _ = newNetConnectionCommandCall("fail", 3, nil)
+	assert.NoError(t, c.handleMessage(chunkStreamID3, messageStreamID0, typeCommandAMF0, data, 0))
+	_, err = peer.readResult(3)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no settings")
+	}
+	data, _ = newNetConnectionCommandCall("unknown", 4, nil)
+	assert.NoError(t, c.handleMessage(chunkStreamID3, messageStreamID0, typeCommandAMF0, data, 0))
+	_, err = peer.readResult(4)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "NetConnection.Call.Failed")
+	}
+
+	//nothing is sent back for transaction id 0
+	data, _ = newNetConnectionCommandCall("echo", transactionID0, []interface{}{"telemetry"})
+	assert.NoError(t, c.handleMessage(chunkStreamID3, messageStreamID0, typeCommandAMF0, data, 0))
+	assert.Equal(t, 0, out.Len())
+}
+
+func TestConn_handleMessage_connectFourCcList(t *testing.T) {
+	data, _ := newNetConnectionCommandConnect(transactionID1, ConnectCommentObject{App: "live", FourCcList: flv.FourCCList})
+	out := &bytes.Buffer{}
+	c, _ := NewConn(newBufferConn(&bytes.Buffer{}, out))
+	peer, _ := NewConn(newBufferConn(out, &bytes.Buffer{}))
+	peer.isClient = true
+	assert.NoError(t, c.handleMessage(chunkStreamID3, messageStreamID0, typeCommandAMF0, data, 0))
+	assert.Equal(t, flv.FourCCList, c.GetConnInfo().FourCcList)
+
+	//the server advertises the codecs it forwards
+	vs, err := peer.readResult(transactionID1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, amf.AmfArray{flv.FourCCAV1, flv.FourCCVP9, flv.FourCCHEVC}, vs[0].(amf.AmfObject)["fourCcList"])
+	}
+}
+
+func Test_parsePlayArguments(t *testing.T) {
+	tests := []struct {
+		vs       []interface{}
+		start    float64
+		duration float64
+		reset    bool
+	}{
+		{nil, PlayStartLiveOrRecorded, PlayDurationAll, true},
+		{[]interface{}{nil, nil, nil}, PlayStartLiveOrRecorded, PlayDurationAll, true},
+		{[]interface{}{float64(PlayStartLive)}, PlayStartLive, PlayDurationAll, true},
+		{[]interface{}{float64(-3), float64(-2)}, PlayStartLiveOrRecorded, PlayDurationAll, true},
+		{[]interface{}{float64(10), float64(0), false}, 10, 0, false},
+		{[]interface{}{float64(1.5), float64(30), float64(0)}, 1.5, 30, false},
+	}
+	for i, tt := range tests {
+		start, duration, reset := parsePlayArguments(tt.vs)
+		assert.Equal(t, tt.start, start, "arguments %d", i)
+		assert.Equal(t, tt.duration, duration, "arguments %d", i)
+		assert.Equal(t, tt.reset, reset, "arguments %d", i)
+	}
+}
+
+//reset false skips NetStream.Play.Reset, a play replaces the current one
+func TestConn_handleMessage_playArguments(t *testing.T) {
+	createStream, _ := newNetConnectionCommandCreateStream(2)
+	play, _ := newNetStreamCommandPlay(4, "live", PlayStartLive, 30)
+	playNoReset, _ := newNetConnectionResponseBase(amf.AmfArray{commandNetStreamPlay, float64(5), nil, "vod", float64(10), float64(5), false}, amf.Amf0)
+	c := runEncoderSteps(t, []encoderStep{
+		{chunkStreamID3, messageStreamID0, newEncoderConnect("rtmp://127.0.0.1/live"), []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, createStream, []string{commandNetConnectionResult}, nil},
+		{chunkStreamID8, 1, play, []string{"NetStream.Play.Reset", "NetStream.Play.Start"}, nil},
+		{chunkStreamID8, 1, playNoReset, []string{"NetStream.Play.Start"}, nil},
+	})
+	ns := c.netStreams[1]
+	assert.Equal(t, "vod", ns.GetStreamName())
+	assert.Equal(t, float64(10), ns.PlayStart())
+	assert.Equal(t, float64(5), ns.PlayDuration())
+	assert.False(t, ns.IsPlayReset())
+}
+
+func TestConn_handleMessage_play2(t *testing.T) {
+	createStream, _ := newNetConnectionCommandCreateStream(2)
+	play, _ := newNetStreamCommandPlay(4, "low", PlayStartLiveOrRecorded, PlayDurationAll)
+	play2, _ := newNetStreamCommandPlay2(0, "high", "low")
+	play2Reset, _ := newNetConnectionResponseBase(amf.AmfArray{commandNetStreamPlay2, float64(0), nil, amf.AmfObject{"streamName": "vod", "transition": transitionReset, "start": float64(10)}}, amf.Amf0)
+	c := runEncoderSteps(t, []encoderStep{
+		{chunkStreamID3, messageStreamID0, newEncoderConnect("rtmp://127.0.0.1/live"), []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, createStream, []string{commandNetConnectionResult}, nil},
+		{chunkStreamID8, 1, play2, nil, nil}, //not playing, ignored
+		{chunkStreamID8, 1, play, []string{"NetStream.Play.Reset", "NetStream.Play.Start"}, nil},
+		{chunkStreamID8, 1, play2, []string{"NetStream.Play.Transition"}, nil},
+	})
+	assert.Equal(t, "high", c.netStreams[1].GetStreamName())
+
+	c = runEncoderSteps(t, []encoderStep{
+		{chunkStreamID3, messageStreamID0, newEncoderConnect("rtmp://127.0.0.1/live"), []string{commandNetConnectionResult}, nil},
+		{chunkStreamID3, messageStreamID0, createStream, []string{commandNetConnectionResult}, nil},
+		{chunkStreamID8, 1, play, []string{"NetStream.Play.Reset", "NetStream.Play.Start"}, nil},
+		{chunkStreamID8, 1, play2Reset, []string{"NetStream.Play.Reset", "NetStream.Play.Start"}, nil},
+	})
+	assert.Equal(t, "vod", c.netStreams[1].GetStreamName())
+	assert.Equal(t, float64(10), c.netStreams[1].PlayStart())
+}
+
+func Test_newNetStreamResponsePlayTransition(t *testing.T) {
+	data, err := newNetStreamResponsePlayTransition("high", amf.Amf0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	command, vs, err := decodeCommandMessage(typeCommandAMF0, data)
+	assert.NoError(t, err)
+	assert.Equal(t, commandNetStreamOnStatus, command)
+	assert.Equal(t, amf.AmfObject{
+		"level":       netStreamStatusLevelStatus,
+		"code":        "NetStream.Play.Transition",
+		"description": "Transition to high.",
+		"details":     "high",
+	}, vs[2])
+}
@@ -1,9 +1,43 @@
 package rtmp
 
+import "time"
+
 const (
 	rtmpVersion = 3
 )
 
+const (
+	handshakeSize          = 1536
+	handshakeSchema0       = 0
+	handshakeSchema1       = 1
+	handshakeServerVersion = 0x04050001 //version of FMS 4.5.0.1, put in S1 for the complex handshake
+)
+
+//"Genuine Adobe Flash Media Server 001" + 32 random bytes, the first 36 bytes are used for S1
+var genuineFMSKey = []byte{
+	0x47, 0x65, 0x6e, 0x75, 0x69, 0x6e, 0x65, 0x20,
+	0x41, 0x64, 0x6f, 0x62, 0x65, 0x20, 0x46, 0x6c,
+	0x61, 0x73, 0x68, 0x20, 0x4d, 0x65, 0x64, 0x69,
+	0x61, 0x20, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72,
+	0x20, 0x30, 0x30, 0x31,
+	0xf0, 0xee, 0xc2, 0x4a, 0x80, 0x68, 0xbe, 0xe8,
+	0x2e, 0x00, 0xd0, 0xd1, 0x02, 0x9e, 0x7e, 0x57,
+	0x6e, 0xec, 0x5d, 0x2d, 0x29, 0x80, 0x6f, 0xab,
+	0x93, 0xb8, 0xe6, 0x36, 0xcf, 0xeb, 0x31, 0xae,
+}
+
+//"Genuine Adobe Flash Player 001" + 32 random bytes, the first 30 bytes are used for C1
+var genuineFPKey = []byte{
+	0x47, 0x65, 0x6e, 0x75, 0x69, 0x6e, 0x65, 0x20,
+	0x41, 0x64, 0x6f, 0x62, 0x65, 0x20, 0x46, 0x6c,
+	0x61, 0x73, 0x68, 0x20, 0x50, 0x6c, 0x61, 0x79,
+	0x65, 0x72, 0x20, 0x30, 0x30, 0x31,
+	0xf0, 0xee, 0xc2, 0x4a, 0x80, 0x68, 0xbe, 0xe8,
+	0x2e, 0x00, 0xd0, 0xd1, 0x02, 0x9e, 0x7e, 0x57,
+	0x6e, 0xec, 0x5d, 0x2d, 0x29, 0x80, 0x6f, 0xab,
+	0x93, 0xb8, 0xe6, 0x36, 0xcf, 0xeb, 0x31, 0xae,
+}
+
 type Fmt byte
 
 const (
@@ -30,6 +64,9 @@ const (
 
 const (
 	chunkStreamID2 = 2
+	chunkStreamID3 = 3 //used by the client for NetConnection commands
+	chunkStreamID5 = 5 //used by the server for NetStream status which does not respond to a command
+	chunkStreamID8 = 8 //used by the client for NetStream commands
 )
 
 //message type id
@@ -63,11 +100,31 @@ const (
 	typeAggregate = 22
 )
 
+//the body of an aggregate message is flv tags, each one followed by a back pointer
+const (
+	aggregateTagHeaderSize   = 11 //type(1) data size(3) timestamp(3) timestamp extended(1) stream id(3)
+	aggregateBackPointerSize = 4
+)
+
 const (
 	transactionID0 = 0
 	transactionID1 = 1
 )
 
+const (
+	defaultPort         = "1935"
+	defaultTLSPort      = "443"
+	defaultFlashVer     = "FMLE/3.0 (compatible; gls)"
+	defaultConnectType  = "nonprivate"
+	defaultBufferLength = 3000 //ms
+)
+
+//rejectDrainTimeout is how long the rejected peer is given to read the error and close the conn
+const rejectDrainTimeout = time.Second
+
+//writeAckTimeout is how long WritePacket waits for the acknowledgement of a peer whose window is used up
+const writeAckTimeout = 5 * time.Second
+
 //user control message events
 const (
 	EventStreamBegin      = 0
@@ -86,6 +143,27 @@ const (
 	commandNetConnectionCall         = "call"
 	commandNetConnectionCreateStream = "createStream"
 
+	//NetConnection server->client
+	commandNetConnectionResult = "_result"
+	commandNetConnectionError  = "_error"
+
+	//not part of the specification, but sent by most encoders(ffmpeg, obs) before publish
+	commandReleaseStream = "releaseStream"
+	commandFCPublish     = "FCPublish"
+	commandFCUnpublish   = "FCUnpublish"
+
+	//not part of the specification, the server replies to FCPublish and FCUnpublish with these before the _result,
+	//some encoders(wirecast) wait for onFCPublish before publish
+	commandOnFCPublish   = "onFCPublish"
+	commandOnFCUnpublish = "onFCUnpublish"
+
+	//not part of the specification, but sent by some players(flash, cdn edges) before play
+	commandFCSubscribe   = "FCSubscribe"
+	commandOnFCSubscribe = "onFCSubscribe"
+
+	//not part of the specification, but sent by ffmpeg before play
+	commandGetStreamLength = "getStreamLength"
+
 	//NetStream client->server
 	commandNetStreamPlay         = "play"
 	commandNetStreamPlay2        = "play2"
@@ -98,7 +176,32 @@ const (
 	commandNetStreamPause        = "pause"
 
 	//NetStream server->client
-	commandNetStreamOnStatus = "onStatus"
+	commandNetStreamOnStatus     = "onStatus"
+	commandNetStreamOnPlayStatus = "onPlayStatus" //sent as a data message
+)
+
+//the start of play in seconds, a start not less than 0 plays the recorded stream from the offset
+const (
+	PlayStartLiveOrRecorded = -2 //the live stream, or the recorded stream if the live one is not found, the default
+	PlayStartLive           = -1 //the live stream only
+)
+
+//PlayDurationAll plays until the live or recorded stream ends, the default,
+//a duration not less than 0 stops playing after the seconds
+const PlayDurationAll = -1
+
+//transition of play2
+const (
+	transitionSwitch = "switch" //switch to the stream at the next keyframe, e.g. another bitrate of dynamic streaming
+	transitionSwap   = "swap"   //the same as switch, gls keeps no playlist
+	transitionReset  = "reset"  //the same as play with reset
+)
+
+//type of publishing
+const (
+	PublishingTypeLive   = "live"   //the live stream only, the default
+	PublishingTypeRecord = "record" //the live stream is also recorded to a new file
+	PublishingTypeAppend = "append" //the live stream is also appended to the recorded file, which is created if not found
 )
 
 const (
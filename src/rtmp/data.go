@@ -11,5 +11,6 @@ type ConnectCommentObject struct {
 	VideoFunction  int
 	PageUrl        string
 	ObjectEncoding float64
-	Type           string //todo 协议上没有，livego和ffmpeg有
+	Type           string   //todo 协议上没有，livego和ffmpeg有
+	FourCcList     []string //the video codecs of enhanced rtmp, e.g. hvc1, av01 and vp09
 }
@@ -0,0 +1,120 @@
+package rtmp
+
+import (
+	"github.com/pkg/errors"
+	"github.com/zhyoulun/gls/src/core"
+	"github.com/zhyoulun/gls/src/utils"
+	"io"
+	"sync"
+	"time"
+)
+
+//flowControl limits the bytes written but not acknowledged by the peer to the window set by Set Peer Bandwidth.
+//the bytes are counted as the sequence number of the acknowledgement, which wraps around at 2^32
+type flowControl struct {
+	mutex        *sync.Mutex
+	bytesWritten uint32        //all the bytes written after the handshake
+	bytesAcked   uint32        //the sequence number of the last acknowledgement from the peer
+	window       uint32        //the peer bandwidth, 0 is not limited
+	limitType    uint8         //the limit type of window
+	acked        chan struct{} //closed and replaced by each acknowledgement
+}
+
+func newFlowControl() *flowControl {
+	return &flowControl{
+		mutex:     &sync.Mutex{},
+		limitType: limitTypeDynamic, //no limit in effect, the same as a dynamic one
+		acked:     make(chan struct{}),
+	}
+}
+
+func (fc *flowControl) written(n uint32) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.bytesWritten += n
+}
+
+func (fc *flowControl) acknowledge(sequenceNumber uint32) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.bytesAcked = sequenceNumber
+	close(fc.acked)
+	fc.acked = make(chan struct{})
+}
+
+//setPeerBandwidth applies the limit type, the window in effect is returned.
+//hard: the window is size
+//soft: the window is size or the window in effect, whichever is smaller
+//dynamic: as hard if the limit type in effect is hard, otherwise it is ignored
+func (fc *flowControl) setPeerBandwidth(size uint32, limitType uint8) (uint32, error) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	switch limitType {
+	case limitTypeHard:
+		fc.window = size
+		fc.limitType = limitTypeHard
+	case limitTypeSoft:
+		if fc.window == 0 || size < fc.window {
+			fc.window = size
+		}
+		fc.limitType = limitTypeSoft
+	case limitTypeDynamic:
+		if fc.limitType == limitTypeHard {
+			fc.window = size
+		}
+	default:
+		return 0, errors.Wrapf(core.ErrorNotSupported, "limit type: %d", limitType)
+	}
+	return fc.window, nil
+}
+
+//exceeded reports whether the window is used up, a peer counting more bytes than written is not exceeded
+func (fc *flowControl) exceeded() bool {
+	unacked := fc.bytesWritten - fc.bytesAcked
+	return fc.window > 0 && int32(unacked) > 0 && unacked >= fc.window
+}
+
+//wait blocks until the window is not used up, or done is closed, or the timeout
+func (fc *flowControl) wait(done <-chan struct{}, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		fc.mutex.Lock()
+		if !fc.exceeded() {
+			fc.mutex.Unlock()
+			return nil
+		}
+		acked := fc.acked
+		fc.mutex.Unlock()
+		select {
+		case <-acked:
+		case <-done:
+			return errors.Wrap(core.ErrorClosed, "wait for acknowledgement")
+		case <-timer.C:
+			return errors.Wrapf(core.ErrorTimeout, "wait for acknowledgement, %s", timeout)
+		}
+	}
+}
+
+//countReader counts the bytes read for the acknowledgement, it is used by the reading goroutine only
+type countReader struct {
+	utils.ReadPeeker
+	n uint32 //wraps around at 2^32
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.ReadPeeker.Read(p)
+	r.n += uint32(n)
+	return n, err
+}
+
+type countWriter struct {
+	io.Writer
+	n uint32
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += uint32(n)
+	return n, err
+}
@@ -0,0 +1,178 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhyoulun/gls/src/av"
+	"github.com/zhyoulun/gls/src/core"
+	"github.com/zhyoulun/gls/src/flv"
+	"testing"
+	"time"
+)
+
+func Test_flowControl_setPeerBandwidth(t *testing.T) {
+	tests := []struct {
+		size      uint32
+		limitType uint8
+		window    uint32
+	}{
+		{100, limitTypeDynamic, 0}, //ignored without a hard limit
+		{200, limitTypeSoft, 200},  //no limit in effect
+		{300, limitTypeSoft, 200},  //the smaller one
+		{150, limitTypeSoft, 150},
+		{300, limitTypeDynamic, 150}, //ignored after a soft limit
+		{300, limitTypeHard, 300},
+		{50, limitTypeDynamic, 50}, //as hard
+	}
+	fc := newFlowControl()
+	for i, tt := range tests {
+		window, err := fc.setPeerBandwidth(tt.size, tt.limitType)
+		assert.NoError(t, err, "set %d", i)
+		assert.Equal(t, tt.window, window, "set %d", i)
+	}
+	_, err := fc.setPeerBandwidth(100, 3)
+	assert.Equal(t, core.ErrorNotSupported, errors.Cause(err))
+}
+
+func Test_flowControl_exceeded(t *testing.T) {
+	fc := newFlowControl()
+	fc.written(1000)
+	assert.False(t, fc.exceeded(), "not limited")
+	_, _ = fc.setPeerBandwidth(1000, limitTypeHard)
+	assert.True(t, fc.exceeded())
+	fc.acknowledge(1)
+	assert.False(t, fc.exceeded())
+	fc.acknowledge(2000) //the peer counts more bytes, e.g. the handshake
+	assert.False(t, fc.exceeded())
+
+	//the sequence number wraps around
+	fc.bytesWritten = 0xfffffff0
+	fc.acknowledge(0xfffffff0)
+	fc.written(999)
+	assert.False(t, fc.exceeded())
+	fc.written(1)
+	assert.True(t, fc.exceeded())
+	fc.acknowledge(1000 - 0x10)
+	assert.False(t, fc.exceeded())
+}
+
+func Test_flowControl_wait(t *testing.T) {
+	fc := newFlowControl()
+	_, _ = fc.setPeerBandwidth(100, limitTypeHard)
+	fc.written(100)
+	done := make(chan struct{})
+	err := fc.wait(done, 50*time.Millisecond)
+	assert.Equal(t, core.ErrorTimeout, errors.Cause(err))
+
+	go fc.acknowledge(100)
+	assert.NoError(t, fc.wait(done, time.Second))
+
+	fc.written(100)
+	close(done)
+	err = fc.wait(done, time.Second)
+	assert.Equal(t, core.ErrorClosed, errors.Cause(err))
+}
+
+func TestConn_WritePacket_flowControl(t *testing.T) {
+	out := &bytes.Buffer{}
+	c, _ := NewConn(newBufferConn(&bytes.Buffer{}, out))
+	peer, _ := NewConn(newBufferConn(out, &bytes.Buffer{}))
+
+	//the window acknowledgement size responds to the peer bandwidth
+	assert.NoError(t, c.handleProtocolControlMessage(typeSetPeerBandwidth, []byte{0x00, 0x00, 0x01, 0x00, limitTypeHard}))
+	if m, err := peer.readMessage(); assert.NoError(t, err) {
+		assert.Equal(t, uint8(typeWindowAcknowledgementSize), m.getMessageTypeID())
+		assert.Equal(t, []byte{0x00, 0x00, 0x01, 0x00}, m.GetData())
+	}
+	out.Reset()
+
+	p, _ := av.NewPacketFromData(av.TypeAudio, 0, append([]byte{0xaf, flv.AACPacketTypeAACRaw}, make([]byte, 300)...), flv.NewDemuxer())
+	assert.NoError(t, c.WritePacket(p))
+	written := uint32(out.Len())
+
+	//the window is used up until the acknowledgement
+	done := make(chan error)
+	go func() {
+		done <- c.WritePacket(p)
+	}()
+	select {
+	case <-done:
+		assert.Fail(t, "write without acknowledgement")
+	case <-time.After(50 * time.Millisecond):
+	}
+	ack := make([]byte, 4)
+	binary.BigEndian.PutUint32(ack, written)
+	assert.NoError(t, c.handleProtocolControlMessage(typeAcknowledgement, ack))
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "write after acknowledgement")
+	}
+
+	//close stops waiting
+	go func() {
+		done <- c.WritePacket(p)
+	}()
+	assert.NoError(t, c.Close())
+	select {
+	case err := <-done:
+		assert.Equal(t, core.ErrorClosed, errors.Cause(err))
+	case <-time.After(time.Second):
+		assert.Fail(t, "write after close")
+	}
+}
+
+//the sequence number is the bytes read so far, sent after each window acknowledgement size bytes
+func TestConn_readMessage_ack(t *testing.T) {
+	in := &bytes.Buffer{}
+	out := &bytes.Buffer{}
+	w, _ := NewConn(newBufferConn(&bytes.Buffer{}, in))
+	c, _ := NewConn(newBufferConn(in, out))
+	c.remoteMaximumChunkSize = w.localMaximumChunkSize
+	c.remoteWindowAckSize = 100
+	peer, _ := NewConn(newBufferConn(out, &bytes.Buffer{}))
+
+	var total uint32
+	for i := 0; i < 5; i++ {
+		m, _ := newMessage2(6, 0, 60, typeVideo, 1)
+		_ = m.cs.writeToData(make([]byte, 60))
+		assert.NoError(t, w.writeMessage(m))
+		total += uint32(in.Len())
+		_, err := c.readMessage()
+		assert.NoError(t, err)
+	}
+	var acks []uint32
+	for out.Len() > 0 {
+		if m, err := peer.readMessage(); assert.NoError(t, err) {
+			assert.Equal(t, uint8(typeAcknowledgement), m.getMessageTypeID())
+			acks = append(acks, binary.BigEndian.Uint32(m.GetData()))
+		}
+	}
+	//72 bytes for the first message, 61 bytes for the others
+	assert.Equal(t, []uint32{72 + 61, 72 + 61*3}, acks)
+	assert.Equal(t, total, c.reader.n)
+}
+
+func TestNetStream_WritePacket_flowControl(t *testing.T) {
+	out := &bytes.Buffer{}
+	c, _ := NewConn(newBufferConn(&bytes.Buffer{}, out))
+	ns := newNetStream(c, 1)
+	_, _ = c.flow.setPeerBandwidth(100, limitTypeHard)
+	p, _ := av.NewPacketFromData(av.TypeAudio, 0, append([]byte{0xaf, flv.AACPacketTypeAACRaw}, make([]byte, 100)...), flv.NewDemuxer())
+	assert.NoError(t, ns.WritePacket(p))
+
+	done := make(chan error)
+	go func() {
+		done <- ns.WritePacket(p)
+	}()
+	assert.NoError(t, c.Close())
+	select {
+	case err := <-done:
+		assert.Equal(t, core.ErrorClosed, errors.Cause(err))
+	case <-time.After(time.Second):
+		assert.Fail(t, "write after close")
+	}
+}
@@ -1,6 +1,8 @@
 package rtmp
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"github.com/pkg/errors"
@@ -18,12 +20,22 @@ type handshake struct {
 	c2time   uint32
 	c2time2  uint32
 	c2random [1528]byte
+	s0       byte
+	s1time   uint32
 	s1random [1528]byte
+	s2time   uint32
+	s2time2  uint32
+	s2random [1528]byte
+
+	c1version uint32 //the zero field of c1, flash player puts its version here when using the complex handshake
+	complex   bool   //c1 carries a valid digest, answer with the complex handshake
+	schema    int    //digest schema used by c1
+	c1digest  []byte
 }
 
 func (h *handshake) String() string {
-	return fmt.Sprintf("c0: %+v, c1time: %+v, c1random: %+v, c2time: %+v, c2time2: %+v, c2random: %+v, s1random: %+v",
-		h.c0, h.c1time, h.c1random, h.c2time, h.c2time2, h.c2random, h.s1random)
+	return fmt.Sprintf("c0: %+v, c1time: %+v, c1random: %+v, c2time: %+v, c2time2: %+v, c2random: %+v, s0: %+v, s1time: %+v, s1random: %+v, s2time: %+v, s2time2: %+v, s2random: %+v",
+		h.c0, h.c1time, h.c1random, h.c2time, h.c2time2, h.c2random, h.s0, h.s1time, h.s1random, h.s2time, h.s2time2, h.s2random)
 }
 
 func newHandshake() (*handshake, error) {
@@ -37,15 +49,17 @@ func (h *handshake) Do(rw io.ReadWriter) error {
 	}
 
 	//the server MUST wait until C0 has been received before sending S0 and S1,
-	//and MAY wait until after C1 as well
-	if err := h.writeS0(rw); err != nil {
+	//and MAY wait until after C1 as well.
+	//we wait until after C1, the complex handshake needs the digest schema of C1 to build S1
+	if err := h.readC1(rw); err != nil {
 		return err
 	}
-	if err := h.writeS1(rw); err != nil {
+	h.detectComplex()
+
+	if err := h.writeS0(rw); err != nil {
 		return err
 	}
-
-	if err := h.readC1(rw); err != nil {
+	if err := h.writeS1(rw); err != nil {
 		return err
 	}
 
@@ -62,6 +76,35 @@ func (h *handshake) Do(rw io.ReadWriter) error {
 	return nil
 }
 
+//DoClient is the client side of Do
+func (h *handshake) DoClient(rw io.ReadWriter) error {
+	//the client MUST wait until S1 has been received before sending C2
+	if err := h.writeC0(rw); err != nil {
+		return err
+	}
+	if err := h.writeC1(rw); err != nil {
+		return err
+	}
+
+	if err := h.readS0(rw); err != nil {
+		return err
+	}
+	if err := h.readS1(rw); err != nil {
+		return err
+	}
+
+	if err := h.writeC2(rw); err != nil {
+		return err
+	}
+
+	//the client MUST wait until S2 has been received before sending any other data
+	if err := h.readS2(rw); err != nil {
+		return err
+	}
+	log.Tracef("handshake: %s", h)
+	return nil
+}
+
 func (h *handshake) readC0(r io.Reader) error {
 	if b, err := utils.ReadByte(r); err != nil {
 		return err
@@ -94,10 +137,12 @@ func (h *handshake) readC1(r io.Reader) error {
 	} else {
 		//this field MUST be all 0s
 		if zero != 0 {
-			log.Warnf("read c1 zero, want 0, got: %d", zero)
+			log.Debugf("read c1 zero, want 0, got: %d", zero)
 			//todo 遇到兼容问题了，降低要求，badcase: ffmpeg version 4.4
 			//return fmt.Errorf("read c1 zero, want 0, got: %d", zero)
+			//clients using the complex handshake(flash player, ffmpeg) put their version here
 		}
+		h.c1version = zero
 	}
 
 	//read random
@@ -133,7 +178,8 @@ func (h *handshake) readC2(r io.Reader) error {
 	} else {
 		copy(h.c2random[:], random)
 	}
-	if h.s1random != h.c2random {
+	//in the complex handshake, C2 is random data with a digest of S1, not an echo of S1
+	if !h.complex && h.s1random != h.c2random {
 		return errors.Errorf("read c2 random, want c2random=s1random, bot not")
 	}
 	return nil
@@ -147,6 +193,9 @@ func (h *handshake) writeS0(w io.Writer) error {
 }
 
 func (h *handshake) writeS1(w io.Writer) error {
+	if h.complex {
+		return h.writeComplexS1(w)
+	}
 	var timestamp uint32 = 0
 	if err := binary.Write(w, binary.BigEndian, &timestamp); err != nil {
 		return err
@@ -170,6 +219,9 @@ func (h *handshake) writeS1(w io.Writer) error {
 }
 
 func (h *handshake) writeS2(w io.Writer) error {
+	if h.complex {
+		return h.writeComplexS2(w)
+	}
 	if err := binary.Write(w, binary.BigEndian, &h.c1time); err != nil {
 		return err
 	}
@@ -182,3 +234,197 @@ func (h *handshake) writeS2(w io.Writer) error {
 	}
 	return nil
 }
+
+func (h *handshake) writeC0(w io.Writer) error {
+	if err := utils.WriteByte(w, rtmpVersion); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (h *handshake) writeC1(w io.Writer) error {
+	var timestamp uint32 = 0
+	if err := binary.Write(w, binary.BigEndian, &timestamp); err != nil {
+		return err
+	}
+	var zero uint32 = 0
+	if err := binary.Write(w, binary.BigEndian, &zero); err != nil {
+		return err
+	}
+	var random [1528]byte
+	_, _ = rand.Read(random[:])
+	h.c1random = random
+	if err := utils.WriteBytes(w, random[:]); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (h *handshake) writeC2(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, &h.s1time); err != nil {
+		return err
+	}
+	var zero uint32 = 0
+	if err := binary.Write(w, binary.BigEndian, &zero); err != nil {
+		return err
+	}
+	if err := utils.WriteBytes(w, h.s1random[:]); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (h *handshake) readS0(r io.Reader) error {
+	if b, err := utils.ReadByte(r); err != nil {
+		return err
+	} else {
+		if b != rtmpVersion {
+			return fmt.Errorf("read s0, want: %d, got: %d", rtmpVersion, b)
+		}
+		h.s0 = b
+	}
+	return nil
+}
+
+func (h *handshake) readS1(r io.Reader) error {
+	//read time
+	var timestamp uint32
+	if err := binary.Read(r, binary.BigEndian, &timestamp); err != nil {
+		return err
+	} else {
+		h.s1time = timestamp
+	}
+
+	//read zero
+	var zero uint32
+	if err := binary.Read(r, binary.BigEndian, &zero); err != nil {
+		return err
+	} else {
+		if zero != 0 {
+			log.Warnf("read s1 zero, want 0, got: %d", zero)
+		}
+	}
+
+	//read random
+	if random, err := utils.ReadBytes(r, 1528); err != nil {
+		return err
+	} else {
+		copy(h.s1random[:], random)
+	}
+	return nil
+}
+
+func (h *handshake) readS2(r io.Reader) error {
+	//read time
+	var timestamp uint32
+	if err := binary.Read(r, binary.BigEndian, &timestamp); err != nil {
+		return err
+	} else {
+		h.s2time = timestamp
+	}
+
+	//read time2
+	var timestamp2 uint32
+	if err := binary.Read(r, binary.BigEndian, &timestamp2); err != nil {
+		return err
+	} else {
+		h.s2time2 = timestamp2
+	}
+
+	//read random
+	if random, err := utils.ReadBytes(r, 1528); err != nil {
+		return err
+	} else {
+		copy(h.s2random[:], random)
+	}
+	if h.c1random != h.s2random {
+		//servers answering with the digest handshake don't echo c1, keep going like ffmpeg does
+		log.Warnf("read s2 random, want s2random=c1random, but not")
+	}
+	return nil
+}
+
+//the complex handshake is not in the specification, it is used by flash player to make sure it talks to a genuine server,
+//without it flash player refuses to play h.264/aac.
+//C1/S1: time(4B) version(4B) key block(764B) digest block(764B), schema 0
+//       time(4B) version(4B) digest block(764B) key block(764B), schema 1
+//digest block: offset(4B) random(offset B) digest(32B) random(764-4-offset-32 B)
+//the digest is HMAC-SHA256 of the other 1504 bytes
+//S2/C2: random(1504B) digest(32B), the digest key is HMAC-SHA256 of the peer's C1/S1 digest
+
+func (h *handshake) detectComplex() {
+	//the simple handshake
+	if h.c1version == 0 {
+		return
+	}
+	c1 := h.c1Bytes()
+	for _, schema := range []int{handshakeSchema0, handshakeSchema1} {
+		pos := handshakeDigestPos(c1, schema)
+		if hmac.Equal(c1[pos:pos+sha256.Size], handshakeDigest(c1, pos, genuineFPKey[:30])) {
+			h.complex = true
+			h.schema = schema
+			h.c1digest = make([]byte, sha256.Size)
+			copy(h.c1digest, c1[pos:pos+sha256.Size])
+			log.Debugf("handshake, got complex c1, schema: %d, version: 0x%x", schema, h.c1version)
+			return
+		}
+	}
+	log.Debugf("handshake, no valid digest in c1, fall back to the simple handshake, version: 0x%x", h.c1version)
+}
+
+func (h *handshake) c1Bytes() []byte {
+	c1 := make([]byte, handshakeSize)
+	binary.BigEndian.PutUint32(c1[0:4], h.c1time)
+	binary.BigEndian.PutUint32(c1[4:8], h.c1version)
+	copy(c1[8:], h.c1random[:])
+	return c1
+}
+
+func (h *handshake) writeComplexS1(w io.Writer) error {
+	s1 := make([]byte, handshakeSize)
+	binary.BigEndian.PutUint32(s1[0:4], 0)
+	binary.BigEndian.PutUint32(s1[4:8], handshakeServerVersion)
+	_, _ = rand.Read(s1[8:])
+	pos := handshakeDigestPos(s1, h.schema)
+	copy(s1[pos:pos+sha256.Size], handshakeDigest(s1, pos, genuineFMSKey[:36]))
+	copy(h.s1random[:], s1[8:])
+	if err := utils.WriteBytes(w, s1); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (h *handshake) writeComplexS2(w io.Writer) error {
+	s2 := make([]byte, handshakeSize)
+	_, _ = rand.Read(s2)
+	key := handshakeHmac(genuineFMSKey, h.c1digest)
+	copy(s2[handshakeSize-sha256.Size:], handshakeHmac(key, s2[:handshakeSize-sha256.Size]))
+	if err := utils.WriteBytes(w, s2); err != nil {
+		return err
+	}
+	return nil
+}
+
+//position of the digest in C1/S1
+func handshakeDigestPos(b []byte, schema int) int {
+	base := 8 //digest block first
+	if schema == handshakeSchema0 {
+		base = 8 + 764 //key block first
+	}
+	offset := (int(b[base]) + int(b[base+1]) + int(b[base+2]) + int(b[base+3])) % (764 - 4 - sha256.Size)
+	return base + 4 + offset
+}
+
+//digest of b without the 32 bytes at pos
+func handshakeDigest(b []byte, pos int, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b[:pos])
+	mac.Write(b[pos+sha256.Size:])
+	return mac.Sum(nil)
+}
+
+func handshakeHmac(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
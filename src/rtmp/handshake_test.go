@@ -3,10 +3,14 @@ package rtmp
 import (
 	"bou.ke/monkey"
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/zhyoulun/gls/src/utils"
+	"io"
 	"math/rand"
+	"net"
 	"os"
 	"testing"
 )
@@ -211,3 +215,147 @@ func Test_handshake_writeS2(t *testing.T) {
 		assert.Error(t, err)
 	}
 }
+
+func Test_handshake_DoClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	ch := make(chan error, 1)
+	go func() {
+		serverConn, err := ln.Accept()
+		if err != nil {
+			ch <- err
+			return
+		}
+		defer serverConn.Close()
+		h, _ := newHandshake()
+		ch <- h.Do(serverConn)
+	}()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer clientConn.Close()
+	h, _ := newHandshake()
+	err = h.DoClient(clientConn)
+	assert.NoError(t, err)
+	assert.NoError(t, <-ch)
+	assert.Equal(t, byte(rtmpVersion), h.s0)
+	assert.Equal(t, h.c1random, h.s2random)
+}
+
+func Test_handshake_readS0(t *testing.T) {
+	{
+		r := bytes.NewReader([]byte{rtmpVersion})
+		h, _ := newHandshake()
+		err := h.readS0(r)
+		assert.NoError(t, err)
+		assert.Equal(t, byte(rtmpVersion), h.s0)
+	}
+	{
+		r := bytes.NewReader([]byte{1})
+		h, _ := newHandshake()
+		err := h.readS0(r)
+		assert.Error(t, err)
+	}
+	{
+		r := bytes.NewReader([]byte{})
+		h, _ := newHandshake()
+		err := h.readS0(r)
+		assert.Error(t, err)
+	}
+}
+
+func Test_handshake_writeC2(t *testing.T) {
+	{
+		buf := &bytes.Buffer{}
+		h, _ := newHandshake()
+		h.s1time = 0x01020304
+		h.s1random = [1528]byte{0x01}
+		err := h.writeC2(buf)
+		assert.NoError(t, err)
+		expect := []byte{0x01, 0x02, 0x03, 0x04, 0x00, 0x00, 0x00, 0x00}
+		random := [1528]byte{0x01}
+		expect = append(expect, random[:]...)
+		assert.Equal(t, expect, buf.Bytes())
+	}
+	{
+		buf, _ := utils.NewWriteBufferWithMaxCapacity(7)
+		h, _ := newHandshake()
+		err := h.writeC2(buf)
+		assert.Error(t, err)
+	}
+}
+
+//c1 of flash player, with a digest of schema
+func newComplexC1(schema int) []byte {
+	c1 := make([]byte, handshakeSize)
+	binary.BigEndian.PutUint32(c1[4:8], 0x80000702)
+	for i := 8; i < handshakeSize; i++ {
+		c1[i] = byte(i * 7)
+	}
+	pos := handshakeDigestPos(c1, schema)
+	copy(c1[pos:pos+sha256.Size], handshakeDigest(c1, pos, genuineFPKey[:30]))
+	return c1
+}
+
+func Test_handshake_detectComplex(t *testing.T) {
+	{
+		h, _ := newHandshake()
+		err := h.readC1(bytes.NewReader(make([]byte, handshakeSize)))
+		assert.NoError(t, err)
+		h.detectComplex()
+		assert.False(t, h.complex)
+	}
+	for _, schema := range []int{handshakeSchema0, handshakeSchema1} {
+		c1 := newComplexC1(schema)
+		h, _ := newHandshake()
+		err := h.readC1(bytes.NewReader(c1))
+		assert.NoError(t, err)
+		h.detectComplex()
+		assert.True(t, h.complex)
+		assert.Equal(t, schema, h.schema)
+		pos := handshakeDigestPos(c1, schema)
+		assert.Equal(t, c1[pos:pos+sha256.Size], h.c1digest)
+	}
+	{
+		c1 := newComplexC1(handshakeSchema1)
+		pos := handshakeDigestPos(c1, handshakeSchema1)
+		c1[pos] ^= 0xff
+		h, _ := newHandshake()
+		err := h.readC1(bytes.NewReader(c1))
+		assert.NoError(t, err)
+		h.detectComplex()
+		assert.False(t, h.complex)
+	}
+}
+
+func Test_handshake_DoComplex(t *testing.T) {
+	c1 := newComplexC1(handshakeSchema1)
+	src := []byte{rtmpVersion}
+	src = append(src, c1...)
+	src = append(src, make([]byte, handshakeSize)...) //c2 is not checked in the complex handshake
+	out := &bytes.Buffer{}
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(src), out}
+
+	h, _ := newHandshake()
+	err := h.Do(rw)
+	assert.NoError(t, err)
+	assert.True(t, h.complex)
+
+	res := out.Bytes()
+	assert.Equal(t, 1+2*handshakeSize, len(res))
+	assert.Equal(t, byte(rtmpVersion), res[0])
+	s1 := res[1 : 1+handshakeSize]
+	s2 := res[1+handshakeSize:]
+
+	//s1 carries a digest made by the server key
+	pos := handshakeDigestPos(s1, handshakeSchema1)
+	assert.Equal(t, s1[pos:pos+sha256.Size], handshakeDigest(s1, pos, genuineFMSKey[:36]))
+
+	//s2 carries a digest of the c1 digest
+	c1pos := handshakeDigestPos(c1, handshakeSchema1)
+	key := handshakeHmac(genuineFMSKey, c1[c1pos:c1pos+sha256.Size])
+	assert.Equal(t, s2[handshakeSize-sha256.Size:], handshakeHmac(key, s2[:handshakeSize-sha256.Size]))
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zhyoulun/gls/src/amf"
 	"github.com/zhyoulun/gls/src/av"
 	"github.com/zhyoulun/gls/src/core"
 	"github.com/zhyoulun/gls/src/flv"
@@ -43,6 +46,11 @@ func (m *message) GetTimestamp() uint32 {
 	return m.cs.clock
 }
 
+//GetTimestamp64 is the timestamp following the 32 bits rollover
+func (m *message) GetTimestamp64() int64 {
+	return m.cs.timestamp64
+}
+
 func (m *message) GetAvType() (uint8, error) {
 	var avType uint8
 	if m.cs.messageTypeID == typeAudio {
@@ -72,6 +80,7 @@ func newMessage2(chunkStreamID, timestamp, messageLength uint32, messageTypeID u
 	cs := &chunkStream{
 		chunkStreamID:   chunkStreamID,
 		clock:           timestamp,
+		timestamp64:     int64(timestamp),
 		messageLength:   messageLength,
 		messageTypeID:   messageTypeID,
 		messageStreamID: messageStreamID,
@@ -116,6 +125,7 @@ func newMessage3(p *av.Packet) (*message, error) {
 	cs := &chunkStream{
 		chunkStreamID:   chunkStreamID,
 		clock:           p.GetTimestamp(),
+		timestamp64:     p.GetTimestamp64(),
 		messageLength:   dataLength,
 		messageTypeID:   messageTypeID,
 		messageStreamID: p.GetStreamID(),
@@ -125,6 +135,53 @@ func newMessage3(p *av.Packet) (*message, error) {
 	return &message{cs: cs}, nil
 }
 
+//splitAggregateMessage splits the aggregate message into audio, video and data messages,
+//the sub message timestamp is rebased: aggregate timestamp + (sub timestamp - first sub timestamp)
+func splitAggregateMessage(m *message) ([]*message, error) {
+	data := m.GetData()
+	res := make([]*message, 0)
+	var firstTimestamp uint32
+	for i := 0; len(data) > 0; i++ {
+		if len(data) < aggregateTagHeaderSize {
+			return nil, errors.Errorf("aggregate message, short tag header, length: %d", len(data))
+		}
+		messageTypeID := data[0]
+		dataSize := uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+		timestamp := uint32(data[7])<<24 | uint32(data[4])<<16 | uint32(data[5])<<8 | uint32(data[6])
+		//data[8:11] stream id, always 0
+		data = data[aggregateTagHeaderSize:]
+		if uint32(len(data)) < dataSize {
+			return nil, errors.Errorf("aggregate message, short tag data, want: %d, got: %d", dataSize, len(data))
+		}
+		if i == 0 {
+			firstTimestamp = timestamp
+		}
+
+		switch messageTypeID {
+		case typeAudio, typeVideo, typeDataAMF0, typeDataAMF3:
+			sub, err := newMessage2(m.getChunkStreamID(), m.GetTimestamp()+timestamp-firstTimestamp, dataSize, messageTypeID, m.GetMessageStreamID())
+			if err != nil {
+				return nil, err
+			}
+			sub.cs.timestamp64 = m.GetTimestamp64() + int64(timestamp) - int64(firstTimestamp)
+			if err := sub.cs.writeToData(data[:dataSize]); err != nil {
+				return nil, err
+			}
+			res = append(res, sub)
+		default:
+			log.Warnf("aggregate message, ignore sub message, messageTypeID: %d", messageTypeID)
+		}
+		data = data[dataSize:]
+
+		//some muxers omit the last back pointer
+		if len(data) < aggregateBackPointerSize {
+			break
+		}
+		data = data[aggregateBackPointerSize:]
+	}
+	return res, nil
+}
+
 func newBaseProtocolControlMessage(messageLength uint32, messageTypeID uint8) (*message, error) {
 	var timestamp uint32 = 0 //ignored
 	return newMessage2(chunkStreamID2, timestamp, messageLength, messageTypeID, messageStreamID0)
@@ -196,8 +253,24 @@ func newPCMSetChunkSize(size uint32) (*message, error) {
 	return m, nil
 }
 
-func newCommandMessage(chunkStreamID, messageStreamID uint32, data []byte) (*message, error) {
-	m, err := newMessage2(chunkStreamID, 0, uint32(len(data)), typeCommandAMF0, messageStreamID)
+func newCommandMessage(chunkStreamID, messageStreamID uint32, objectEncoding amf.AmfVersion, data []byte) (*message, error) {
+	var typeID uint8 = typeCommandAMF0
+	if objectEncoding == amf.Amf3 {
+		typeID = typeCommandAMF3
+	}
+	m, err := newMessage2(chunkStreamID, 0, uint32(len(data)), typeID, messageStreamID)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.cs.writeToData(data); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//data message of amf0, e.g. onPlayStatus
+func newDataMessage(chunkStreamID, messageStreamID uint32, data []byte) (*message, error) {
+	m, err := newMessage2(chunkStreamID, 0, uint32(len(data)), typeDataAMF0, messageStreamID)
 	if err != nil {
 		return nil, err
 	}
@@ -252,3 +325,66 @@ func newUCMStreamBegin(messageStreamID uint32) (*message, error) {
 	}
 	return m, nil
 }
+
+func newUCMStreamEOF(messageStreamID uint32) (*message, error) {
+	m, err := newBaseUserControlMessage(EventStreamEOF, 4)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := utils.WriteUintBE(buf, messageStreamID, 4); err != nil {
+		return nil, err
+	}
+	if err := m.cs.writeToData(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func newUCMSetBufferLength(messageStreamID, bufferLength uint32) (*message, error) {
+	m, err := newBaseUserControlMessage(EventSetBufferLength, 8)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := utils.WriteUintBE(buf, messageStreamID, 4); err != nil {
+		return nil, err
+	}
+	if err := utils.WriteUintBE(buf, bufferLength, 4); err != nil {
+		return nil, err
+	}
+	if err := m.cs.writeToData(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func newUCMPingRequest(timestamp uint32) (*message, error) {
+	m, err := newBaseUserControlMessage(EventPingRequest, 4)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := utils.WriteUintBE(buf, timestamp, 4); err != nil {
+		return nil, err
+	}
+	if err := m.cs.writeToData(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func newUCMPingResponse(timestamp uint32) (*message, error) {
+	m, err := newBaseUserControlMessage(EventPingResponse, 4)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := utils.WriteUintBE(buf, timestamp, 4); err != nil {
+		return nil, err
+	}
+	if err := m.cs.writeToData(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,64 @@
+package rtmp
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+//writeAggregateTag writes one flv tag and its back pointer of the aggregate message body
+func writeAggregateTag(buf *bytes.Buffer, messageTypeID uint8, timestamp uint32, data []byte) {
+	size := len(data)
+	buf.Write([]byte{messageTypeID, byte(size >> 16), byte(size >> 8), byte(size),
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(timestamp >> 24),
+		0, 0, 0})
+	buf.Write(data)
+	backPointer := size + aggregateTagHeaderSize
+	buf.Write([]byte{byte(backPointer >> 24), byte(backPointer >> 16), byte(backPointer >> 8), byte(backPointer)})
+}
+
+func newAggregateMessage(timestamp uint32, body []byte) *message {
+	m, _ := newMessage2(6, timestamp, uint32(len(body)), typeAggregate, 1)
+	_ = m.cs.writeToData(body)
+	return m
+}
+
+func Test_splitAggregateMessage(t *testing.T) {
+	{
+		body := &bytes.Buffer{}
+		writeAggregateTag(body, typeVideo, 0x01000010, []byte{0x17, 0x01, 0, 0, 0})
+		writeAggregateTag(body, typeAudio, 0x01000030, []byte{0xaf, 0x01, 0x21})
+		writeAggregateTag(body, 0x7f, 0x01000040, []byte{0x00})
+		ms, err := splitAggregateMessage(newAggregateMessage(1000, body.Bytes()))
+		assert.NoError(t, err)
+		if assert.Equal(t, 2, len(ms)) {
+			assert.Equal(t, uint8(typeVideo), ms[0].getMessageTypeID())
+			assert.Equal(t, uint32(1000), ms[0].GetTimestamp())
+			assert.Equal(t, uint32(1), ms[0].GetMessageStreamID())
+			assert.Equal(t, []byte{0x17, 0x01, 0, 0, 0}, ms[0].GetData())
+			assert.Equal(t, uint8(typeAudio), ms[1].getMessageTypeID())
+			assert.Equal(t, uint32(1032), ms[1].GetTimestamp())
+			assert.Equal(t, []byte{0xaf, 0x01, 0x21}, ms[1].GetData())
+		}
+	}
+	{
+		//without the last back pointer
+		body := &bytes.Buffer{}
+		writeAggregateTag(body, typeAudio, 0, []byte{0xaf, 0x01})
+		ms, err := splitAggregateMessage(newAggregateMessage(0, body.Bytes()[:body.Len()-aggregateBackPointerSize]))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(ms))
+	}
+	{
+		//short tag data
+		body := &bytes.Buffer{}
+		writeAggregateTag(body, typeAudio, 0, []byte{0xaf, 0x01})
+		_, err := splitAggregateMessage(newAggregateMessage(0, body.Bytes()[:aggregateTagHeaderSize+1]))
+		assert.Error(t, err)
+	}
+	{
+		//short tag header
+		_, err := splitAggregateMessage(newAggregateMessage(0, []byte{typeAudio, 0, 0}))
+		assert.Error(t, err)
+	}
+}
@@ -3,46 +3,237 @@ package rtmp
 import (
 	"bytes"
 	"github.com/zhyoulun/gls/src/amf"
+	"github.com/zhyoulun/gls/src/flv"
 )
 
-func newNetConnectionResponseConnect(transactionID float64) ([]byte, error) {
+func newNetConnectionResponseConnect(transactionID float64, objectEncoding amf.AmfVersion) ([]byte, error) {
 	properties := make(amf.AmfObject)
 	properties["fmsVer"] = "FMS/3,0,1,123"
 	properties["capabilities"] = 31
+	properties["fourCcList"] = newFourCcList(flv.FourCCList)
 
 	info := make(amf.AmfObject)
 	info["level"] = "status"
 	info["code"] = "NetConnection.Connect.Success"
 	info["description"] = "Connection Succeeded."
-	info["objectEncoding"] = amf.Amf0
+	info["objectEncoding"] = objectEncoding
 
 	command := amf.AmfArray{
-		"_result",
+		commandNetConnectionResult,
 		transactionID,
 		properties,
 		info,
 	}
-	return newNetConnectionResponseBase(command)
+	return newNetConnectionResponseBase(command, objectEncoding)
 }
 
-func newNetConnectionResponseCreateStream(transactionID float64, messageStreamID uint32) ([]byte, error) {
+//the _error of a rejected connect, the conn is closed after it
+func newNetConnectionResponseConnectRejected(transactionID float64, description string, objectEncoding amf.AmfVersion) ([]byte, error) {
+	info := make(amf.AmfObject)
+	info["level"] = netStreamStatusLevelError
+	info["code"] = "NetConnection.Connect.Rejected"
+	info["description"] = description
+
+	command := amf.AmfArray{
+		commandNetConnectionError,
+		transactionID,
+		nil,
+		info,
+	}
+	return newNetConnectionResponseBase(command, objectEncoding)
+}
+
+//the _result of a registered method, the results follow the nil command object
+func newNetConnectionResponseCallResult(transactionID float64, results []interface{}, objectEncoding amf.AmfVersion) ([]byte, error) {
+	command := amf.AmfArray{
+		commandNetConnectionResult,
+		transactionID,
+		nil,
+	}
+	command = append(command, results...)
+	return newNetConnectionResponseBase(command, objectEncoding)
+}
+
+//the _error of a failed or unknown method
+func newNetConnectionResponseCallFailed(transactionID float64, description string, objectEncoding amf.AmfVersion) ([]byte, error) {
+	info := make(amf.AmfObject)
+	info["level"] = netStreamStatusLevelError
+	info["code"] = "NetConnection.Call.Failed"
+	info["description"] = description
+
+	command := amf.AmfArray{
+		commandNetConnectionError,
+		transactionID,
+		nil,
+		info,
+	}
+	return newNetConnectionResponseBase(command, objectEncoding)
+}
+
+func newNetConnectionResponseCreateStream(transactionID float64, messageStreamID uint32, objectEncoding amf.AmfVersion) ([]byte, error) {
 	command := amf.AmfArray{
-		"_result",
+		commandNetConnectionResult,
 		transactionID,
 		nil,
 		messageStreamID,
 	}
-	return newNetConnectionResponseBase(command)
+	return newNetConnectionResponseBase(command, objectEncoding)
 }
 
-func newNetConnectionResponseBase(arr amf.AmfArray) ([]byte, error) {
+//the _result of releaseStream, FCPublish, FCUnpublish and FCSubscribe
+func newNetConnectionResponseResult(transactionID float64, objectEncoding amf.AmfVersion) ([]byte, error) {
+	command := amf.AmfArray{
+		commandNetConnectionResult,
+		transactionID,
+		nil,
+		nil,
+	}
+	return newNetConnectionResponseBase(command, objectEncoding)
+}
+
+func newNetConnectionResponseOnFCPublish(streamName string, objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetConnectionResponseOnFC(commandOnFCPublish, "NetStream.Publish.Start", streamName, objectEncoding)
+}
+
+func newNetConnectionResponseOnFCUnpublish(streamName string, objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetConnectionResponseOnFC(commandOnFCUnpublish, "NetStream.Unpublish.Success", streamName, objectEncoding)
+}
+
+func newNetConnectionResponseOnFCSubscribe(streamName string, objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetConnectionResponseOnFC(commandOnFCSubscribe, "NetStream.Play.Start", streamName, objectEncoding)
+}
+
+//the description is the stream name, as fms does
+func newNetConnectionResponseOnFC(commandName, code, streamName string, objectEncoding amf.AmfVersion) ([]byte, error) {
+	info := make(amf.AmfObject)
+	info["code"] = code
+	info["description"] = streamName
+
+	command := amf.AmfArray{
+		commandName,
+		transactionID0,
+		nil,
+		info,
+	}
+	return newNetConnectionResponseBase(command, objectEncoding)
+}
+
+func newNetConnectionCommandConnect(transactionID float64, connInfo ConnectCommentObject) ([]byte, error) {
+	obj := make(amf.AmfObject)
+	obj["app"] = connInfo.App
+	obj["type"] = connInfo.Type
+	obj["flashVer"] = connInfo.Flashver
+	obj["tcUrl"] = connInfo.TcUrl
+	obj["fpad"] = connInfo.Fpad
+	obj["capabilities"] = 15
+	obj["audioCodecs"] = connInfo.AudioCodecs
+	obj["videoCodecs"] = connInfo.VideoCodecs
+	obj["videoFunction"] = connInfo.VideoFunction
+	if len(connInfo.FourCcList) > 0 {
+		obj["fourCcList"] = newFourCcList(connInfo.FourCcList)
+	}
+
+	command := amf.AmfArray{
+		commandNetConnectionConnect,
+		transactionID,
+		obj,
+	}
+	return newNetConnectionResponseBase(command, amf.Amf0)
+}
+
+func newNetConnectionCommandCall(name string, transactionID float64, args []interface{}) ([]byte, error) {
+	command := amf.AmfArray{
+		name,
+		transactionID,
+		nil,
+	}
+	command = append(command, args...)
+	return newNetConnectionResponseBase(command, amf.Amf0)
+}
+
+func newNetConnectionCommandCreateStream(transactionID float64) ([]byte, error) {
+	command := amf.AmfArray{
+		commandNetConnectionCreateStream,
+		transactionID,
+		nil,
+	}
+	return newNetConnectionResponseBase(command, amf.Amf0)
+}
+
+func newNetConnectionCommandReleaseStream(transactionID float64, streamName string) ([]byte, error) {
+	command := amf.AmfArray{
+		commandReleaseStream,
+		transactionID,
+		nil,
+		streamName,
+	}
+	return newNetConnectionResponseBase(command, amf.Amf0)
+}
+
+func newNetConnectionCommandFCPublish(transactionID float64, streamName string) ([]byte, error) {
+	command := amf.AmfArray{
+		commandFCPublish,
+		transactionID,
+		nil,
+		streamName,
+	}
+	return newNetConnectionResponseBase(command, amf.Amf0)
+}
+
+func newNetConnectionCommandFCSubscribe(transactionID float64, streamName string) ([]byte, error) {
+	command := amf.AmfArray{
+		commandFCSubscribe,
+		transactionID,
+		nil,
+		streamName,
+	}
+	return newNetConnectionResponseBase(command, amf.Amf0)
+}
+
+func newNetConnectionCommandFCUnpublish(transactionID float64, streamName string) ([]byte, error) {
+	command := amf.AmfArray{
+		commandFCUnpublish,
+		transactionID,
+		nil,
+		streamName,
+	}
+	return newNetConnectionResponseBase(command, amf.Amf0)
+}
+
+//fourCcList is a strict array of strings
+func newFourCcList(list []string) amf.AmfArray {
+	arr := make(amf.AmfArray, 0, len(list))
+	for _, fourCC := range list {
+		arr = append(arr, fourCC)
+	}
+	return arr
+}
+
+//amf3 command: a leading 0x00 followed by amf0 values, objects are switched to amf3 by the avmplus-object-marker
+func newNetConnectionResponseBase(arr amf.AmfArray, objectEncoding amf.AmfVersion) ([]byte, error) {
 	a, err := amf.NewAmf()
 	if err != nil {
 		return nil, err
 	}
 	buf := &bytes.Buffer{}
-	if _, err := a.EncodeBatch(buf, arr, amf.Amf0); err != nil {
-		return nil, err
+	if objectEncoding != amf.Amf3 {
+		if _, err := a.EncodeBatch(buf, arr, amf.Amf0); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	buf.WriteByte(0x00)
+	for _, v := range arr {
+		switch v.(type) {
+		case amf.AmfObject, *amf.AmfTypedObject:
+			if _, err := a.EncodeAvmplus(buf, v); err != nil {
+				return nil, err
+			}
+		default:
+			if _, err := a.Encode(buf, v, amf.Amf0); err != nil {
+				return nil, err
+			}
+		}
 	}
 	return buf.Bytes(), nil
 }
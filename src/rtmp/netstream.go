@@ -1,15 +1,248 @@
 package rtmp
 
 import (
-	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
 	"github.com/zhyoulun/gls/src/amf"
+	"github.com/zhyoulun/gls/src/av"
+	"sync"
+	"sync/atomic"
 )
 
+//NetStreamHandler is told about the NetStreams of a server conn, it is called by the goroutine of Serve only
+type NetStreamHandler interface {
+	//HandlePublish is called before the publish start is sent, an error is sent as NetStream.Publish.BadName,
+	//or NetStream.Record.NoAccess for core.ErrorNoAccess, and closes the conn
+	HandlePublish(ns *NetStream) error
+	//HandlePlay is called before the play start is sent to find the live or recorded stream, nothing may be written to ns until HandlePlayStart,
+	//an error is sent as NetStream.Play.StreamNotFound or NetStream.Play.Failed instead of the play start and closes the conn
+	HandlePlay(ns *NetStream) error
+	//HandlePlayStart is called after the play start is sent, the packets are written to ns from then on
+	HandlePlayStart(ns *NetStream)
+	//HandleSwitch is called for play2 after NetStream.Play.Transition is sent, the stream name of ns is the new one,
+	//the player should move to it at the next keyframe and call PlayTransitionComplete.
+	//an error is sent as NetStream.Play.StreamNotFound or NetStream.Play.Failed and closes the conn
+	HandleSwitch(ns *NetStream, oldStreamName string) error
+	//HandlePacket is called for the packets of the publishing NetStream
+	HandlePacket(ns *NetStream, p *av.Packet) error
+	//HandleClose is called when the NetStream stops publishing or playing,
+	//err is nil for FCUnpublish, deleteStream and closeStream, or why the conn fails
+	HandleClose(ns *NetStream, err error)
+}
+
+//NetStream is created by createStream and keyed by its message stream id,
+//one NetConnection may publish and play several streams at the same time
+type NetStream struct {
+	conn *Conn
+	id   uint32 //message stream id
+
+	nameMutex  *sync.Mutex //guards streamName, which is changed by play2 on the goroutine of Serve while the player reads it
+	streamName string
+	isPublish  bool
+	started    bool //publishing or playing, cleared by FCUnpublish, deleteStream and closeStream
+
+	publishingType string //the argument of publish, set before HandlePublish
+
+	//the arguments of play, set before HandlePlay
+	playStart    float64 //seconds, PlayStartLiveOrRecorded, PlayStartLive or the offset of the recorded stream
+	playDuration float64 //seconds, or PlayDurationAll
+	playReset    bool    //NetStream.Play.Reset is sent, gls keeps no playlist, a play always replaces the current one
+
+	paused   int32 //set by the pause command of the player, atomic
+	audioOff int32 //set by receiveAudio false, atomic
+	videoOff int32 //set by receiveVideo false, atomic
+}
+
+func newNetStream(conn *Conn, id uint32) *NetStream {
+	return &NetStream{
+		conn:           conn,
+		id:             id,
+		nameMutex:      &sync.Mutex{},
+		publishingType: PublishingTypeLive,
+		playStart:      PlayStartLiveOrRecorded,
+		playDuration:   PlayDurationAll,
+		playReset:      true,
+	}
+}
+
+func (ns *NetStream) ID() uint32 {
+	return ns.id
+}
+
+func (ns *NetStream) GetStreamName() string {
+	ns.nameMutex.Lock()
+	defer ns.nameMutex.Unlock()
+	return ns.streamName
+}
+
+func (ns *NetStream) setStreamName(streamName string) {
+	ns.nameMutex.Lock()
+	defer ns.nameMutex.Unlock()
+	ns.streamName = streamName
+}
+
+func (ns *NetStream) IsPublish() bool {
+	return ns.isPublish
+}
+
+func (ns *NetStream) GetConnInfo() ConnectCommentObject {
+	return ns.conn.connInfo
+}
+
+func (ns *NetStream) Conn() *Conn {
+	return ns.conn
+}
+
+func (ns *NetStream) String() string {
+	return fmt.Sprintf("id: %d, streamName: %s, isPublish: %t, remote addr: %s",
+		ns.id, ns.GetStreamName(), ns.isPublish, ns.conn.NetConn().RemoteAddr())
+}
+
+//PublishingType is the type argument of publish, PublishingTypeLive, PublishingTypeRecord or PublishingTypeAppend
+func (ns *NetStream) PublishingType() string {
+	return ns.publishingType
+}
+
+//IsRecord reports whether the publishing is recorded, by PublishingTypeRecord or PublishingTypeAppend
+func (ns *NetStream) IsRecord() bool {
+	return ns.publishingType == PublishingTypeRecord || ns.publishingType == PublishingTypeAppend
+}
+
+//PlayStart is the start argument of play in seconds, PlayStartLiveOrRecorded, PlayStartLive or the offset of the recorded stream
+func (ns *NetStream) PlayStart() float64 {
+	return ns.playStart
+}
+
+//PlayDuration is the duration argument of play in seconds, or PlayDurationAll
+func (ns *NetStream) PlayDuration() float64 {
+	return ns.playDuration
+}
+
+//IsPlayReset is the reset argument of play
+func (ns *NetStream) IsPlayReset() bool {
+	return ns.playReset
+}
+
+//IsPaused reports whether the player pauses, the packets should not be written to it
+func (ns *NetStream) IsPaused() bool {
+	return atomic.LoadInt32(&ns.paused) == 1
+}
+
+//IsReceiveAudio reports whether the player wants the audio, it is turned off by receiveAudio false
+func (ns *NetStream) IsReceiveAudio() bool {
+	return atomic.LoadInt32(&ns.audioOff) == 0
+}
+
+//IsReceiveVideo reports whether the player wants the video, it is turned off by receiveVideo false
+func (ns *NetStream) IsReceiveVideo() bool {
+	return atomic.LoadInt32(&ns.videoOff) == 0
+}
+
+//WritePacket writes p to the player, in the message stream of the NetStream
+func (ns *NetStream) WritePacket(p *av.Packet) error {
+	m, err := newMessage3(p)
+	if err != nil {
+		return err
+	}
+	m.cs.messageStreamID = ns.id
+	//a slow player is waited for by the acknowledgement, see Conn.WritePacket
+	if err := ns.conn.flow.wait(ns.conn.done, writeAckTimeout); err != nil {
+		return err
+	}
+	if err := ns.conn.writeMessage(m); err != nil {
+		return err
+	}
+	log.Tracef("write message: %s", m)
+	return nil
+}
+
+//UnpublishNotify tells the player that the publisher stops, the player is kept for the next publish
+func (ns *NetStream) UnpublishNotify() error {
+	if m, err := newUCMStreamEOF(ns.id); err != nil {
+		return err
+	} else {
+		if err := ns.conn.writeMessage(m); err != nil {
+			return err
+		}
+	}
+	if msg, err := newNetStreamResponseUnpublishNotify(ns.conn.objectEncoding()); err != nil {
+		return err
+	} else {
+		if err := ns.conn.writeCommandMessage(chunkStreamID5, ns.id, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//PublishNotify tells the player that the stream is published again
+func (ns *NetStream) PublishNotify() error {
+	if m, err := newUCMStreamBegin(ns.id); err != nil {
+		return err
+	} else {
+		if err := ns.conn.writeMessage(m); err != nil {
+			return err
+		}
+	}
+	if msg, err := newNetStreamResponsePublishNotify(ns.conn.objectEncoding()); err != nil {
+		return err
+	} else {
+		if err := ns.conn.writeCommandMessage(chunkStreamID5, ns.id, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//PlayStop tells the player that the stream ends, e.g. the duration of play is reached or the recorded stream ends,
+//the NetStream can play again
+func (ns *NetStream) PlayStop() error {
+	if m, err := newUCMStreamEOF(ns.id); err != nil {
+		return err
+	} else {
+		if err := ns.conn.writeMessage(m); err != nil {
+			return err
+		}
+	}
+	if msg, err := newNetStreamResponsePlayStop(ns.conn.objectEncoding()); err != nil {
+		return err
+	} else {
+		if err := ns.conn.writeCommandMessage(chunkStreamID5, ns.id, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//PlayTransitionComplete tells the player that the stream of play2 is switched to, before its first packet
+func (ns *NetStream) PlayTransitionComplete() error {
+	data, err := newNetStreamDataPlayTransitionComplete(ns.GetStreamName())
+	if err != nil {
+		return err
+	}
+	m, err := newDataMessage(chunkStreamID5, ns.id, data)
+	if err != nil {
+		return err
+	}
+	return ns.conn.writeMessage(m)
+}
+
+//reset stops the publishing or playing, the NetStream can publish or play again
+func (ns *NetStream) reset() {
+	ns.isPublish = false
+	ns.started = false
+	ns.publishingType = PublishingTypeLive
+	atomic.StoreInt32(&ns.paused, 0)
+	atomic.StoreInt32(&ns.audioOff, 0)
+	atomic.StoreInt32(&ns.videoOff, 0)
+}
+
 type netStreamStatusInfoObject struct {
 	level       string //the level for this message
 	code        string //the message code
 	description string //a human-readable description of the message
 	//the info object may contain other properties as appropriate to the code
+	details string //the stream name of the play transition
 }
 
 func newNetStreamStatusInfoObject(level, code, description string) *netStreamStatusInfoObject {
@@ -25,37 +258,192 @@ func (info *netStreamStatusInfoObject) toAmfObject() amf.AmfObject {
 	res["level"] = info.level
 	res["code"] = info.code
 	res["description"] = info.description
+	if info.details != "" {
+		res["details"] = info.details
+	}
 	return res
 }
 
-func newNetStreamResponsePublishStart() ([]byte, error) {
-	return newNetStreamResponseBase("NetStream.Publish.Start", "Start publishing.")
+func newNetStreamResponsePublishStart(objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseBase("NetStream.Publish.Start", "Start publishing.", objectEncoding)
+}
+
+func newNetStreamResponseRecordStart(objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseBase("NetStream.Record.Start", "Recording stream.", objectEncoding)
 }
 
-func newNetStreamResponsePlayReset() ([]byte, error) {
-	return newNetStreamResponseBase("NetStream.Play.Reset", "Playing and resetting stream.")
+func newNetStreamResponseRecordStop(objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseBase("NetStream.Record.Stop", "Stopped recording stream.", objectEncoding)
 }
 
-func newNetStreamResponsePlayStart() ([]byte, error) {
-	return newNetStreamResponseBase("NetStream.Play.Start", "Started playing stream.")
+func newNetStreamResponsePlayReset(objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseBase("NetStream.Play.Reset", "Playing and resetting stream.", objectEncoding)
 }
 
-func newNetStreamResponseBase(code, description string) ([]byte, error) {
-	infoObject := newNetStreamStatusInfoObject(netStreamStatusLevelStatus, code, description).toAmfObject()
+func newNetStreamResponsePlayStart(objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseBase("NetStream.Play.Start", "Started playing stream.", objectEncoding)
+}
+
+func newNetStreamResponsePlayStop(objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseBase("NetStream.Play.Stop", "Stopped playing stream.", objectEncoding)
+}
+
+func newNetStreamResponsePlayTransition(streamName string, objectEncoding amf.AmfVersion) ([]byte, error) {
+	info := newNetStreamStatusInfoObject(netStreamStatusLevelStatus, "NetStream.Play.Transition", fmt.Sprintf("Transition to %s.", streamName))
+	info.details = streamName
+	return newNetStreamResponseInfo(info, objectEncoding)
+}
+
+//onPlayStatus is a data message, which is always amf0
+func newNetStreamDataPlayTransitionComplete(streamName string) ([]byte, error) {
+	info := newNetStreamStatusInfoObject(netStreamStatusLevelStatus, "NetStream.Play.TransitionComplete", fmt.Sprintf("Transition to %s complete.", streamName))
+	info.details = streamName
+	return newNetConnectionResponseBase(amf.AmfArray{commandNetStreamOnPlayStatus, info.toAmfObject()}, amf.Amf0)
+}
+
+func newNetStreamResponseUnpublishNotify(objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseBase("NetStream.Play.UnpublishNotify", "Stream is unpublished.", objectEncoding)
+}
+
+func newNetStreamResponsePublishNotify(objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseBase("NetStream.Play.PublishNotify", "Stream is published.", objectEncoding)
+}
+
+func newNetStreamResponseUnpublishSuccess(objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseBase("NetStream.Unpublish.Success", "Stop publishing.", objectEncoding)
+}
+
+func newNetStreamResponseSeekNotify(objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseBase("NetStream.Seek.Notify", "Seeking.", objectEncoding)
+}
+
+func newNetStreamResponsePauseNotify(objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseBase("NetStream.Pause.Notify", "Paused stream.", objectEncoding)
+}
+
+func newNetStreamResponseUnpauseNotify(objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseBase("NetStream.Unpause.Notify", "Unpaused stream.", objectEncoding)
+}
+
+//the error level onStatus are sent before the conn is closed, the description tells why
+func newNetStreamResponsePublishBadName(description string, objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseError("NetStream.Publish.BadName", description, objectEncoding)
+}
+
+func newNetStreamResponseRecordNoAccess(description string, objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseError("NetStream.Record.NoAccess", description, objectEncoding)
+}
+
+func newNetStreamResponsePlayStreamNotFound(description string, objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseError("NetStream.Play.StreamNotFound", description, objectEncoding)
+}
+
+func newNetStreamResponsePlayFailed(description string, objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseError("NetStream.Play.Failed", description, objectEncoding)
+}
+
+func newNetStreamCommandPublish(transactionID float64, publishingName, publishingType string) ([]byte, error) {
+	command := amf.AmfArray{
+		commandNetStreamPublish,
+		transactionID,
+		nil,
+		publishingName,
+		publishingType,
+	}
+	return newNetConnectionResponseBase(command, amf.Amf0)
+}
+
+//start and duration in seconds, see PlayStartLiveOrRecorded and PlayDurationAll, reset is true by default
+func newNetStreamCommandPlay(transactionID float64, streamName string, start, duration float64) ([]byte, error) {
+	command := amf.AmfArray{
+		commandNetStreamPlay,
+		transactionID,
+		nil,
+		streamName,
+		start,
+		duration,
+	}
+	return newNetConnectionResponseBase(command, amf.Amf0)
+}
+
+func newNetStreamCommandGetStreamLength(transactionID float64, streamName string) ([]byte, error) {
+	command := amf.AmfArray{
+		commandGetStreamLength,
+		transactionID,
+		nil,
+		streamName,
+	}
+	return newNetConnectionResponseBase(command, amf.Amf0)
+}
+
+func newNetStreamCommandPause(transactionID float64, pause bool, milliSeconds uint32) ([]byte, error) {
+	command := amf.AmfArray{
+		commandNetStreamPause,
+		transactionID,
+		nil,
+		pause,
+		milliSeconds,
+	}
+	return newNetConnectionResponseBase(command, amf.Amf0)
+}
+
+//receiveAudio or receiveVideo
+func newNetStreamCommandReceive(commandName string, transactionID float64, flag bool) ([]byte, error) {
+	command := amf.AmfArray{
+		commandName,
+		transactionID,
+		nil,
+		flag,
+	}
+	return newNetConnectionResponseBase(command, amf.Amf0)
+}
+
+func newNetStreamCommandDeleteStream(transactionID float64, messageStreamID uint32) ([]byte, error) {
+	command := amf.AmfArray{
+		commandNetStreamDeleteStream,
+		transactionID,
+		nil,
+		messageStreamID,
+	}
+	return newNetConnectionResponseBase(command, amf.Amf0)
+}
+
+func newNetStreamResponseBase(code, description string, objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseLevel(netStreamStatusLevelStatus, code, description, objectEncoding)
+}
+
+func newNetStreamResponseError(code, description string, objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseLevel(netStreamStatusLevelError, code, description, objectEncoding)
+}
+
+func newNetStreamResponseLevel(level, code, description string, objectEncoding amf.AmfVersion) ([]byte, error) {
+	return newNetStreamResponseInfo(newNetStreamStatusInfoObject(level, code, description), objectEncoding)
+}
+
+func newNetStreamResponseInfo(info *netStreamStatusInfoObject, objectEncoding amf.AmfVersion) ([]byte, error) {
 	command := amf.AmfArray{
 		commandNetStreamOnStatus,
 		transactionID0,
 		nil,
-		infoObject,
+		info.toAmfObject(),
 	}
+	return newNetConnectionResponseBase(command, objectEncoding)
+}
 
-	a, err := amf.NewAmf()
-	if err != nil {
-		return nil, err
-	}
-	buf := &bytes.Buffer{}
-	if _, err := a.EncodeBatch(buf, command, amf.Amf0); err != nil {
-		return nil, err
+//play2 with transition switch, start and len are the defaults
+func newNetStreamCommandPlay2(transactionID float64, streamName, oldStreamName string) ([]byte, error) {
+	command := amf.AmfArray{
+		commandNetStreamPlay2,
+		transactionID,
+		nil,
+		amf.AmfObject{
+			"streamName":    streamName,
+			"oldStreamName": oldStreamName,
+			"start":         float64(PlayStartLiveOrRecorded),
+			"len":           float64(PlayDurationAll),
+			"offset":        float64(-1),
+			"transition":    transitionSwitch,
+		},
 	}
-	return buf.Bytes(), nil
+	return newNetConnectionResponseBase(command, amf.Amf0)
 }
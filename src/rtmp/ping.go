@@ -0,0 +1,69 @@
+package rtmp
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync/atomic"
+	"time"
+)
+
+//StartPing sends a ping request every interval,
+//the conn is closed when maxMissed pings in a row are not responded, so that a dead peer is removed.
+//ping responses are handled while reading the conn
+func (c *Conn) StartPing(interval time.Duration, maxMissed int) {
+	go c.pingCycle(interval, maxMissed)
+}
+
+func (c *Conn) pingCycle(interval time.Duration, maxMissed int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if missed := atomic.LoadInt32(&c.pingMissed); int(missed) >= maxMissed {
+			log.Warnf("ping missed %d times, close conn, remote addr: %s", missed, c.conn.RemoteAddr())
+			if err := c.Close(); err != nil {
+				log.Warnf("conn Close err: %s", err)
+			}
+			return
+		}
+		m, err := newUCMPingRequest(c.pingTimestamp())
+		if err != nil {
+			log.Errorf("new ping request err: %s", err)
+			return
+		}
+		atomic.AddInt32(&c.pingMissed, 1)
+		if err := c.writeMessage(m); err != nil {
+			log.Warnf("write ping request err: %s", err)
+			return
+		}
+	}
+}
+
+//RTT returns the round trip time measured by the last ping, 0 if there is no ping response yet
+func (c *Conn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+//milliseconds since the conn is created
+func (c *Conn) pingTimestamp() uint32 {
+	return uint32(time.Since(c.startTime) / time.Millisecond)
+}
+
+//the response echoes the timestamp of the request
+func (c *Conn) handlePingRequest(timestamp uint32) error {
+	m, err := newUCMPingResponse(timestamp)
+	if err != nil {
+		return err
+	}
+	return c.writeMessage(m)
+}
+
+func (c *Conn) handlePingResponse(timestamp uint32) {
+	atomic.StoreInt32(&c.pingMissed, 0)
+	rtt := time.Duration(c.pingTimestamp()-timestamp) * time.Millisecond
+	atomic.StoreInt64(&c.rtt, int64(rtt))
+	log.Debugf("ping response, rtt: %s, remote addr: %s", rtt, c.conn.RemoteAddr())
+}
@@ -0,0 +1,74 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+//readUserControlMessage reads the next user control message, returns the event type and the event data
+func readUserControlMessage(t *testing.T, c *Conn) (uint16, []byte) {
+	for {
+		m, err := c.readMessage()
+		if !assert.NoError(t, err) {
+			return 0, nil
+		}
+		if m.getMessageTypeID() == typeUserControl {
+			return binary.BigEndian.Uint16(m.GetData()), m.GetData()[2:]
+		}
+	}
+}
+
+func TestConn_handleMessage_ping(t *testing.T) {
+	{
+		//ping request is responded with the same timestamp
+		out := &bytes.Buffer{}
+		c, _ := NewConn(newBufferConn(&bytes.Buffer{}, out))
+		assert.NoError(t, c.handleMessage(chunkStreamID2, messageStreamID0, typeUserControl, []byte{0, EventPingRequest, 0, 0, 0x12, 0x34}, 0))
+		peer, _ := NewConn(newBufferConn(out, &bytes.Buffer{}))
+		eventType, data := readUserControlMessage(t, peer)
+		assert.Equal(t, uint16(EventPingResponse), eventType)
+		assert.Equal(t, []byte{0, 0, 0x12, 0x34}, data)
+	}
+	{
+		//ping response resets the missed count and sets the rtt
+		c, _ := NewConn(newBufferConn(&bytes.Buffer{}, &bytes.Buffer{}))
+		c.startTime = time.Now().Add(-time.Second)
+		c.pingMissed = 2
+		assert.NoError(t, c.handleMessage(chunkStreamID2, messageStreamID0, typeUserControl, []byte{0, EventPingResponse, 0, 0, 0x01, 0xf4}, 0))
+		assert.Equal(t, int32(0), c.pingMissed)
+		assert.True(t, c.RTT() >= 500*time.Millisecond && c.RTT() < time.Second, c.RTT())
+	}
+	{
+		//other events are ignored
+		c, _ := NewConn(newBufferConn(&bytes.Buffer{}, &bytes.Buffer{}))
+		assert.NoError(t, c.handleMessage(chunkStreamID2, messageStreamID0, typeUserControl, []byte{0, EventSetBufferLength, 0, 0, 0, 1, 0, 0, 0x0b, 0xb8}, 0))
+	}
+	{
+		c, _ := NewConn(newBufferConn(&bytes.Buffer{}, &bytes.Buffer{}))
+		assert.Error(t, c.handleMessage(chunkStreamID2, messageStreamID0, typeUserControl, []byte{0}, 0))
+		assert.Error(t, c.handleMessage(chunkStreamID2, messageStreamID0, typeUserControl, []byte{0, EventPingRequest, 0}, 0))
+	}
+}
+
+func TestConn_StartPing(t *testing.T) {
+	out := &bytes.Buffer{}
+	c, _ := NewConn(newBufferConn(&bytes.Buffer{}, out))
+	c.StartPing(10*time.Millisecond, 2)
+	//nobody responds, the conn is closed after 2 pings
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "conn is not closed")
+		return
+	}
+	peer, _ := NewConn(newBufferConn(out, &bytes.Buffer{}))
+	for i := 0; i < 2; i++ {
+		eventType, data := readUserControlMessage(t, peer)
+		assert.Equal(t, uint16(EventPingRequest), eventType)
+		assert.Equal(t, 4, len(data))
+	}
+	assert.NoError(t, c.Close())
+}
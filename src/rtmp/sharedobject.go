@@ -0,0 +1,290 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zhyoulun/gls/src/amf"
+	"github.com/zhyoulun/gls/src/core"
+	"github.com/zhyoulun/gls/src/utils"
+	"io"
+)
+
+//shared object event type
+const (
+	SharedObjectEventUse           = 1  //client -> server
+	SharedObjectEventRelease       = 2  //client -> server
+	SharedObjectEventRequestChange = 3  //client -> server, the key and the value
+	SharedObjectEventChange        = 4  //server -> client, the key and the value changed by another client
+	SharedObjectEventSuccess       = 5  //server -> client, the key of the request change accepted
+	SharedObjectEventSendMessage   = 6  //client -> server -> clients, the method name and the arguments
+	SharedObjectEventStatus        = 7  //server -> client, the message and the level
+	SharedObjectEventClear         = 8  //server -> client, sent after use success, before the initial changes
+	SharedObjectEventRemove        = 9  //server -> client, the key removed
+	SharedObjectEventRequestRemove = 10 //client -> server, the key
+	SharedObjectEventUseSuccess    = 11 //server -> client
+)
+
+//the first 4 bytes of the flags, the other 4 bytes are reserved
+const sharedObjectFlagPersistent = 2
+
+//SharedObjectHandler keeps the remote shared objects, it is called by the goroutine of Serve of each conn
+type SharedObjectHandler interface {
+	//HandleSharedObject is called for the shared object messages from the client, an error closes the conn
+	HandleSharedObject(conn *Conn, m *SharedObjectMessage) error
+	//HandleSharedObjectClose is called when Serve returns, the shared objects used by conn are released
+	HandleSharedObjectClose(conn *Conn)
+}
+
+//SharedObjectMessage is the message of type 19, or type 16 with a leading 0x00 byte
+//name(UTF-8 with 2 bytes length) + version(4 bytes) + flags(8 bytes) + events
+type SharedObjectMessage struct {
+	Name       string
+	Version    uint32
+	Persistent bool
+	Events     []*SharedObjectEvent
+}
+
+//SharedObjectEvent is event type(1 byte) + event data length(4 bytes) + event data,
+//a change or request change with several key value pairs is split into one event each
+type SharedObjectEvent struct {
+	Type  uint8
+	Key   string        //change, request change, success, remove and request remove, or the message of status
+	Value interface{}   //change and request change, or the level of status
+	Args  []interface{} //send message, the method name and the arguments
+}
+
+func (e *SharedObjectEvent) String() string {
+	return fmt.Sprintf("type: %d, key: %s, value: %v, args: %v", e.Type, e.Key, e.Value, e.Args)
+}
+
+//SetSharedObjectHandler sets the keeper of the shared objects, it must be called before Serve
+func (c *Conn) SetSharedObjectHandler(h SharedObjectHandler) {
+	c.sharedObjectHandler = h
+}
+
+//WriteSharedObjectMessage writes m encoded in the negotiated amf version
+func (c *Conn) WriteSharedObjectMessage(m *SharedObjectMessage) error {
+	var typeID uint8 = typeSharedObjectAMF0
+	buf := &bytes.Buffer{}
+	if c.objectEncoding() == amf.Amf3 {
+		typeID = typeSharedObjectAMF3
+		buf.WriteByte(0x00)
+	}
+	if err := encodeSharedObjectMessage(buf, m); err != nil {
+		return err
+	}
+	msg, err := newMessage2(chunkStreamID3, 0, uint32(buf.Len()), typeID, messageStreamID0)
+	if err != nil {
+		return err
+	}
+	if err := msg.cs.writeToData(buf.Bytes()); err != nil {
+		return err
+	}
+	return c.writeMessage(msg)
+}
+
+func (c *Conn) handleSharedObjectMessage(typeID uint8, data []byte) error {
+	m, err := decodeSharedObjectMessage(typeID, data)
+	if err != nil {
+		return err
+	}
+	if c.sharedObjectHandler == nil {
+		log.Debugf("handle shared object message, no handler, ignore: %s", m.Name)
+		return nil
+	}
+	return c.sharedObjectHandler.HandleSharedObject(c, m)
+}
+
+//decodeSharedObjectMessage decodes the message of type 16 or 19, the values are amf0,
+//which may switch to amf3 by the avmplus-object-marker
+func decodeSharedObjectMessage(typeID uint8, data []byte) (*SharedObjectMessage, error) {
+	if typeID == typeSharedObjectAMF3 && len(data) > 0 && data[0] == 0x00 {
+		data = data[1:]
+	}
+	r := bytes.NewReader(data)
+	m := &SharedObjectMessage{}
+	var err error
+	if m.Name, err = readSharedObjectString(r); err != nil {
+		return nil, errors.Wrap(err, "read shared object name")
+	}
+	if m.Version, err = utils.ReadUintBE(r, 4); err != nil {
+		return nil, errors.Wrap(err, "read shared object version")
+	}
+	flags, err := utils.ReadBytes(r, 8)
+	if err != nil {
+		return nil, errors.Wrap(err, "read shared object flags")
+	}
+	m.Persistent = flags[3] == sharedObjectFlagPersistent
+	for r.Len() > 0 {
+		eventType, err := utils.ReadByte(r)
+		if err != nil {
+			return nil, err
+		}
+		length, err := utils.ReadUintBE(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		eventData, err := readSharedObjectBytes(r, int(length))
+		if err != nil {
+			return nil, errors.Wrapf(core.ErrorInvalidData, "shared object event data, length: %d", length)
+		}
+		events, err := decodeSharedObjectEvent(eventType, eventData)
+		if err != nil {
+			return nil, err
+		}
+		m.Events = append(m.Events, events...)
+	}
+	return m, nil
+}
+
+func decodeSharedObjectEvent(eventType uint8, data []byte) ([]*SharedObjectEvent, error) {
+	r := bytes.NewReader(data)
+	amfDecoder, err := amf.NewAmf()
+	if err != nil {
+		return nil, err
+	}
+	switch eventType {
+	case SharedObjectEventUse, SharedObjectEventRelease, SharedObjectEventClear, SharedObjectEventUseSuccess:
+		return []*SharedObjectEvent{{Type: eventType}}, nil
+	case SharedObjectEventRequestChange, SharedObjectEventChange:
+		var events []*SharedObjectEvent
+		for r.Len() > 0 {
+			key, err := readSharedObjectString(r)
+			if err != nil {
+				return nil, err
+			}
+			value, err := amfDecoder.Decode(r, amf.Amf0)
+			if err != nil {
+				return nil, errors.Wrapf(err, "decode value of %s", key)
+			}
+			events = append(events, &SharedObjectEvent{Type: eventType, Key: key, Value: value})
+		}
+		return events, nil
+	case SharedObjectEventSuccess, SharedObjectEventRemove, SharedObjectEventRequestRemove:
+		key, err := readSharedObjectString(r)
+		if err != nil {
+			return nil, err
+		}
+		return []*SharedObjectEvent{{Type: eventType, Key: key}}, nil
+	case SharedObjectEventSendMessage:
+		args, err := amfDecoder.DecodeBatch(r, amf.Amf0)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode send message")
+		}
+		return []*SharedObjectEvent{{Type: eventType, Args: args}}, nil
+	case SharedObjectEventStatus:
+		message, err := readSharedObjectString(r)
+		if err != nil {
+			return nil, err
+		}
+		level, err := readSharedObjectString(r)
+		if err != nil {
+			return nil, err
+		}
+		return []*SharedObjectEvent{{Type: eventType, Key: message, Value: level}}, nil
+	}
+	log.Warnf("unknown shared object event type: %d", eventType)
+	return nil, nil
+}
+
+func encodeSharedObjectMessage(w io.Writer, m *SharedObjectMessage) error {
+	if err := writeSharedObjectString(w, m.Name); err != nil {
+		return err
+	}
+	if err := utils.WriteUintBE(w, m.Version, 4); err != nil {
+		return err
+	}
+	var flag uint32
+	if m.Persistent {
+		flag = sharedObjectFlagPersistent
+	}
+	if err := utils.WriteUintBE(w, flag, 4); err != nil {
+		return err
+	}
+	if err := utils.WriteUintBE(w, 0, 4); err != nil {
+		return err
+	}
+	for _, e := range m.Events {
+		data, err := encodeSharedObjectEvent(e)
+		if err != nil {
+			return err
+		}
+		if err := utils.WriteByte(w, e.Type); err != nil {
+			return err
+		}
+		if err := utils.WriteUintBE(w, uint32(len(data)), 4); err != nil {
+			return err
+		}
+		if err := utils.WriteBytes(w, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeSharedObjectEvent(e *SharedObjectEvent) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	amfEncoder, err := amf.NewAmf()
+	if err != nil {
+		return nil, err
+	}
+	switch e.Type {
+	case SharedObjectEventRequestChange, SharedObjectEventChange:
+		if err := writeSharedObjectString(buf, e.Key); err != nil {
+			return nil, err
+		}
+		if _, err := amfEncoder.Encode(buf, e.Value, amf.Amf0); err != nil {
+			return nil, err
+		}
+	case SharedObjectEventSuccess, SharedObjectEventRemove, SharedObjectEventRequestRemove:
+		if err := writeSharedObjectString(buf, e.Key); err != nil {
+			return nil, err
+		}
+	case SharedObjectEventSendMessage:
+		if _, err := amfEncoder.EncodeBatch(buf, e.Args, amf.Amf0); err != nil {
+			return nil, err
+		}
+	case SharedObjectEventStatus:
+		level, _ := e.Value.(string)
+		if err := writeSharedObjectString(buf, e.Key); err != nil {
+			return nil, err
+		}
+		if err := writeSharedObjectString(buf, level); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+//UTF-8 with 2 bytes length, no amf marker
+func readSharedObjectString(r io.Reader) (string, error) {
+	length, err := utils.ReadUintBE(r, 2)
+	if err != nil {
+		return "", err
+	}
+	buf, err := readSharedObjectBytes(r, int(length))
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+//the event data and the strings may be empty, e.g. use at the end of the message
+func readSharedObjectBytes(r io.Reader, n int) ([]byte, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	return utils.ReadBytes(r, n)
+}
+
+func writeSharedObjectString(w io.Writer, s string) error {
+	if len(s) > 0xffff {
+		return errors.Wrapf(core.ErrorInvalidData, "shared object string too long, length: %d", len(s))
+	}
+	if err := utils.WriteUintBE(w, uint32(len(s)), 2); err != nil {
+		return err
+	}
+	return utils.WriteBytes(w, []byte(s))
+}
@@ -0,0 +1,50 @@
+package rtmp
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhyoulun/gls/src/amf"
+	"testing"
+)
+
+func Test_encodeSharedObjectMessage(t *testing.T) {
+	m := &SharedObjectMessage{
+		Name:       "chat",
+		Version:    3,
+		Persistent: true,
+		Events: []*SharedObjectEvent{
+			{Type: SharedObjectEventUse},
+			{Type: SharedObjectEventRequestChange, Key: "topic", Value: "gls"},
+			{Type: SharedObjectEventSendMessage, Args: []interface{}{"onMessage", "hello", float64(1)}},
+			{Type: SharedObjectEventStatus, Key: "SharedObject.NoWriteAccess", Value: netStreamStatusLevelError},
+			{Type: SharedObjectEventRequestRemove, Key: "topic"},
+		},
+	}
+	buf := &bytes.Buffer{}
+	assert.NoError(t, encodeSharedObjectMessage(buf, m))
+	assert.Equal(t, []byte{0x00, 0x04, 'c', 'h', 'a', 't', 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, SharedObjectEventUse, 0x00, 0x00, 0x00, 0x00}, buf.Bytes()[:23])
+	got, err := decodeSharedObjectMessage(typeSharedObjectAMF0, buf.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, m, got)
+
+	//the amf3 message starts with 0x00
+	got, err = decodeSharedObjectMessage(typeSharedObjectAMF3, append([]byte{0x00}, buf.Bytes()...))
+	assert.NoError(t, err)
+	assert.Equal(t, m, got)
+}
+
+//several key value pairs in one request change are split
+func Test_decodeSharedObjectEvent_requestChange(t *testing.T) {
+	data := &bytes.Buffer{}
+	a, _ := amf.NewAmf()
+	_ = writeSharedObjectString(data, "x")
+	_, _ = a.Encode(data, float64(1), amf.Amf0)
+	_ = writeSharedObjectString(data, "y")
+	_, _ = a.Encode(data, amf.AmfObject{"z": true}, amf.Amf0)
+	events, err := decodeSharedObjectEvent(SharedObjectEventRequestChange, data.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, []*SharedObjectEvent{
+		{Type: SharedObjectEventRequestChange, Key: "x", Value: float64(1)},
+		{Type: SharedObjectEventRequestChange, Key: "y", Value: amf.AmfObject{"z": true}},
+	}, events)
+}
@@ -0,0 +1,18 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+//ListenTLS listens on addr for rtmps, the conns accepted are decrypted tls conns
+func ListenTLS(addr, certFile, keyFile string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	return tls.Listen("tcp", addr, config)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zhyoulun/gls/src/av"
+	"github.com/zhyoulun/gls/src/core"
+	"github.com/zhyoulun/gls/src/rtmp"
+	"github.com/zhyoulun/gls/src/stream"
+)
+
+//netStreamHandler attaches the NetStreams of one conn to the streams,
+//it is called by the goroutine of rtmp.Conn.Serve only
+type netStreamHandler struct {
+	sources map[uint32]*stream.Source //keyed by the message stream id
+	players map[uint32]stream.Player  //the live or recorded stream played
+}
+
+func newNetStreamHandler() *netStreamHandler {
+	return &netStreamHandler{
+		sources: make(map[uint32]*stream.Source),
+		players: make(map[uint32]stream.Player),
+	}
+}
+
+func (h *netStreamHandler) HandlePublish(ns *rtmp.NetStream) error {
+	source, err := stream.Mgr.HandlePublish(ns)
+	if err != nil {
+		return err
+	}
+	log.Infof("publish, NetStream: %s", ns)
+	h.sources[ns.ID()] = source
+	return nil
+}
+
+func (h *netStreamHandler) HandlePlay(ns *rtmp.NetStream) error {
+	player, err := stream.Mgr.HandlePlay(ns)
+	if err != nil {
+		return err
+	}
+	log.Infof("play, NetStream: %s", ns)
+	h.players[ns.ID()] = player
+	return nil
+}
+
+//HandlePlayStart runs the player found by HandlePlay
+func (h *netStreamHandler) HandlePlayStart(ns *rtmp.NetStream) {
+	if player, ok := h.players[ns.ID()]; ok {
+		player.Run()
+	}
+}
+
+//HandleSwitch moves the sink of the live stream to the new stream, a recorded stream can not be switched
+func (h *netStreamHandler) HandleSwitch(ns *rtmp.NetStream, oldStreamName string) error {
+	sink, ok := h.players[ns.ID()].(*stream.Sink)
+	if !ok {
+		return errors.Wrapf(core.ErrorNotSupported, "switch from %s, not a live stream", oldStreamName)
+	}
+	log.Infof("switch from %s, NetStream: %s", oldStreamName, ns)
+	return stream.Mgr.HandleSwitch(sink, ns)
+}
+
+func (h *netStreamHandler) HandlePacket(ns *rtmp.NetStream, p *av.Packet) error {
+	if source, ok := h.sources[ns.ID()]; ok {
+		source.ReceivePacket(p)
+	}
+	return nil
+}
+
+//the source is closed with err, its players are closed too if the publisher fails
+func (h *netStreamHandler) HandleClose(ns *rtmp.NetStream, err error) {
+	if source, ok := h.sources[ns.ID()]; ok {
+		source.Close(err)
+		delete(h.sources, ns.ID())
+	}
+	if player, ok := h.players[ns.ID()]; ok {
+		player.Remove()
+		delete(h.players, ns.ID())
+	}
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zhyoulun/gls/src/core"
+	"github.com/zhyoulun/gls/src/utils"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//rtmpt: rtmp tunneled over http
+//1. client -> server: POST /open/1, server -> client: session id
+//2. client -> server: POST /send/<session id>/<sequence>, with the rtmp bytes as the body
+//3. client -> server: POST /idle/<session id>/<sequence>, polling when the client has nothing to send
+//4. client -> server: POST /close/<session id>/<sequence>
+//the response of send and idle is one byte of polling interval followed by the rtmp bytes for the client
+const (
+	rtmptContentType     = "application/x-fcs"
+	rtmptMinPollInterval = 0x01
+	rtmptMaxPollInterval = 0x21
+	rtmptSessionTimeout  = 30 * time.Second
+	rtmptMaxOutputSize   = 8 * 1024 * 1024 //the bytes not polled yet, a client polling slower than the stream is closed
+)
+
+type RTMPTHandler struct {
+	server *Server
+
+	sessionsMutex *sync.Mutex
+	sessions      map[string]*rtmptSession
+}
+
+func NewRTMPTHandler(server *Server) *RTMPTHandler {
+	return &RTMPTHandler{
+		server:        server,
+		sessionsMutex: &sync.Mutex{},
+		sessions:      make(map[string]*rtmptSession),
+	}
+}
+
+func (h *RTMPTHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	//"", command, session id, sequence
+	items := strings.Split(r.URL.Path, "/")
+	if len(items) < 3 {
+		http.NotFound(w, r)
+		return
+	}
+	switch items[1] {
+	case "open":
+		h.handleOpen(w, r)
+	case "send", "idle", "close":
+		s := h.getSession(items[2])
+		if s == nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.touch()
+		switch items[1] {
+		case "send":
+			h.handleSend(w, r, s)
+		case "idle":
+			h.handleIdle(w, s)
+		case "close":
+			h.handleClose(w, s)
+		}
+	default:
+		//e.g. /fcs/ident2, the client goes on when it is not found
+		http.NotFound(w, r)
+	}
+}
+
+func (h *RTMPTHandler) handleOpen(w http.ResponseWriter, r *http.Request) {
+	s, err := h.newSession(r)
+	if err != nil {
+		log.Errorf("rtmpt new session err: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("rtmpt open session: %s, remote addr: %s", s.id, r.RemoteAddr)
+	go func() {
+		bufferedConn := utils.NewBufferedConn(s, core.Size4KB)
+		if err := h.server.handleConn(bufferedConn); err != nil {
+			log.Printf("handle rtmpt conn err: %s", err)
+		}
+	}()
+	w.Header().Set("Content-Type", rtmptContentType)
+	_, _ = fmt.Fprintf(w, "%s\n", s.id)
+}
+
+func (h *RTMPTHandler) handleSend(w http.ResponseWriter, r *http.Request, s *rtmptSession) {
+	//blocks until the rtmp conn reads all of them
+	if _, err := io.Copy(s.inWriter, r.Body); err != nil {
+		log.Warnf("rtmpt session %s send err: %s", s.id, err)
+		_ = s.Close()
+		http.NotFound(w, r)
+		return
+	}
+	h.writeResponse(w, s)
+}
+
+func (h *RTMPTHandler) handleIdle(w http.ResponseWriter, s *rtmptSession) {
+	h.writeResponse(w, s)
+}
+
+func (h *RTMPTHandler) handleClose(w http.ResponseWriter, s *rtmptSession) {
+	log.Infof("rtmpt close session: %s", s.id)
+	if err := s.Close(); err != nil {
+		log.Warnf("rtmpt session %s Close err: %s", s.id, err)
+	}
+	w.Header().Set("Content-Type", rtmptContentType)
+	_, _ = w.Write([]byte{0x00})
+}
+
+func (h *RTMPTHandler) writeResponse(w http.ResponseWriter, s *rtmptSession) {
+	interval, data := s.takeOutput()
+	w.Header().Set("Content-Type", rtmptContentType)
+	_, _ = w.Write([]byte{interval})
+	_, _ = w.Write(data)
+}
+
+func (h *RTMPTHandler) newSession(r *http.Request) (*rtmptSession, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	var localAddr net.Addr = rtmptAddr("")
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localAddr = addr
+	}
+	inReader, inWriter := io.Pipe()
+	s := &rtmptSession{
+		handler:      h,
+		id:           hex.EncodeToString(buf),
+		localAddr:    localAddr,
+		remoteAddr:   rtmptAddr(r.RemoteAddr),
+		inReader:     inReader,
+		inWriter:     inWriter,
+		outMutex:     &sync.Mutex{},
+		out:          &bytes.Buffer{},
+		pollInterval: rtmptMinPollInterval,
+	}
+	s.timer = time.AfterFunc(rtmptSessionTimeout, func() {
+		log.Infof("rtmpt session %s timeout", s.id)
+		_ = s.Close()
+	})
+
+	h.sessionsMutex.Lock()
+	defer h.sessionsMutex.Unlock()
+	h.sessions[s.id] = s
+	return s, nil
+}
+
+func (h *RTMPTHandler) getSession(id string) *rtmptSession {
+	h.sessionsMutex.Lock()
+	defer h.sessionsMutex.Unlock()
+	return h.sessions[id]
+}
+
+func (h *RTMPTHandler) deleteSession(id string) {
+	h.sessionsMutex.Lock()
+	defer h.sessionsMutex.Unlock()
+	delete(h.sessions, id)
+}
+
+//rtmptSession is the net.Conn seen by rtmp.Conn,
+//bytes in the body of send requests are read from it, bytes written to it go to the next send or idle response
+type rtmptSession struct {
+	handler    *RTMPTHandler
+	id         string
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	inReader *io.PipeReader
+	inWriter *io.PipeWriter
+
+	outMutex     *sync.Mutex
+	out          *bytes.Buffer
+	pollInterval byte
+	closed       bool
+
+	timer *time.Timer
+}
+
+func (s *rtmptSession) Read(b []byte) (int, error) {
+	return s.inReader.Read(b)
+}
+
+func (s *rtmptSession) Write(b []byte) (int, error) {
+	s.outMutex.Lock()
+	if s.closed {
+		s.outMutex.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if size := s.out.Len() + len(b); size > rtmptMaxOutputSize {
+		s.outMutex.Unlock()
+		log.Warnf("rtmpt session %s, %d bytes not polled, close", s.id, size)
+		_ = s.Close()
+		return 0, errors.Wrapf(core.ErrorClosed, "rtmpt session %s, %d bytes not polled", s.id, size)
+	}
+	defer s.outMutex.Unlock()
+	return s.out.Write(b)
+}
+
+//closed by the client, the rtmp conn or the timeout
+func (s *rtmptSession) Close() error {
+	s.handler.deleteSession(s.id)
+	s.outMutex.Lock()
+	s.closed = true
+	s.out.Reset()
+	s.outMutex.Unlock()
+	s.timer.Stop()
+	return s.inReader.Close()
+}
+
+//takeOutput returns the polling interval and the pending bytes,
+//the interval grows while there is nothing to send, so that idle clients poll less
+func (s *rtmptSession) takeOutput() (byte, []byte) {
+	s.outMutex.Lock()
+	defer s.outMutex.Unlock()
+	if s.out.Len() == 0 {
+		if s.pollInterval < rtmptMaxPollInterval {
+			s.pollInterval++
+		}
+		return s.pollInterval, nil
+	}
+	s.pollInterval = rtmptMinPollInterval
+	data := make([]byte, s.out.Len())
+	copy(data, s.out.Bytes())
+	s.out.Reset()
+	return s.pollInterval, data
+}
+
+func (s *rtmptSession) touch() {
+	s.timer.Reset(rtmptSessionTimeout)
+}
+
+func (s *rtmptSession) LocalAddr() net.Addr {
+	return s.localAddr
+}
+
+func (s *rtmptSession) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+//deadlines are controlled by the http server
+func (s *rtmptSession) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (s *rtmptSession) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (s *rtmptSession) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type rtmptAddr string
+
+func (a rtmptAddr) Network() string {
+	return "rtmpt"
+}
+
+func (a rtmptAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhyoulun/gls/src/core"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func rtmptPost(t *testing.T, url string, body []byte) (int, []byte) {
+	resp, err := http.Post(url, rtmptContentType, bytes.NewReader(body))
+	if !assert.NoError(t, err) {
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return resp.StatusCode, data
+}
+
+func TestRTMPTHandler(t *testing.T) {
+	s, _ := NewServer(nil)
+	ts := httptest.NewServer(NewRTMPTHandler(s))
+	defer ts.Close()
+
+	{
+		code, _ := rtmptPost(t, ts.URL+"/fcs/ident2", nil)
+		assert.Equal(t, http.StatusNotFound, code)
+	}
+	{
+		code, _ := rtmptPost(t, ts.URL+"/idle/not-exist/0", nil)
+		assert.Equal(t, http.StatusNotFound, code)
+	}
+	{
+		resp, err := http.Get(ts.URL + "/open/1")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+
+	code, data := rtmptPost(t, ts.URL+"/open/1", nil)
+	assert.Equal(t, http.StatusOK, code)
+	sessionID := strings.TrimSpace(string(data))
+	assert.NotEmpty(t, sessionID)
+
+	//c0 c1
+	c1 := make([]byte, 1536)
+	for i := 8; i < len(c1); i++ {
+		c1[i] = byte(i)
+	}
+	code, data = rtmptPost(t, fmt.Sprintf("%s/send/%s/1", ts.URL, sessionID), append([]byte{0x03}, c1...))
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, len(data) >= 1)
+
+	//poll s0 s1 s2
+	got := data[1:]
+	for i := 2; len(got) < 1+2*1536 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		code, data = rtmptPost(t, fmt.Sprintf("%s/idle/%s/%d", ts.URL, sessionID, i), nil)
+		assert.Equal(t, http.StatusOK, code)
+		assert.True(t, data[0] >= rtmptMinPollInterval && data[0] <= rtmptMaxPollInterval)
+		got = append(got, data[1:]...)
+	}
+	if !assert.Equal(t, 1+2*1536, len(got)) {
+		return
+	}
+	assert.Equal(t, byte(0x03), got[0])
+	s1 := got[1 : 1+1536]
+	s2 := got[1+1536:]
+	assert.Equal(t, c1[8:], s2[8:])
+
+	//c2
+	c2 := make([]byte, 1536)
+	copy(c2[8:], s1[8:])
+	code, _ = rtmptPost(t, fmt.Sprintf("%s/send/%s/100", ts.URL, sessionID), c2)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, data = rtmptPost(t, fmt.Sprintf("%s/close/%s/101", ts.URL, sessionID), nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []byte{0x00}, data)
+	code, _ = rtmptPost(t, fmt.Sprintf("%s/idle/%s/102", ts.URL, sessionID), nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+//the output is capped, a client polling slower than the stream is closed
+func TestRTMPTSession_Write_maxOutputSize(t *testing.T) {
+	h := NewRTMPTHandler(nil)
+	s, err := h.newSession(httptest.NewRequest(http.MethodPost, "/open/1", nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	n, err := s.Write(make([]byte, rtmptMaxOutputSize))
+	assert.NoError(t, err)
+	assert.Equal(t, rtmptMaxOutputSize, n)
+	_, err = s.Write([]byte{0x01})
+	assert.Equal(t, core.ErrorClosed, errors.Cause(err))
+	assert.Nil(t, h.getSession(s.id))
+	_, err = s.Write([]byte{0x01})
+	assert.Equal(t, io.ErrClosedPipe, err)
+}
@@ -4,22 +4,49 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/zhyoulun/gls/src/core"
 	"github.com/zhyoulun/gls/src/rtmp"
-	"github.com/zhyoulun/gls/src/stream"
 	"github.com/zhyoulun/gls/src/utils"
 	"net"
+	"time"
+)
+
+const (
+	defaultPingInterval  = 10 * time.Second
+	defaultPingMaxMissed = 3
 )
 
 type Server struct {
 	ln net.Listener
+
+	pingInterval  time.Duration //0 means ping is disabled
+	pingMaxMissed int
+
+	calls         map[string]rtmp.CallHandler //registered on every conn
+	sharedObjects *sharedObjects              //shared by all the conns
 }
 
 func NewServer(ln net.Listener) (*Server, error) {
 	server := &Server{
-		ln: ln,
+		ln:            ln,
+		pingInterval:  defaultPingInterval,
+		pingMaxMissed: defaultPingMaxMissed,
+		calls:         make(map[string]rtmp.CallHandler),
+		sharedObjects: newSharedObjects(),
 	}
 	return server, nil
 }
 
+//SetPing sets the ping interval and the number of missed pings after which the conn is closed,
+//interval 0 disables the ping
+func (s *Server) SetPing(interval time.Duration, maxMissed int) {
+	s.pingInterval = interval
+	s.pingMaxMissed = maxMissed
+}
+
+//RegisterCall registers a method the clients call with NetConnection.call, it must be called before Serve
+func (s *Server) RegisterCall(name string, h rtmp.CallHandler) {
+	s.calls[name] = h
+}
+
 func (s *Server) Serve() error {
 	for {
 		tcpConn, err := s.ln.Accept()
@@ -44,19 +71,13 @@ func (s *Server) handleConn(conn utils.PeekerConn) error {
 	if err := rtmpConn.Handshake(); err != nil {
 		return err
 	}
-	if err := rtmpConn.ReadHeader(); err != nil {
-		return err
+	if s.pingInterval > 0 {
+		rtmpConn.StartPing(s.pingInterval, s.pingMaxMissed)
 	}
-
-	if rtmpConn.IsPublish() {
-		if err := stream.Mgr.HandlePublish(rtmpConn); err != nil {
-			return err
-		}
-	} else {
-		if err := stream.Mgr.HandlePlay(rtmpConn); err != nil {
-			return err
-		}
+	for name, h := range s.calls {
+		rtmpConn.RegisterCall(name, h)
 	}
-
-	return nil
+	rtmpConn.SetSharedObjectHandler(s.sharedObjects)
+	defer rtmpConn.Close()
+	return rtmpConn.Serve(newNetStreamHandler())
 }
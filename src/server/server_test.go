@@ -0,0 +1,898 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhyoulun/gls/src/amf"
+	"github.com/zhyoulun/gls/src/av"
+	"github.com/zhyoulun/gls/src/core"
+	"github.com/zhyoulun/gls/src/flv"
+	"github.com/zhyoulun/gls/src/rtmp"
+	"github.com/zhyoulun/gls/src/stream"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//the stream manager is global, it is shared by all the tests
+func TestMain(m *testing.M) {
+	if err := stream.InitManager(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+//write a self-signed certificate for 127.0.0.1 into dir
+func writeSelfSignedCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"gls test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func dialTLS(t *testing.T, addr, rawurl string) *rtmp.Conn {
+	tlsConn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	c, err := rtmp.NewClientConn(tlsConn, rawurl)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	return c
+}
+
+func TestListenTLS(t *testing.T) {
+	{
+		_, err := ListenTLS("127.0.0.1:0", "not-exist.pem", "not-exist.pem")
+		assert.Error(t, err)
+	}
+
+	certFile, keyFile := writeSelfSignedCert(t, t.TempDir())
+	ln, err := ListenTLS("127.0.0.1:0", certFile, keyFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	s, err := NewServer(ln)
+	assert.NoError(t, err)
+	go func() {
+		_ = s.Serve()
+	}()
+
+	//publish start is answered by handleConn through the decrypted conn
+	addr := ln.Addr().String()
+	c := dialTLS(t, addr, "rtmps://"+addr+"/live/test")
+	if c == nil {
+		return
+	}
+	defer c.Close()
+	assert.NoError(t, c.Publish())
+	assert.True(t, c.IsPublish())
+}
+
+func TestServer_ping(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	s, _ := NewServer(ln)
+	s.SetPing(20*time.Millisecond, 2)
+	go func() {
+		_ = s.Serve()
+	}()
+	addr := ln.Addr().String()
+
+	//the conn reading by ReadPacket responds the pings, it is kept
+	alive, err := rtmp.DialPublish("rtmp://" + addr + "/live/alive")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer alive.Close()
+	aliveErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := alive.ReadPacket(); err != nil {
+				aliveErr <- err
+				return
+			}
+		}
+	}()
+
+	//the player is read by the sink, its ping responses are handled too
+	player, err := rtmp.DialPlay("rtmp://" + addr + "/live/alive")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer player.Close()
+	playerErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := player.ReadPacket(); err != nil {
+				playerErr <- err
+				return
+			}
+		}
+	}()
+
+	//the conn never responds, it is closed by the server
+	dead, err := rtmp.DialPublish("rtmp://" + addr + "/live/dead")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer dead.Close()
+	deadDone := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, dead.NetConn())
+		close(deadDone)
+	}()
+	select {
+	case <-deadDone:
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "dead conn is not closed by the server")
+	}
+
+	select {
+	case err := <-aliveErr:
+		assert.Fail(t, "alive conn is closed", "err: %s", err)
+	case err := <-playerErr:
+		assert.Fail(t, "player conn is closed", "err: %s", err)
+	default:
+	}
+}
+
+func TestServer_unpublish(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	s, _ := NewServer(ln)
+	go func() {
+		_ = s.Serve()
+	}()
+	rawurl := "rtmp://" + ln.Addr().String() + "/live/republish"
+
+	publisher, err := rtmp.DialPublish(rawurl)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer publisher.Close()
+	player, err := rtmp.DialPlay(rawurl)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer player.Close()
+	packets := make(chan *av.Packet, 1)
+	go func() {
+		for {
+			p, err := player.ReadPacket()
+			if err != nil {
+				close(packets)
+				return
+			}
+			packets <- p
+		}
+	}()
+
+	//the stream is released as soon as the publisher unpublishes, the conn is kept
+	assert.NoError(t, publisher.Unpublish())
+	var another *rtmp.Conn
+	for i := 0; i < 100; i++ {
+		if another, err = rtmp.DialPublish(rawurl); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer another.Close()
+
+	//the player is kept for the next publisher
+	data := []byte{0xaf, flv.AACPacketTypeAACRaw, 0x01}
+	p, _ := av.NewPacketFromData(av.TypeAudio, 40, data, flv.NewDemuxer())
+	assert.NoError(t, another.WritePacket(p))
+	select {
+	case got, ok := <-packets:
+		if assert.True(t, ok, "player is closed") {
+			assert.Equal(t, data, got.GetData())
+		}
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "player gets no packet")
+	}
+}
+
+func TestServer_pause(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	s, _ := NewServer(ln)
+	go func() {
+		_ = s.Serve()
+	}()
+	rawurl := "rtmp://" + ln.Addr().String() + "/live/pause"
+
+	publisher, err := rtmp.DialPublish(rawurl)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer publisher.Close()
+	player, err := rtmp.DialPlay(rawurl)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer player.Close()
+	packets := make(chan *av.Packet, 10)
+	go func() {
+		for {
+			p, err := player.ReadPacket()
+			if err != nil {
+				close(packets)
+				return
+			}
+			packets <- p
+		}
+	}()
+	write := func(data []byte) {
+		p, _ := av.NewPacketFromData(av.TypeVideo, 40, data, flv.NewDemuxer())
+		assert.NoError(t, publisher.WritePacket(p))
+	}
+	read := func() []byte {
+		select {
+		case p, ok := <-packets:
+			if assert.True(t, ok, "player is closed") {
+				return p.GetData()
+			}
+		case <-time.After(200 * time.Millisecond):
+		}
+		return nil
+	}
+	sequenceHeader := []byte{0x17, flv.AVCPacketTypeAVCSequenceHeader, 0x00, 0x00, 0x00, 0x01}
+	keyframe := []byte{0x17, flv.AVCPacketTypeAVCNALU, 0x00, 0x00, 0x00, 0x02}
+	interframe := []byte{0x27, flv.AVCPacketTypeAVCNALU, 0x00, 0x00, 0x00, 0x03}
+
+	//the sequence header is sent before the first packet
+	write(sequenceHeader)
+	assert.Equal(t, sequenceHeader, read())
+	assert.Equal(t, sequenceHeader, read())
+
+	//nothing is received while pausing, the conn is kept
+	assert.NoError(t, player.Pause(true))
+	time.Sleep(100 * time.Millisecond)
+	write(keyframe)
+	assert.Nil(t, read())
+
+	//resume at the next keyframe, with the sequence header
+	assert.NoError(t, player.Pause(false))
+	time.Sleep(100 * time.Millisecond)
+	write(interframe)
+	write(keyframe)
+	assert.Equal(t, sequenceHeader, read())
+	assert.Equal(t, keyframe, read())
+}
+
+func TestServer_receiveVideo(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	s, _ := NewServer(ln)
+	go func() {
+		_ = s.Serve()
+	}()
+	rawurl := "rtmp://" + ln.Addr().String() + "/live/receive"
+
+	publisher, err := rtmp.DialPublish(rawurl)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer publisher.Close()
+	player, err := rtmp.DialPlay(rawurl)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer player.Close()
+	packets := make(chan *av.Packet, 10)
+	go func() {
+		for {
+			p, err := player.ReadPacket()
+			if err != nil {
+				close(packets)
+				return
+			}
+			packets <- p
+		}
+	}()
+	write := func(avType uint8, data []byte) {
+		p, _ := av.NewPacketFromData(avType, 40, data, flv.NewDemuxer())
+		assert.NoError(t, publisher.WritePacket(p))
+	}
+	read := func() []byte {
+		select {
+		case p, ok := <-packets:
+			if assert.True(t, ok, "player is closed") {
+				return p.GetData()
+			}
+		case <-time.After(200 * time.Millisecond):
+		}
+		return nil
+	}
+	sequenceHeader := []byte{0x17, flv.AVCPacketTypeAVCSequenceHeader, 0x00, 0x00, 0x00, 0x01}
+	keyframe := []byte{0x17, flv.AVCPacketTypeAVCNALU, 0x00, 0x00, 0x00, 0x02}
+	interframe := []byte{0x27, flv.AVCPacketTypeAVCNALU, 0x00, 0x00, 0x00, 0x03}
+	audio := []byte{0xaf, flv.AACPacketTypeAACRaw, 0x01}
+
+	write(av.TypeVideo, sequenceHeader)
+	assert.Equal(t, sequenceHeader, read())
+	assert.Equal(t, sequenceHeader, read())
+
+	//audio only
+	assert.NoError(t, player.ReceiveVideo(false))
+	time.Sleep(100 * time.Millisecond)
+	write(av.TypeVideo, keyframe)
+	write(av.TypeAudio, audio)
+	assert.Equal(t, audio, read())
+
+	//the video resumes at the next keyframe, with the sequence header
+	assert.NoError(t, player.ReceiveVideo(true))
+	time.Sleep(100 * time.Millisecond)
+	write(av.TypeVideo, interframe)
+	write(av.TypeAudio, audio)
+	write(av.TypeVideo, keyframe)
+	assert.Equal(t, audio, read())
+	assert.Equal(t, sequenceHeader, read())
+	assert.Equal(t, keyframe, read())
+}
+
+func TestServer_duplicatePublish(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	s, _ := NewServer(ln)
+	go func() {
+		_ = s.Serve()
+	}()
+	rawurl := "rtmp://" + ln.Addr().String() + "/live/duplicate"
+
+	publisher, err := rtmp.DialPublish(rawurl)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer publisher.Close()
+
+	//the second publisher is told why before its conn is closed
+	another, err := rtmp.DialPublish(rawurl)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "NetStream.Publish.BadName")
+		assert.Contains(t, err.Error(), "duplicate publish")
+	} else {
+		another.Close()
+	}
+}
+
+func TestServer_RegisterCall(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	s, _ := NewServer(ln)
+	s.RegisterCall("getSettings", func(conn *rtmp.Conn, args []interface{}) ([]interface{}, error) {
+		if len(args) < 1 {
+			return nil, errors.Errorf("stream name is missing")
+		}
+		return []interface{}{amf.AmfObject{"app": conn.GetConnInfo().App, "stream": args[0], "bitrate": float64(2500)}}, nil
+	})
+	go func() {
+		_ = s.Serve()
+	}()
+
+	c, err := rtmp.Dial("rtmp://" + ln.Addr().String() + "/live/settings")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	results, err := c.Call("getSettings", "settings")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []interface{}{amf.AmfObject{"app": "live", "stream": "settings", "bitrate": float64(2500)}}, results)
+	}
+	_, err = c.Call("getSettings")
+	assert.Error(t, err)
+	_, err = c.Call("getStats")
+	assert.Error(t, err)
+}
+
+func TestServer_sharedObject(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	s, _ := NewServer(ln)
+	go func() {
+		_ = s.Serve()
+	}()
+	rawurl := "rtmp://" + ln.Addr().String() + "/chat/room"
+	use := &rtmp.SharedObjectMessage{Name: "room", Events: []*rtmp.SharedObjectEvent{{Type: rtmp.SharedObjectEventUse}}}
+
+	a, err := rtmp.Dial(rawurl)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.Close()
+	assert.NoError(t, a.WriteSharedObjectMessage(use))
+	m, err := a.ReadSharedObjectMessage()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []*rtmp.SharedObjectEvent{{Type: rtmp.SharedObjectEventUseSuccess}, {Type: rtmp.SharedObjectEventClear}}, m.Events)
+	}
+	assert.NoError(t, a.WriteSharedObjectMessage(&rtmp.SharedObjectMessage{Name: "room", Events: []*rtmp.SharedObjectEvent{
+		{Type: rtmp.SharedObjectEventRequestChange, Key: "topic", Value: "gls"},
+	}}))
+	m, err = a.ReadSharedObjectMessage()
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint32(1), m.Version)
+		assert.Equal(t, []*rtmp.SharedObjectEvent{{Type: rtmp.SharedObjectEventSuccess, Key: "topic"}}, m.Events)
+	}
+
+	//the second client gets the properties when it uses the shared object
+	b, err := rtmp.Dial(rawurl)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer b.Close()
+	assert.NoError(t, b.WriteSharedObjectMessage(use))
+	m, err = b.ReadSharedObjectMessage()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []*rtmp.SharedObjectEvent{
+			{Type: rtmp.SharedObjectEventUseSuccess},
+			{Type: rtmp.SharedObjectEventClear},
+			{Type: rtmp.SharedObjectEventChange, Key: "topic", Value: "gls"},
+		}, m.Events)
+	}
+
+	//the change of b is told to a, the message of b is sent to both
+	assert.NoError(t, b.WriteSharedObjectMessage(&rtmp.SharedObjectMessage{Name: "room", Events: []*rtmp.SharedObjectEvent{
+		{Type: rtmp.SharedObjectEventRequestChange, Key: "slide", Value: float64(2)},
+		{Type: rtmp.SharedObjectEventSendMessage, Args: []interface{}{"onChat", "hello"}},
+	}}))
+	m, err = a.ReadSharedObjectMessage()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []*rtmp.SharedObjectEvent{{Type: rtmp.SharedObjectEventChange, Key: "slide", Value: float64(2)}}, m.Events)
+	}
+	m, err = a.ReadSharedObjectMessage()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []*rtmp.SharedObjectEvent{{Type: rtmp.SharedObjectEventSendMessage, Args: []interface{}{"onChat", "hello"}}}, m.Events)
+	}
+	for _, want := range []*rtmp.SharedObjectEvent{
+		{Type: rtmp.SharedObjectEventSuccess, Key: "slide"},
+		{Type: rtmp.SharedObjectEventSendMessage, Args: []interface{}{"onChat", "hello"}},
+	} {
+		m, err = b.ReadSharedObjectMessage()
+		if assert.NoError(t, err) {
+			assert.Equal(t, []*rtmp.SharedObjectEvent{want}, m.Events)
+		}
+	}
+
+	//a shared object which is not persistent is dropped after the last client releases it
+	for _, persistent := range []bool{false, true} {
+		soMessage := func(e *rtmp.SharedObjectEvent) *rtmp.SharedObjectMessage {
+			return &rtmp.SharedObjectMessage{Name: "board", Persistent: persistent, Events: []*rtmp.SharedObjectEvent{e}}
+		}
+		assert.NoError(t, b.WriteSharedObjectMessage(soMessage(&rtmp.SharedObjectEvent{Type: rtmp.SharedObjectEventUse})))
+		_, err = b.ReadSharedObjectMessage()
+		assert.NoError(t, err)
+		assert.NoError(t, b.WriteSharedObjectMessage(soMessage(&rtmp.SharedObjectEvent{Type: rtmp.SharedObjectEventRequestChange, Key: "page", Value: float64(1)})))
+		_, err = b.ReadSharedObjectMessage()
+		assert.NoError(t, err)
+		assert.NoError(t, b.WriteSharedObjectMessage(soMessage(&rtmp.SharedObjectEvent{Type: rtmp.SharedObjectEventRelease})))
+		assert.NoError(t, b.WriteSharedObjectMessage(soMessage(&rtmp.SharedObjectEvent{Type: rtmp.SharedObjectEventUse})))
+		m, err = b.ReadSharedObjectMessage()
+		if assert.NoError(t, err) {
+			if persistent {
+				assert.Len(t, m.Events, 3, "persistent")
+			} else {
+				assert.Len(t, m.Events, 2, "not persistent")
+			}
+		}
+		assert.NoError(t, b.WriteSharedObjectMessage(soMessage(&rtmp.SharedObjectEvent{Type: rtmp.SharedObjectEventRelease})))
+	}
+}
+
+//the sequence start of enhanced rtmp is cached for the players joining later, as the avc sequence header
+func TestServer_enhancedRTMP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	s, _ := NewServer(ln)
+	go func() {
+		_ = s.Serve()
+	}()
+	rawurl := "rtmp://" + ln.Addr().String() + "/live/hevc"
+
+	publisher, err := rtmp.DialPublish(rawurl)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer publisher.Close()
+	write := func(data []byte) {
+		p, err := av.NewPacketFromData(av.TypeVideo, 40, data, flv.NewDemuxer())
+		if assert.NoError(t, err) {
+			assert.NoError(t, publisher.WritePacket(p))
+		}
+	}
+	sequenceStart := []byte{0x90 | flv.PacketTypeSequenceStart, 'h', 'v', 'c', '1', 0x01}
+	keyframe := []byte{0x90 | flv.PacketTypeCodedFrames, 'h', 'v', 'c', '1', 0x00, 0x00, 0x00, 0x02}
+	write(sequenceStart)
+	time.Sleep(100 * time.Millisecond)
+
+	player, err := rtmp.DialPlay(rawurl)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer player.Close()
+	write(keyframe)
+	for _, want := range [][]byte{sequenceStart, keyframe} {
+		p, err := player.ReadPacket()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, want, p.GetData())
+		assert.Equal(t, flv.FourCCHEVC, p.GetVideoTagHandler().FourCC())
+	}
+}
+
+//writeFLVFile writes the tags as an flv file, the data of each tag is the same as the rtmp message
+func writeFLVFile(t *testing.T, path string, tags []*flv.Tag) {
+	buf := []byte{'F', 'L', 'V', 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}
+	for _, tag := range tags {
+		size := len(tag.Data)
+		buf = append(buf, tag.TagType, byte(size>>16), byte(size>>8), byte(size),
+			byte(tag.Timestamp>>16), byte(tag.Timestamp>>8), byte(tag.Timestamp), byte(tag.Timestamp>>24), 0x00, 0x00, 0x00)
+		buf = append(buf, tag.Data...)
+		size += 11
+		buf = append(buf, byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+	}
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, ioutil.WriteFile(path, buf, 0644))
+}
+
+func TestServer_playRecorded(t *testing.T) {
+	dir := t.TempDir()
+	stream.Mgr.SetRecordDir(dir)
+	defer stream.Mgr.SetRecordDir("")
+	audioSequenceHeader := []byte{0xaf, flv.AACPacketTypeAACSequenceHeader, 0x12, 0x10}
+	videoSequenceHeader := []byte{0x17, flv.AVCPacketTypeAVCSequenceHeader, 0x00, 0x00, 0x00, 0x01}
+	tags := []*flv.Tag{
+		{TagType: flv.TagTypeAudio, Timestamp: 0, Data: audioSequenceHeader},
+		{TagType: flv.TagTypeVideo, Timestamp: 0, Data: videoSequenceHeader},
+		{TagType: flv.TagTypeVideo, Timestamp: 0, Data: []byte{0x17, flv.AVCPacketTypeAVCNALU, 0x00, 0x00, 0x00, 0x02}},
+		{TagType: flv.TagTypeAudio, Timestamp: 20, Data: []byte{0xaf, flv.AACPacketTypeAACRaw, 0x03}},
+		{TagType: flv.TagTypeVideo, Timestamp: 40, Data: []byte{0x27, flv.AVCPacketTypeAVCNALU, 0x00, 0x00, 0x00, 0x04}},
+		{TagType: flv.TagTypeVideo, Timestamp: 80, Data: []byte{0x17, flv.AVCPacketTypeAVCNALU, 0x00, 0x00, 0x00, 0x05}},
+		{TagType: flv.TagTypeVideo, Timestamp: 120, Data: []byte{0x27, flv.AVCPacketTypeAVCNALU, 0x00, 0x00, 0x00, 0x06}},
+	}
+	writeFLVFile(t, filepath.Join(dir, "vod", "movie.flv"), tags)
+	//the audio goes backward from the first keyframe, as interleaved by the encoder
+	interleaved := []*flv.Tag{
+		tags[1],
+		{TagType: flv.TagTypeVideo, Timestamp: 40, Data: []byte{0x17, flv.AVCPacketTypeAVCNALU, 0x00, 0x00, 0x00, 0x02}},
+		{TagType: flv.TagTypeAudio, Timestamp: 20, Data: []byte{0xaf, flv.AACPacketTypeAACRaw, 0x03}},
+		{TagType: flv.TagTypeVideo, Timestamp: 80, Data: []byte{0x27, flv.AVCPacketTypeAVCNALU, 0x00, 0x00, 0x00, 0x04}},
+	}
+	writeFLVFile(t, filepath.Join(dir, "vod", "interleaved.flv"), interleaved)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	s, _ := NewServer(ln)
+	go func() {
+		_ = s.Serve()
+	}()
+
+	tests := []struct {
+		name       string
+		streamName string
+		start      float64
+		duration   float64
+		tags       []*flv.Tag //the headers are sent at the timestamp of the first tag
+	}{
+		{"live or recorded", "movie", rtmp.PlayStartLiveOrRecorded, rtmp.PlayDurationAll, []*flv.Tag{tags[0], tags[1], tags[2], tags[3], tags[4], tags[5], tags[6]}},
+		{"from the keyframe after start", "movie", 0.05, rtmp.PlayDurationAll, []*flv.Tag{
+			{TagType: flv.TagTypeAudio, Timestamp: 80, Data: audioSequenceHeader},
+			{TagType: flv.TagTypeVideo, Timestamp: 80, Data: videoSequenceHeader},
+			tags[5], tags[6],
+		}},
+		{"duration", "movie", 0, 0.03, []*flv.Tag{tags[0], tags[1], tags[2], tags[3]}},
+		{"timestamp goes backward", "interleaved", 0, rtmp.PlayDurationAll, []*flv.Tag{
+			{TagType: flv.TagTypeVideo, Timestamp: 40, Data: videoSequenceHeader},
+			interleaved[1], interleaved[2], interleaved[3],
+		}},
+		{"timestamp goes backward with duration", "interleaved", 0, 0.05, []*flv.Tag{
+			{TagType: flv.TagTypeVideo, Timestamp: 40, Data: videoSequenceHeader},
+			interleaved[1], interleaved[2], interleaved[3],
+		}},
+		{"not found", "missing", 0, rtmp.PlayDurationAll, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			player, err := rtmp.Dial("rtmp://" + ln.Addr().String() + "/vod/" + tt.streamName)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer player.Close()
+			//the error status is the first one, PlayRange returns at NetStream.Play.Start otherwise
+			err = player.PlayRange(tt.start, tt.duration)
+			if tt.tags == nil {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), "NetStream.Play.StreamNotFound")
+				}
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			_ = player.NetConn().SetReadDeadline(time.Now().Add(2 * time.Second))
+			for _, want := range tt.tags {
+				p, err := player.ReadPacket()
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, want.Timestamp, p.GetTimestamp())
+				assert.Equal(t, want.Data, p.GetData())
+			}
+			//NetStream.Play.Stop at the end of the file or the duration
+			_, err = player.ReadPacket()
+			assert.Equal(t, core.ErrorStreamClosed, errors.Cause(err))
+		})
+	}
+}
+
+//readFLVFile reads the tags of the flv file, which is written by the recorder
+func readFLVFile(path string) ([]*flv.Tag, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := flv.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	var tags []*flv.Tag
+	for {
+		tag, err := r.ReadTag()
+		if err == io.EOF {
+			return tags, nil
+		} else if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+}
+
+func TestServer_publishRecord(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	s, _ := NewServer(ln)
+	go func() {
+		_ = s.Serve()
+	}()
+	rawurl := "rtmp://" + ln.Addr().String() + "/archive/session"
+
+	//no record dir
+	publisher, err := rtmp.Dial(rawurl)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = publisher.PublishWithType(rtmp.PublishingTypeRecord)
+	_ = publisher.Close()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "NetStream.Record.NoAccess")
+	}
+
+	dir := t.TempDir()
+	stream.Mgr.SetRecordDir(dir)
+	defer stream.Mgr.SetRecordDir("")
+	path := filepath.Join(dir, "archive", "session.flv")
+	audio := []byte{0xaf, flv.AACPacketTypeAACRaw, 0x01}
+	video := []byte{0x17, flv.AVCPacketTypeAVCNALU, 0x00, 0x00, 0x00, 0x02}
+
+	tests := []struct {
+		publishingType string
+		timestamps     []uint32 //of the audio and the video packet published
+		tags           []*flv.Tag
+	}{
+		//the timestamps start from 0
+		{rtmp.PublishingTypeRecord, []uint32{1000, 1040}, []*flv.Tag{
+			{TagType: flv.TagTypeAudio, Timestamp: 0, Data: audio},
+			{TagType: flv.TagTypeVideo, Timestamp: 40, Data: video},
+		}},
+		//the timestamps follow the last one of the file
+		{rtmp.PublishingTypeAppend, []uint32{0, 20}, []*flv.Tag{
+			{TagType: flv.TagTypeAudio, Timestamp: 0, Data: audio},
+			{TagType: flv.TagTypeVideo, Timestamp: 40, Data: video},
+			{TagType: flv.TagTypeAudio, Timestamp: 40, Data: audio},
+			{TagType: flv.TagTypeVideo, Timestamp: 60, Data: video},
+		}},
+		//a new file
+		{rtmp.PublishingTypeRecord, []uint32{0, 0}, []*flv.Tag{
+			{TagType: flv.TagTypeAudio, Timestamp: 0, Data: audio},
+			{TagType: flv.TagTypeVideo, Timestamp: 0, Data: video},
+		}},
+	}
+	for i, tt := range tests {
+		publisher, err := rtmp.Dial(rawurl)
+		if !assert.NoError(t, err, "publish %d", i) {
+			return
+		}
+		defer publisher.Close()
+		if !assert.NoError(t, publisher.PublishWithType(tt.publishingType), "publish %d", i) {
+			return
+		}
+		p, _ := av.NewPacketFromData(av.TypeAudio, tt.timestamps[0], audio, flv.NewDemuxer())
+		assert.NoError(t, publisher.WritePacket(p))
+		p, _ = av.NewPacketFromData(av.TypeVideo, tt.timestamps[1], video, flv.NewDemuxer())
+		assert.NoError(t, publisher.WritePacket(p))
+		assert.NoError(t, publisher.Unpublish())
+
+		//the file is closed after the unpublish is handled
+		var tags []*flv.Tag
+		for j := 0; j < 100; j++ {
+			if tags, err = readFLVFile(path); err == nil && len(tags) == len(tt.tags) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.NoError(t, err, "publish %d", i)
+		assert.Equal(t, tt.tags, tags, "publish %d", i)
+	}
+}
+
+func TestServer_playDuration(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	s, _ := NewServer(ln)
+	go func() {
+		_ = s.Serve()
+	}()
+	rawurl := "rtmp://" + ln.Addr().String() + "/live/duration"
+
+	publisher, err := rtmp.DialPublish(rawurl)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer publisher.Close()
+	player, err := rtmp.Dial(rawurl)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer player.Close()
+	if !assert.NoError(t, player.PlayRange(rtmp.PlayStartLive, 0.2)) {
+		return
+	}
+	time.Sleep(50 * time.Millisecond)
+	p, _ := av.NewPacketFromData(av.TypeAudio, 0, []byte{0xaf, flv.AACPacketTypeAACRaw, 0x01}, flv.NewDemuxer())
+	assert.NoError(t, publisher.WritePacket(p))
+	if got, err := player.ReadPacket(); assert.NoError(t, err) {
+		assert.Equal(t, p.GetData(), got.GetData())
+	}
+
+	//the live stream stops after the duration with NetStream.Play.Stop, the later packets are not sent
+	time.Sleep(300 * time.Millisecond)
+	assert.NoError(t, publisher.WritePacket(p))
+	_ = player.NetConn().SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = player.ReadPacket()
+	assert.Equal(t, core.ErrorStreamClosed, errors.Cause(err))
+}
+
+//play2 switches the player from one rendition to another at its next keyframe
+func TestServer_play2(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	s, _ := NewServer(ln)
+	go func() {
+		_ = s.Serve()
+	}()
+	url := "rtmp://" + ln.Addr().String() + "/live/"
+
+	publishers := make(map[string]*rtmp.Conn)
+	for _, name := range []string{"low", "high"} {
+		publisher, err := rtmp.DialPublish(url + name)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer publisher.Close()
+		publishers[name] = publisher
+	}
+	//the last byte tells the rendition and the frame
+	video := func(frameType, avcPacketType, b byte) []byte {
+		return []byte{frameType<<4 | 0x07, avcPacketType, 0x00, 0x00, 0x00, b}
+	}
+	write := func(name string, data []byte) {
+		p, _ := av.NewPacketFromData(av.TypeVideo, 0, data, flv.NewDemuxer())
+		assert.NoError(t, publishers[name].WritePacket(p))
+		time.Sleep(50 * time.Millisecond)
+	}
+	write("low", video(flv.FrameTypeKeyFrame, flv.AVCPacketTypeAVCSequenceHeader, 0x10))
+	write("high", video(flv.FrameTypeKeyFrame, flv.AVCPacketTypeAVCSequenceHeader, 0x20))
+
+	player, err := rtmp.DialPlay(url + "low")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer player.Close()
+	write("low", video(flv.FrameTypeKeyFrame, flv.AVCPacketTypeAVCNALU, 0x11))
+	assert.NoError(t, player.Switch("high"))
+	time.Sleep(50 * time.Millisecond)
+	write("low", video(flv.FrameTypeInterFrame, flv.AVCPacketTypeAVCNALU, 0x12))
+	write("high", video(flv.FrameTypeInterFrame, flv.AVCPacketTypeAVCNALU, 0x21)) //before the keyframe, not sent
+	write("high", video(flv.FrameTypeKeyFrame, flv.AVCPacketTypeAVCNALU, 0x22))
+	write("low", video(flv.FrameTypeInterFrame, flv.AVCPacketTypeAVCNALU, 0x13)) //switched, not sent
+	write("high", video(flv.FrameTypeInterFrame, flv.AVCPacketTypeAVCNALU, 0x23))
+
+	var got []byte
+	for {
+		_ = player.NetConn().SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		p, err := player.ReadPacket()
+		if err != nil {
+			break
+		}
+		if p.IsMetadata() {
+			//onPlayStatus of the transition complete
+			assert.Contains(t, string(p.GetData()), "NetStream.Play.TransitionComplete")
+			got = append(got, 0xff)
+			continue
+		}
+		got = append(got, p.GetData()[5])
+	}
+	assert.Equal(t, []byte{0x10, 0x11, 0x12, 0xff, 0x20, 0x22, 0x23}, got)
+}
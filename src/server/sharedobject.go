@@ -0,0 +1,155 @@
+package server
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/zhyoulun/gls/src/rtmp"
+	"sync"
+)
+
+//sharedObjects keeps the remote shared objects of all the apps in memory, keyed by the app and the name,
+//a persistent one is kept after the last client releases it, until the server exits
+type sharedObjects struct {
+	mutex   *sync.Mutex
+	objects map[string]*sharedObject
+}
+
+type sharedObject struct {
+	name       string
+	persistent bool
+	version    uint32 //increased by each change and remove
+	data       map[string]interface{}
+	conns      map[*rtmp.Conn]struct{} //the clients using it
+}
+
+func newSharedObjects() *sharedObjects {
+	return &sharedObjects{
+		mutex:   &sync.Mutex{},
+		objects: make(map[string]*sharedObject),
+	}
+}
+
+//sharedObjectWrite is a message to write after the mutex is released, so that a slow client blocks no others
+type sharedObjectWrite struct {
+	conn *rtmp.Conn
+	m    *rtmp.SharedObjectMessage
+}
+
+//HandleSharedObject applies the events of m, the changes are told to the other clients using the shared object,
+//the errors of writing to the other clients are logged only
+func (s *sharedObjects) HandleSharedObject(conn *rtmp.Conn, m *rtmp.SharedObjectMessage) error {
+	var err error
+	for _, w := range s.applyEvents(conn, m) {
+		if e := w.conn.WriteSharedObjectMessage(w.m); e != nil {
+			if w.conn == conn {
+				err = e
+				break
+			}
+			log.Warnf("write shared object %s, err: %s", w.m.Name, e)
+		}
+	}
+	return err
+}
+
+//applyEvents applies the events of m under the mutex, the messages to write are returned in order
+func (s *sharedObjects) applyEvents(conn *rtmp.Conn, m *rtmp.SharedObjectMessage) []sharedObjectWrite {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var writes []sharedObjectWrite
+	key := conn.GetConnInfo().App + "/" + m.Name
+	for _, e := range m.Events {
+		log.Debugf("handle shared object %s, event: %s", key, e)
+		so, ok := s.objects[key]
+		if e.Type == rtmp.SharedObjectEventUse {
+			if !ok {
+				so = &sharedObject{
+					name:       m.Name,
+					persistent: m.Persistent,
+					data:       make(map[string]interface{}),
+					conns:      make(map[*rtmp.Conn]struct{}),
+				}
+				s.objects[key] = so
+			}
+			so.conns[conn] = struct{}{}
+			writes = append(writes, sharedObjectWrite{conn, so.initialMessage()})
+			continue
+		}
+		if !ok || !so.isUsedBy(conn) {
+			log.Warnf("handle shared object %s, not used by the conn, ignore event: %s", key, e)
+			continue
+		}
+		switch e.Type {
+		case rtmp.SharedObjectEventRelease:
+			delete(so.conns, conn)
+			if len(so.conns) == 0 && !so.persistent {
+				delete(s.objects, key)
+			}
+		case rtmp.SharedObjectEventRequestChange:
+			so.data[e.Key] = e.Value
+			so.version++
+			//the requester is told success, the others are told the change
+			writes = append(writes, sharedObjectWrite{conn, so.newMessage(&rtmp.SharedObjectEvent{Type: rtmp.SharedObjectEventSuccess, Key: e.Key})})
+			writes = so.broadcast(writes, conn, so.newMessage(&rtmp.SharedObjectEvent{Type: rtmp.SharedObjectEventChange, Key: e.Key, Value: e.Value}))
+		case rtmp.SharedObjectEventRequestRemove:
+			delete(so.data, e.Key)
+			so.version++
+			writes = so.broadcast(writes, nil, so.newMessage(&rtmp.SharedObjectEvent{Type: rtmp.SharedObjectEventRemove, Key: e.Key}))
+		case rtmp.SharedObjectEventSendMessage:
+			//the sender gets the message too, as SharedObject.send of flash does
+			writes = so.broadcast(writes, nil, so.newMessage(&rtmp.SharedObjectEvent{Type: rtmp.SharedObjectEventSendMessage, Args: e.Args}))
+		default:
+			log.Warnf("handle shared object %s, ignore event: %s", key, e)
+		}
+	}
+	return writes
+}
+
+//HandleSharedObjectClose releases the shared objects used by conn
+func (s *sharedObjects) HandleSharedObjectClose(conn *rtmp.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, so := range s.objects {
+		delete(so.conns, conn)
+		if len(so.conns) == 0 && !so.persistent {
+			delete(s.objects, key)
+		}
+	}
+}
+
+func (so *sharedObject) isUsedBy(conn *rtmp.Conn) bool {
+	_, ok := so.conns[conn]
+	return ok
+}
+
+func (so *sharedObject) newMessage(events ...*rtmp.SharedObjectEvent) *rtmp.SharedObjectMessage {
+	return &rtmp.SharedObjectMessage{
+		Name:       so.name,
+		Version:    so.version,
+		Persistent: so.persistent,
+		Events:     events,
+	}
+}
+
+//initialMessage is sent for use: use success, clear, and a change for each property
+func (so *sharedObject) initialMessage() *rtmp.SharedObjectMessage {
+	events := []*rtmp.SharedObjectEvent{
+		{Type: rtmp.SharedObjectEventUseSuccess},
+		{Type: rtmp.SharedObjectEventClear},
+	}
+	for k, v := range so.data {
+		events = append(events, &rtmp.SharedObjectEvent{Type: rtmp.SharedObjectEventChange, Key: k, Value: v})
+	}
+	return so.newMessage(events...)
+}
+
+//broadcast appends the writes of m to the clients using the shared object except the conn skipped
+func (so *sharedObject) broadcast(writes []sharedObjectWrite, skipped *rtmp.Conn, m *rtmp.SharedObjectMessage) []sharedObjectWrite {
+	for conn := range so.conns {
+		if conn == skipped {
+			continue
+		}
+		writes = append(writes, sharedObjectWrite{conn, m})
+	}
+	return writes
+}
@@ -0,0 +1,207 @@
+package stream
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zhyoulun/gls/src/av"
+	"github.com/zhyoulun/gls/src/core"
+	"github.com/zhyoulun/gls/src/flv"
+	"github.com/zhyoulun/gls/src/rtmp"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+//filePlayerPauseInterval is how often the paused player checks for unpause
+const filePlayerPauseInterval = 100 * time.Millisecond
+
+//FilePlayer writes the recorded stream in the flv file to the player in real time,
+//from the start of play, until the duration of play is reached or the file ends
+type FilePlayer struct {
+	ns        *rtmp.NetStream
+	path      string
+	start     uint32  //milliseconds
+	duration  float64 //the duration of play in seconds, or rtmp.PlayDurationAll
+	closeOnce *sync.Once
+	done      chan struct{} //closed by Remove
+}
+
+//NewFilePlayer plays the file from start seconds
+func NewFilePlayer(ns *rtmp.NetStream, path string, start float64) *FilePlayer {
+	return &FilePlayer{
+		ns:        ns,
+		path:      path,
+		start:     uint32(start * 1000),
+		duration:  ns.PlayDuration(),
+		closeOnce: &sync.Once{},
+		done:      make(chan struct{}),
+	}
+}
+
+func (fp *FilePlayer) Run() {
+	go fp.playCycle()
+}
+
+//Remove stops the player, the conn of the player is kept
+func (fp *FilePlayer) Remove() {
+	fp.closeOnce.Do(func() {
+		close(fp.done)
+	})
+}
+
+func (fp *FilePlayer) playCycle() {
+	log.Infof("file player start cycle, path: %s", fp.path)
+	err := fp.play()
+	if errors.Cause(err) == core.ErrorClosed {
+		log.Infof("file player end cycle, removed")
+		return
+	}
+	if err == nil {
+		log.Infof("file player end cycle, path: %s", fp.path)
+		err = fp.ns.PlayStop()
+	}
+	if err != nil {
+		log.Errorf("file player fail, err: %s", err)
+		if err := fp.ns.Conn().Close(); err != nil {
+			log.Warnf("conn Close err: %s", err)
+		}
+	}
+}
+
+//play skips the tags before start except the metadata and sequence headers,
+//which are sent before the first keyframe not before start, or the first tag if there is no video
+func (fp *FilePlayer) play() error {
+	f, err := os.Open(fp.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := flv.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	var headers []*flv.Tag //the last metadata, audio and video sequence header, one for each tag type
+	var hasVideo bool
+	var begun bool
+	var beginTimestamp uint32
+	var beginTime time.Time
+	for {
+		tag, err := r.ReadTag()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		p, err := newFilePacket(tag)
+		if err != nil {
+			log.Warnf("file player, skip tag, type: %d, timestamp: %d, err: %s", tag.TagType, tag.Timestamp, err)
+			continue
+		}
+		if !begun {
+			if isHeader(p) {
+				headers = replaceHeader(headers, tag)
+				hasVideo = hasVideo || p.IsVideo()
+				continue
+			}
+			if tag.Timestamp < fp.start || (hasVideo && !isKeyframe(p)) {
+				continue
+			}
+			begun = true
+			beginTimestamp = tag.Timestamp
+			beginTime = time.Now()
+			//the headers are sent at the timestamp of the first tag, so that the timestamps do not go backward
+			for _, h := range headers {
+				hp, err := newFilePacket(&flv.Tag{TagType: h.TagType, Timestamp: tag.Timestamp, Data: h.Data})
+				if err != nil {
+					return err
+				}
+				if err := fp.write(hp); err != nil {
+					return err
+				}
+			}
+		}
+		//the interleaved audio and video may go backward a little, which is sent at once
+		offset := int64(tag.Timestamp) - int64(beginTimestamp)
+		if offset < 0 {
+			offset = 0
+		}
+		if fp.duration >= 0 && float64(offset) > fp.duration*1000 {
+			return nil
+		}
+		if beginTime, err = fp.wait(beginTime, offset); err != nil {
+			return err
+		}
+		if err := fp.write(p); err != nil {
+			return err
+		}
+	}
+}
+
+//wait waits until the offset since the beginning, the time paused is added to beginTime, which is returned
+func (fp *FilePlayer) wait(beginTime time.Time, offset int64) (time.Time, error) {
+	for {
+		d := time.Until(beginTime.Add(time.Duration(offset) * time.Millisecond))
+		if fp.ns.IsPaused() {
+			d = filePlayerPauseInterval
+			beginTime = beginTime.Add(filePlayerPauseInterval)
+		} else if d <= 0 {
+			return beginTime, nil
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-fp.done:
+			timer.Stop()
+			return beginTime, errors.Wrapf(core.ErrorClosed, "file player %s", fp.path)
+		case <-timer.C:
+		}
+	}
+}
+
+//write skips the tracks turned off by receiveAudio and receiveVideo
+func (fp *FilePlayer) write(p *av.Packet) error {
+	if (p.IsAudio() && !fp.ns.IsReceiveAudio()) || (p.IsVideo() && !fp.ns.IsReceiveVideo()) {
+		return nil
+	}
+	log.Tracef("write %s", p)
+	return fp.ns.WritePacket(p)
+}
+
+func newFilePacket(tag *flv.Tag) (*av.Packet, error) {
+	var avType uint8
+	switch tag.TagType {
+	case flv.TagTypeAudio:
+		avType = av.TypeAudio
+	case flv.TagTypeVideo:
+		avType = av.TypeVideo
+	case flv.TagTypeScriptData:
+		avType = av.TypeMetadata
+	default:
+		return nil, errors.Wrapf(core.ErrorNotSupported, "flv tag type: %d", tag.TagType)
+	}
+	return av.NewPacketFromData(avType, tag.Timestamp, tag.Data, flv.NewDemuxer())
+}
+
+//the metadata and the sequence headers, which are cached by the source too
+func isHeader(p *av.Packet) bool {
+	if p.IsMetadata() {
+		return true
+	}
+	if p.IsAudio() {
+		ah := p.GetAudioTagHandler()
+		return ah.SoundFormat() == flv.SoundFormatAAC && ah.AACPacketType() == flv.AACPacketTypeAACSequenceHeader
+	}
+	vh := p.GetVideoTagHandler()
+	return vh.FrameType() == flv.FrameTypeKeyFrame && vh.PacketType() == flv.PacketTypeSequenceStart
+}
+
+func replaceHeader(headers []*flv.Tag, tag *flv.Tag) []*flv.Tag {
+	for i, h := range headers {
+		if h.TagType == tag.TagType {
+			headers[i] = tag
+			return headers
+		}
+	}
+	return append(headers, tag)
+}
@@ -2,7 +2,13 @@ package stream
 
 import (
 	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zhyoulun/gls/src/core"
 	"github.com/zhyoulun/gls/src/rtmp"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 )
 
@@ -11,6 +17,16 @@ var Mgr *Manager
 type Manager struct {
 	streamsMutex *sync.Mutex
 	streams      map[string]*Stream
+
+	recordDir string //the recorded streams are <recordDir>/<app>/<stream name>.flv, empty means disabled
+}
+
+//Player writes the live stream or the recorded stream to a playing NetStream
+type Player interface {
+	//Run starts writing to the NetStream, after the play start is sent
+	Run()
+	//Remove stops the player, the conn of the player is kept
+	Remove()
 }
 
 func InitManager() error {
@@ -21,31 +37,83 @@ func InitManager() error {
 	return nil
 }
 
-func (m *Manager) HandlePublish(conn *rtmp.Conn) error {
+//HandlePublish attaches the publishing NetStream to its stream, the packets are given to the source
+func (m *Manager) HandlePublish(ns *rtmp.NetStream) (*Source, error) {
 	var stream *Stream
 	var err error
-	if stream, err = m.getOrCreateStream(conn.GetConnInfo(), conn.GetStreamName()); err != nil {
-		return err
+	if stream, err = m.getOrCreateStream(ns.GetConnInfo(), ns.GetStreamName()); err != nil {
+		return nil, err
 	}
-	if err = stream.SetSource(conn); err != nil {
-		return err
+	//the recorded stream is played from the same file
+	var path string
+	if ns.IsRecord() {
+		if path, err = m.recordPath(ns.GetConnInfo(), ns.GetStreamName()); err != nil {
+			return nil, errors.Wrapf(core.ErrorNoAccess, "record stream %s, err: %s", ns.GetStreamName(), err)
+		}
 	}
-	return nil
+	return stream.SetSource(ns, path)
+}
 
+//SetRecordDir sets the dir of the recorded streams, it must be called before serving
+func (m *Manager) SetRecordDir(dir string) {
+	m.recordDir = dir
 }
 
-func (m *Manager) HandlePlay(conn *rtmp.Conn) error {
+//HandlePlay plays the live stream or the recorded stream by the start of play:
+//PlayStartLive attaches the NetStream to the live stream, waiting for the publisher if it is not published,
+//PlayStartLiveOrRecorded plays the recorded stream from the beginning if the live one is not published and the recorded one is found,
+//a start not less than 0 plays the recorded stream from the offset.
+//the player is not run until the play start is sent
+func (m *Manager) HandlePlay(ns *rtmp.NetStream) (Player, error) {
 	var stream *Stream
 	var err error
-	if stream, err = m.getOrCreateStream(conn.GetConnInfo(), conn.GetStreamName()); err != nil {
-		return err
+	if stream, err = m.getOrCreateStream(ns.GetConnInfo(), ns.GetStreamName()); err != nil {
+		return nil, err
+	}
+	start := ns.PlayStart()
+	if start == rtmp.PlayStartLive {
+		return stream.AddSink(ns)
 	}
-	if err = stream.AddSink(conn); err != nil {
+	path, err := m.recordPath(ns.GetConnInfo(), ns.GetStreamName())
+	if err == nil {
+		_, err = os.Stat(path)
+	}
+	if start == rtmp.PlayStartLiveOrRecorded {
+		if err != nil || stream.IsPublishing() {
+			return stream.AddSink(ns)
+		}
+		start = 0
+	} else if err != nil {
+		return nil, errors.Wrapf(core.ErrorStreamNotFound, "recorded stream %s, err: %s", ns.GetStreamName(), err)
+	}
+	log.Infof("play recorded stream %s from %vs", path, start)
+	return NewFilePlayer(ns, path, start), nil
+}
+
+//HandleSwitch switches the live stream played by the sink to the stream named by the NetStream, for play2
+func (m *Manager) HandleSwitch(sink *Sink, ns *rtmp.NetStream) error {
+	stream, err := m.getOrCreateStream(ns.GetConnInfo(), ns.GetStreamName())
+	if err != nil {
 		return err
 	}
+	stream.SwitchSink(sink)
 	return nil
 }
 
+//recordPath is the flv file of the recorded stream, the stream name must not leave the dir of the app
+func (m *Manager) recordPath(connInfo rtmp.ConnectCommentObject, streamName string) (string, error) {
+	if m.recordDir == "" {
+		return "", errors.Wrapf(core.ErrorNotSupported, "no record dir")
+	}
+	root := filepath.Clean(m.recordDir) + string(filepath.Separator)
+	dir := filepath.Join(m.recordDir, connInfo.App)
+	path := filepath.Join(dir, streamName+".flv")
+	if !strings.HasPrefix(dir, root) || !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return "", errors.Wrapf(core.ErrorInvalidData, "record path of app %s, stream name %s", connInfo.App, streamName)
+	}
+	return path, nil
+}
+
 func (m *Manager) getOrCreateStream(connInfo rtmp.ConnectCommentObject, streamName string) (*Stream, error) {
 	m.streamsMutex.Lock()
 	defer m.streamsMutex.Unlock()
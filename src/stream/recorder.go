@@ -0,0 +1,100 @@
+package stream
+
+import (
+	"bufio"
+	log "github.com/sirupsen/logrus"
+	"github.com/zhyoulun/gls/src/av"
+	"github.com/zhyoulun/gls/src/flv"
+	"os"
+	"path/filepath"
+)
+
+//Recorder writes the packets of the publisher to the flv file, for the publishing type record and append,
+//it is called by the goroutine of the publisher only
+type Recorder struct {
+	path    string
+	f       *os.File
+	bw      *bufio.Writer
+	w       *flv.Writer
+	offset  uint32 //the last timestamp of the file appended to, the recorded tags follow it
+	first   int64  //the timestamp of the first packet recorded
+	started bool
+}
+
+//NewRecorder creates the flv file, or opens it to append the tags after the last one,
+//an appended file is created if not found
+func NewRecorder(path string, isAppend bool) (*Recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	flag := os.O_RDWR | os.O_CREATE
+	if !isAppend {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		path: path,
+		f:    f,
+		bw:   bufio.NewWriter(f),
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		r.w, err = flv.NewWriter(r.bw)
+	} else {
+		//LastTimestamp leaves f at the end
+		r.offset, err = flv.LastTimestamp(f)
+		r.w = flv.NewAppendWriter(r.bw)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	log.Infof("record start, path: %s, append: %t, offset: %d", path, isAppend, r.offset)
+	return r, nil
+}
+
+//WritePacket writes the packet as a tag, the timestamps start from 0, or the last one of the file appended to
+func (r *Recorder) WritePacket(p *av.Packet) error {
+	var tagType uint8
+	switch {
+	case p.IsAudio():
+		tagType = flv.TagTypeAudio
+	case p.IsVideo():
+		tagType = flv.TagTypeVideo
+	case p.IsMetadata():
+		tagType = flv.TagTypeScriptData
+	default:
+		return nil
+	}
+	if !r.started {
+		r.first = p.GetTimestamp64()
+		r.started = true
+	}
+	timestamp := p.GetTimestamp64() - r.first
+	if timestamp < 0 {
+		//e.g. the metadata sent again with timestamp 0
+		timestamp = 0
+	}
+	return r.w.WriteTag(&flv.Tag{
+		TagType:   tagType,
+		Timestamp: r.offset + uint32(timestamp),
+		Data:      p.GetData(),
+	})
+}
+
+//Close flushes the tags and closes the file
+func (r *Recorder) Close() error {
+	log.Infof("record stop, path: %s", r.path)
+	if err := r.bw.Flush(); err != nil {
+		_ = r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
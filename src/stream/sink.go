@@ -2,75 +2,188 @@ package stream
 
 import (
 	"fmt"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/zhyoulun/gls/src/av"
+	"github.com/zhyoulun/gls/src/core"
 	"github.com/zhyoulun/gls/src/rtmp"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var (
 	globalID int32 = 0
+	//sinkLagTimeout is how long the channel of a sink may stay full, the packets are dropped meanwhile
+	sinkLagTimeout = 5 * time.Second
+)
+
+//sinkEvent is sent to the sink in order with the packets
+type sinkEvent int
+
+const (
+	sinkEventUnpublish sinkEvent = iota
+	sinkEventPublish
+	sinkEventTransitionComplete //play2 switches to the stream, sent before its first packet
 )
 
 type Sink struct {
-	id       int32
-	conn     *rtmp.Conn
-	running  bool
+	id string
+	ns *rtmp.NetStream
+	//guards stream and switchTo, and the sending of the stream to the sink, so that the sink is sent by one stream only.
+	//it is locked after the sinksMutex of the stream
+	mutex    *sync.Mutex
+	stream   *Stream //the sink is added to
+	switchTo *Stream //the stream of play2, the sink moves to it at its next keyframe
 	ch       chan interface{}
 	initDone bool
+	//set while the player pauses, or after packets are dropped, the packets are not sent until the next keyframe
+	waitKeyframe bool
+	fullSince    time.Time //when the first packet is dropped for the full channel, zero if it is not full
+	//set while the track is turned off by receiveAudio or receiveVideo,
+	//the sequence header is sent again when it is turned on, and the video waits for the next keyframe
+	audioOff  bool
+	videoOff  bool
+	duration  float64 //the duration of play in seconds, taken when the sink is created, the NetStream may play again
+	closeOnce *sync.Once
+	done      chan struct{} //closed by Close or stop, stops the cycle
 }
 
-func NewSink(conn *rtmp.Conn) *Sink {
+func NewSink(ns *rtmp.NetStream) *Sink {
 	return &Sink{
-		id:   atomic.AddInt32(&globalID, 1),
-		conn: conn,
-		ch:   make(chan interface{}, 1000),
+		id:        fmt.Sprintf("%s:%d", ns.GetStreamName(), atomic.AddInt32(&globalID, 1)),
+		ns:        ns,
+		mutex:     &sync.Mutex{},
+		ch:        make(chan interface{}, 1000),
+		duration:  ns.PlayDuration(),
+		closeOnce: &sync.Once{},
+		done:      make(chan struct{}),
 	}
 }
 
+//Close stops the sink and closes the conn of the player
 func (s *Sink) Close() error {
-	s.running = false
-	return s.conn.Close()
+	s.stop()
+	return s.ns.Conn().Close()
+}
+
+//stop stops the sink, the conn of the player is kept
+func (s *Sink) stop() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+//Remove removes the sink from its stream, the conn of the player is kept, e.g. for deleteStream
+func (s *Sink) Remove() {
+	s.mutex.Lock()
+	stream := s.stream
+	s.mutex.Unlock()
+	stream.RemoveSink(s)
+}
+
+//isStopped reports whether the sink is stopped by Close, stop or Remove
+func (s *Sink) isStopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
 }
 
 func (s *Sink) Run() {
-	s.running = true
 	go s.writeCycle() //todo 使用协程池
 }
 
 func (s *Sink) writeCycle() {
 	log.Infof("sink start cycle")
+	//the duration of play stops the live stream after that long
+	var durationC <-chan time.Time
+	if s.duration >= 0 {
+		timer := time.NewTimer(time.Duration(s.duration * float64(time.Second)))
+		defer timer.Stop()
+		durationC = timer.C
+	}
 	for {
-		if !s.running {
-			break
-		}
-
 		select {
+		case <-s.done:
+			log.Infof("sink end cycle")
+			return
+		case <-durationC:
+			log.Infof("sink end cycle, the duration of play is reached")
+			//stopped before Remove takes the sinksMutex, which may be held by a Send to the full channel of the sink
+			s.stop()
+			s.Remove()
+			if err := s.ns.PlayStop(); err != nil {
+				log.Errorf("play stop fail, err: %s", err)
+				if err := s.ns.Conn().Close(); err != nil {
+					log.Warnf("conn Close err: %s", err)
+				}
+			}
+			return
 		case ch := <-s.ch:
-			p := ch.(*av.Packet)
-			log.Tracef("write %s", p)
-			if err := s.conn.WritePacket(p); err != nil {
-				s.running = false
+			var err error
+			switch v := ch.(type) {
+			case *av.Packet:
+				//packets queued before the pause
+				if s.ns.IsPaused() {
+					continue
+				}
+				log.Tracef("write %s", v)
+				err = s.ns.WritePacket(v)
+			case sinkEvent:
+				err = s.handleEvent(v)
+			}
+			if err != nil {
 				log.Errorf("write packet fail, err: %s", err)
+				if err := s.Close(); err != nil {
+					log.Warnf("sink Close err: %s", err)
+				}
 			}
 		}
 	}
-	log.Infof("sink end cycle")
 }
 
-func (s *Sink) Send(p *av.Packet) error {
+func (s *Sink) handleEvent(event sinkEvent) error {
+	switch event {
+	case sinkEventUnpublish:
+		return s.ns.UnpublishNotify()
+	case sinkEventPublish:
+		return s.ns.PublishNotify()
+	case sinkEventTransitionComplete:
+		return s.ns.PlayTransitionComplete()
+	}
+	return core.ErrorImpossible
+}
+
+//Send sends a packet or a sinkEvent to the sink, it is called with the sinksMutex of the stream and the mutex of the sink held,
+//so it never blocks: while the channel is full, e.g. for a burst, the packets are dropped and the sink starts again
+//from the headers and the next keyframe. a sink whose channel stays full for sinkLagTimeout lags too far behind,
+//e.g. its player does not read or acknowledge, and it is closed
+func (s *Sink) Send(p interface{}) error {
 	select {
 	case s.ch <- p:
+		s.fullSince = time.Time{}
+		return nil
+	case <-s.done:
+		return errors.Wrapf(core.ErrorClosed, "sink[%s]", s.ID())
 	default:
-		select {
-		case s.ch <- p:
-			//default:
-			//	return errors.Errorf("sink[%s] send to channel fail", s.ID())
+	}
+	if s.fullSince.IsZero() {
+		log.Warnf("sink[%s] is full, drop packets until the next keyframe", s.ID())
+		s.fullSince = time.Now()
+	} else if time.Since(s.fullSince) > sinkLagTimeout {
+		if err := s.Close(); err != nil {
+			log.Warnf("sink Close err: %s", err)
 		}
+		return errors.Wrapf(core.ErrorClosed, "sink[%s] lags behind, full for %s", s.ID(), time.Since(s.fullSince))
 	}
+	s.initDone = false
+	s.waitKeyframe = true
 	return nil
 }
 
 func (s *Sink) ID() string {
-	return fmt.Sprintf("%s:%d", s.conn.GetStreamName(), s.id) //todo 待优化
+	return s.id
 }
@@ -0,0 +1,92 @@
+package stream
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhyoulun/gls/src/av"
+	"github.com/zhyoulun/gls/src/core"
+	"github.com/zhyoulun/gls/src/flv"
+	"github.com/zhyoulun/gls/src/rtmp"
+	"github.com/zhyoulun/gls/src/utils"
+	"net"
+	"testing"
+	"time"
+)
+
+//playingNetStream returns the server side NetStream of a player dialed to ln
+func playingNetStream(t *testing.T, ln net.Listener) (*rtmp.NetStream, *rtmp.Conn) {
+	ch := make(chan *rtmp.NetStream, 1)
+	go func() {
+		netConn, err := ln.Accept()
+		if err != nil {
+			ch <- nil
+			return
+		}
+		c, _ := rtmp.NewConn(utils.NewBufferedConn(netConn, core.Size4KB))
+		if err := c.Handshake(); err != nil {
+			ch <- nil
+			return
+		}
+		ns, err := c.ReadHeader()
+		if err != nil {
+			ch <- nil
+			return
+		}
+		ch <- ns
+	}()
+	player, err := rtmp.DialPlay("rtmp://" + ln.Addr().String() + "/live/lagging")
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	return <-ch, player
+}
+
+//the sink not running lags behind, the packets are dropped while its channel is full, until it is closed
+func TestSink_Send_lagging(t *testing.T) {
+	timeout := sinkLagTimeout
+	sinkLagTimeout = 100 * time.Millisecond
+	defer func() {
+		sinkLagTimeout = timeout
+	}()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	ns, player := playingNetStream(t, ln)
+	if !assert.NotNil(t, ns) {
+		return
+	}
+	defer player.Close()
+
+	sink := NewSink(ns)
+	sink.initDone = true
+	p, _ := av.NewPacketFromData(av.TypeAudio, 0, []byte{0xaf, flv.AACPacketTypeAACRaw, 0x01}, flv.NewDemuxer())
+	for i := 0; i < cap(sink.ch); i++ {
+		assert.NoError(t, sink.Send(p))
+	}
+	assert.True(t, sink.fullSince.IsZero())
+
+	//a burst: dropped, the sink starts again from the headers and the next keyframe
+	assert.NoError(t, sink.Send(p))
+	assert.False(t, sink.fullSince.IsZero())
+	assert.False(t, sink.initDone)
+	assert.True(t, sink.waitKeyframe)
+	<-sink.ch
+	assert.NoError(t, sink.Send(p))
+	assert.True(t, sink.fullSince.IsZero(), "not full any more")
+
+	//full for longer than sinkLagTimeout
+	assert.NoError(t, sink.Send(p))
+	time.Sleep(2 * sinkLagTimeout)
+	err = sink.Send(p)
+	assert.Equal(t, core.ErrorClosed, errors.Cause(err))
+	assert.True(t, sink.isStopped())
+	//the conn of the player is closed
+	_ = player.NetConn().SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = player.ReadPacket()
+	assert.Error(t, err)
+	if ne, ok := errors.Cause(err).(net.Error); ok {
+		assert.False(t, ne.Timeout(), "conn is not closed")
+	}
+}
@@ -10,26 +10,38 @@ import (
 type DataHandler interface {
 	ReceiveData(p *av.Packet)
 	CloseAllSink()
+	Unpublish()
 }
 
 type Source struct {
 	handler DataHandler
 
-	conn    *rtmp.Conn
-	running bool
+	ns       *rtmp.NetStream
+	done     chan struct{} //closed by Close
+	recorder *Recorder     //nil if the publishing is not recorded, or the recording fails
 
 	metadata *av.Packet
 	video    *av.Packet
 	audio    *av.Packet
 }
 
-func (s *Source) Run() {
-	s.running = true
-	go s.readCycle() //todo 待优化到协程池
+//NewSource creates the source of the publisher, the packets are also written to the recorder if it is not nil
+func NewSource(handler DataHandler, ns *rtmp.NetStream, recorder *Recorder) *Source {
+	return &Source{
+		handler:  handler,
+		ns:       ns,
+		done:     make(chan struct{}),
+		recorder: recorder,
+	}
 }
 
 func (s *Source) GetRunning() bool {
-	return s.running
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
 }
 
 func (s *Source) GetMetadata() *av.Packet {
@@ -44,53 +56,58 @@ func (s *Source) GetAudio() *av.Packet {
 	return s.audio
 }
 
-func (s *Source) readCycle() {
-	log.Debugf("start source")
-	for {
-		if !s.running {
-			break
-		}
+//ReceivePacket is called with the packets read from the publisher
+func (s *Source) ReceivePacket(p *av.Packet) {
+	log.Tracef("read %s", p)
 
-		var p *av.Packet
-		var err error
-		if p, err = s.conn.ReadPacket(); err != nil {
-			log.Warnf("stream source ReadPacket err: %s", err)
-			log.Infof("source conn stop, local addr: %s, remote addr: %s",
-				s.conn.NetConn().LocalAddr(), s.conn.NetConn().RemoteAddr())
-			s.running = false
-			continue
-		} else {
-			log.Tracef("read %s", p)
-		}
-
-		//缓存
-		if p.IsMetadata() {
-			s.metadata = p
-		}
-		if p.IsAudio() {
-			ah := p.GetAudioTagHandler()
-			if ah.SoundFormat() == flv.SoundFormatAAC && ah.AACPacketType() == flv.AACPacketTypeAACSequenceHeader { //todo ??
-				s.audio = p
-			}
+	//缓存
+	if p.IsMetadata() {
+		s.metadata = p
+	}
+	if p.IsAudio() {
+		ah := p.GetAudioTagHandler()
+		if ah.SoundFormat() == flv.SoundFormatAAC && ah.AACPacketType() == flv.AACPacketTypeAACSequenceHeader { //todo ??
+			s.audio = p
 		}
-		if p.IsVideo() {
-			vh := p.GetVideoTagHandler()
-			if vh.FrameType() == flv.FrameTypeKeyFrame && vh.AVCPacketType() == flv.AVCPacketTypeAVCSequenceHeader { //todo ??
-				s.video = p
-			}
+	}
+	if p.IsVideo() {
+		vh := p.GetVideoTagHandler()
+		//the avc sequence header, or the sequence start of enhanced rtmp
+		if vh.FrameType() == flv.FrameTypeKeyFrame && vh.PacketType() == flv.PacketTypeSequenceStart { //todo ??
+			s.video = p
 		}
+	}
 
-		s.handler.ReceiveData(p)
+	if s.recorder != nil {
+		if err := s.recorder.WritePacket(p); err != nil {
+			//the live stream goes on without the recording
+			log.Errorf("recorder WritePacket err: %s, NetStream: %s", err, s.ns)
+			s.closeRecorder()
+		}
 	}
-	log.Debugf("stop source")
 
-	s.handler.CloseAllSink()
+	s.handler.ReceiveData(p)
 }
 
-func NewSource(handler DataHandler, conn *rtmp.Conn) *Source {
-	return &Source{
-		handler: handler,
-		conn:    conn,
-		running: false,
+func (s *Source) closeRecorder() {
+	if err := s.recorder.Close(); err != nil {
+		log.Errorf("recorder Close err: %s, NetStream: %s", err, s.ns)
 	}
+	s.recorder = nil
+}
+
+//Close stops the source, err is nil if the publisher unpublishes, the players are kept for the next publish,
+//otherwise the players are closed
+func (s *Source) Close(err error) {
+	close(s.done)
+	if s.recorder != nil {
+		s.closeRecorder()
+	}
+	if err == nil {
+		log.Infof("source unpublish, NetStream: %s", s.ns)
+		s.handler.Unpublish()
+		return
+	}
+	log.Warnf("source stop, NetStream: %s, err: %s", s.ns, err)
+	s.handler.CloseAllSink()
 }
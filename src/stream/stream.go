@@ -1,16 +1,19 @@
 package stream
 
 import (
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/zhyoulun/gls/src/av"
 	"github.com/zhyoulun/gls/src/core"
+	"github.com/zhyoulun/gls/src/flv"
 	"github.com/zhyoulun/gls/src/rtmp"
 	"sync"
 )
 
 type Stream struct {
-	sinksMutex *sync.Mutex
-	sinks      map[string]*Sink
+	sinksMutex     *sync.Mutex
+	sinks          map[string]*Sink
+	switchingSinks map[string]*Sink //switching to the stream by play2, added to sinks at the next keyframe
 
 	sourceMutex *sync.Mutex
 	source      *Source
@@ -18,29 +21,46 @@ type Stream struct {
 
 func newStream() (*Stream, error) {
 	return &Stream{
-		sinksMutex:  &sync.Mutex{},
-		sinks:       make(map[string]*Sink),
-		sourceMutex: &sync.Mutex{},
+		sinksMutex:     &sync.Mutex{},
+		sinks:          make(map[string]*Sink),
+		switchingSinks: make(map[string]*Sink),
+		sourceMutex:    &sync.Mutex{},
 	}, nil
 }
 
-func (s *Stream) SetSource(conn *rtmp.Conn) error {
+//SetSource starts the publishing of ns, which is also recorded to recordPath if it is not empty
+func (s *Stream) SetSource(ns *rtmp.NetStream, recordPath string) (*Source, error) {
 	s.sourceMutex.Lock()
 	defer s.sourceMutex.Unlock()
 
 	//重复推流，拒绝后推的流
 	if s.source != nil && s.source.GetRunning() {
-		if err := conn.Close(); err != nil { //todo close位置优化，减少心智负担
-			log.Printf("source Close err: %s", err)
+		return nil, core.ErrorDuplicatePublish
+	}
+
+	//opened after the duplicate check, so that the recording of the running source is kept
+	var recorder *Recorder
+	if recordPath != "" {
+		var err error
+		if recorder, err = NewRecorder(recordPath, ns.PublishingType() == rtmp.PublishingTypeAppend); err != nil {
+			return nil, errors.Wrapf(core.ErrorNoAccess, "record %s, err: %s", recordPath, err)
 		}
-		return core.ErrorDuplicatePublish
 	}
 
+	//players waiting for the publisher, e.g. after unpublish
+	s.notifyAllSink(sinkEventPublish)
+
 	//新建流记录
-	s.source = NewSource(s, conn)
-	s.source.Run()
+	s.source = NewSource(s, ns, recorder)
+
+	return s.source, nil
+}
 
-	return nil
+//IsPublishing reports whether the live stream is published
+func (s *Stream) IsPublishing() bool {
+	s.sourceMutex.Lock()
+	defer s.sourceMutex.Unlock()
+	return s.source != nil && s.source.GetRunning()
 }
 
 func (s *Stream) ReceiveData(p *av.Packet) {
@@ -49,69 +69,206 @@ func (s *Stream) ReceiveData(p *av.Packet) {
 
 func (s *Stream) sendData(p *av.Packet) {
 	s.sinksMutex.Lock()
-	for _, sink := range s.sinks {
-		if !sink.initDone {
-			if s.source.GetMetadata() != nil {
-				if err := sink.Send(s.source.GetMetadata()); err != nil {
-					if err := sink.Close(); err != nil {
-						log.Errorf("sink Close err: %s", err)
-					}
-					delete(s.sinks, sink.ID())
-					log.Errorf("sink Send err: %s", err)
-					continue
+	defer s.sinksMutex.Unlock()
+	s.switchSinks(p)
+	for id, sink := range s.sinks {
+		sink.mutex.Lock()
+		if sink.stream != s {
+			//switched to another stream by play2
+			delete(s.sinks, id)
+		} else if err := s.sendToSink(sink, p); err != nil {
+			delete(s.sinks, id)
+			log.Errorf("sink Send err: %s", err)
+		}
+		sink.mutex.Unlock()
+	}
+}
+
+//switchSinks moves the sinks switching to the stream at its keyframe, or its audio if it has no video,
+//the sink gets the metadata and sequence headers of the stream after the transition complete
+func (s *Stream) switchSinks(p *av.Packet) {
+	if !isKeyframe(p) && (s.source.GetVideo() != nil || !p.IsAudio()) {
+		return
+	}
+	for id, sink := range s.switchingSinks {
+		sink.mutex.Lock()
+		delete(s.switchingSinks, id)
+		//switched again, or stopped
+		if sink.switchTo == s && !sink.isStopped() {
+			log.Infof("sink %s switches to stream %s", id, sink.ns.GetStreamName())
+			sink.stream = s
+			sink.switchTo = nil
+			sink.initDone = false
+			sink.waitKeyframe = false
+			s.sinks[id] = sink
+			if err := sink.Send(sinkEventTransitionComplete); err != nil {
+				delete(s.sinks, id)
+				log.Errorf("sink Send err: %s", err)
+			}
+		}
+		sink.mutex.Unlock()
+	}
+}
+
+//SwitchSink switches the sink to the stream at its next keyframe, the sink is sent by its stream until then
+func (s *Stream) SwitchSink(sink *Sink) {
+	s.sinksMutex.Lock()
+	defer s.sinksMutex.Unlock()
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.stream == s {
+		sink.switchTo = nil
+		return
+	}
+	sink.switchTo = s
+	s.switchingSinks[sink.ID()] = sink
+}
+
+//sendToSink sends the metadata and sequence headers before the first packet,
+//packets are skipped while the player pauses or turns the track off
+func (s *Stream) sendToSink(sink *Sink, p *av.Packet) error {
+	//the player pauses, it gets the metadata and sequence headers again at the next keyframe after unpause
+	if sink.ns.IsPaused() {
+		sink.initDone = false
+		sink.waitKeyframe = true
+		return nil
+	}
+	if sink.waitKeyframe {
+		if s.source.GetVideo() != nil && sink.ns.IsReceiveVideo() && !isKeyframe(p) {
+			return nil
+		}
+		sink.waitKeyframe = false
+	}
+
+	//receiveAudio and receiveVideo, the sequence header is sent again when the track is turned on
+	if p.IsAudio() {
+		if !sink.ns.IsReceiveAudio() {
+			sink.audioOff = true
+			return nil
+		}
+		if sink.audioOff {
+			sink.audioOff = false
+			if sink.initDone && s.source.GetAudio() != nil {
+				if err := sink.Send(s.source.GetAudio()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if p.IsVideo() {
+		if !sink.ns.IsReceiveVideo() {
+			sink.videoOff = true
+			return nil
+		}
+		if sink.videoOff {
+			if !isKeyframe(p) {
+				return nil
+			}
+			sink.videoOff = false
+			if sink.initDone && s.source.GetVideo() != nil {
+				if err := sink.Send(s.source.GetVideo()); err != nil {
+					return err
 				}
 			}
-			if s.source.GetAudio() != nil {
+		}
+	}
+
+	if !sink.initDone {
+		//set first, a header dropped by Send clears it
+		sink.initDone = true
+		if s.source.GetMetadata() != nil {
+			if err := sink.Send(s.source.GetMetadata()); err != nil {
+				return err
+			}
+		}
+		if s.source.GetAudio() != nil {
+			if sink.ns.IsReceiveAudio() {
 				if err := sink.Send(s.source.GetAudio()); err != nil {
-					if err := sink.Close(); err != nil {
-						log.Errorf("sink Close err: %s", err)
-					}
-					delete(s.sinks, sink.ID())
-					log.Errorf("sink Send err: %s", err)
-					continue
+					return err
 				}
+			} else {
+				sink.audioOff = true
 			}
-			if s.source.GetVideo() != nil {
+		}
+		if s.source.GetVideo() != nil {
+			if sink.ns.IsReceiveVideo() {
 				if err := sink.Send(s.source.GetVideo()); err != nil {
-					if err := sink.Close(); err != nil {
-						log.Errorf("sink Close err: %s", err)
-					}
-					delete(s.sinks, sink.ID())
-					log.Errorf("sink Send err: %s", err)
-					continue
+					return err
 				}
+			} else {
+				sink.videoOff = true
 			}
-			sink.initDone = true
 		}
+	}
+
+	return sink.Send(p)
+}
 
-		if err := sink.Send(p); err != nil {
+//the video frame which can be decoded alone, the sequence header and the metadata of enhanced rtmp are not
+func isKeyframe(p *av.Packet) bool {
+	if !p.IsVideo() {
+		return false
+	}
+	vh := p.GetVideoTagHandler()
+	if vh.FrameType() != flv.FrameTypeKeyFrame {
+		return false
+	}
+	return vh.PacketType() == flv.PacketTypeCodedFrames || vh.PacketType() == flv.PacketTypeCodedFramesX
+}
+
+func (s *Stream) CloseAllSink() {
+	s.sinksMutex.Lock()
+	defer s.sinksMutex.Unlock()
+	for id, sink := range s.sinks {
+		sink.mutex.Lock()
+		if sink.stream == s {
 			if err := sink.Close(); err != nil {
-				log.Errorf("sink Close err: %s", err)
+				log.Warnf("sink Close err: %s", err)
 			}
-			delete(s.sinks, sink.ID())
-			log.Errorf("sink Send err: %s", err)
-			continue
 		}
+		delete(s.sinks, id)
+		sink.mutex.Unlock()
 	}
-	s.sinksMutex.Unlock()
 }
 
-func (s *Stream) CloseAllSink() {
+//Unpublish tells the players that the publisher stops,
+//the players are kept, they get the metadata and sequence headers again when the stream is published again
+func (s *Stream) Unpublish() {
+	s.notifyAllSink(sinkEventUnpublish)
+}
+
+func (s *Stream) notifyAllSink(event sinkEvent) {
 	s.sinksMutex.Lock()
 	defer s.sinksMutex.Unlock()
-	for _, sink := range s.sinks {
-		err := sink.Close()
-		if err != nil {
-			log.Warnf("sink Close err: %s", err)
+	for id, sink := range s.sinks {
+		sink.mutex.Lock()
+		if sink.stream != s {
+			delete(s.sinks, id)
+		} else {
+			sink.initDone = false
+			if err := sink.Send(event); err != nil {
+				delete(s.sinks, id)
+				log.Errorf("sink Send err: %s", err)
+			}
 		}
+		sink.mutex.Unlock()
 	}
 }
 
-func (s *Stream) AddSink(conn *rtmp.Conn) error {
+//AddSink adds the sink of the player, the packets are queued until the sink runs
+func (s *Stream) AddSink(ns *rtmp.NetStream) (*Sink, error) {
 	s.sinksMutex.Lock()
 	defer s.sinksMutex.Unlock()
-	sink := NewSink(conn)
+	sink := NewSink(ns)
+	sink.stream = s
 	s.sinks[sink.ID()] = sink
-	sink.Run()
-	return nil
+	return sink, nil
+}
+
+//RemoveSink stops the sink, the conn of the player is kept
+func (s *Stream) RemoveSink(sink *Sink) {
+	s.sinksMutex.Lock()
+	defer s.sinksMutex.Unlock()
+	delete(s.sinks, sink.ID())
+	sink.stop()
 }
@@ -106,6 +106,9 @@ func (d *CsvDebug) doMessage(m *Message) {
 }
 
 func (d *CsvDebug) Write(m *Message) {
+	if d == nil { //Init is not called, e.g. rtmp client used as a library
+		return
+	}
 	select {
 	case d.ch <- m:
 	default: